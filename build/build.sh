@@ -5,6 +5,7 @@ set -e
 
 # Int vars
 binName="Default"
+buildTags=""
 targetOS=$1
 currentOS="Unknown"
 
@@ -48,6 +49,10 @@ function main() {
 			varLinux
 			build
 		;;
+		[lL][iI][nN][uU][xX][hH][eE][aA][dD][lL][eE][sS][sS])
+			varLinuxHeadless
+			build
+		;;
 	esac
 
 	if [[ "${binName}" == "Default" ]]; then
@@ -102,18 +107,23 @@ function varLinuxARM() {
 	export GOARCH=arm64
 	binName="Ikemen_GO_LinuxARM"
 }
+function varLinuxHeadless() {
+	export GOOS=linux
+	buildTags="headless"
+	binName="Ikemen_GO_LinuxHeadless"
+}
 
 # Build functions.
 function build() {
 	#echo "buildNormal"
 	#echo "$binName"
-	go build -trimpath -v -trimpath -o ./bin/$binName ./src
+	go build -trimpath -v -trimpath -tags "${buildTags}" -o ./bin/$binName ./src
 }
 
 function buildWin() {
 	#echo "buildWin"
 	#echo "$binName"
-	go build -trimpath -v -trimpath -ldflags "-H windowsgui" -o ./bin/$binName ./src
+	go build -trimpath -v -trimpath -tags "${buildTags}" -ldflags "-H windowsgui" -o ./bin/$binName ./src
 }
 
 # Determine the target OS.
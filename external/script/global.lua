@@ -6,6 +6,10 @@ addHotkey('c', true, false, false, true, false, 'toggleClsnDraw()')
 addHotkey('d', true, false, false, true, false, 'toggleDebugDraw()')
 addHotkey('d', false, false, true, true, false, 'toggleDebugDraw(true)')
 addHotkey('w', true, false, false, true, false, 'toggleWireframeDraw()')
+addHotkey('h', true, false, false, true, false, 'toggleInputHistory()')
+addHotkey('f', true, false, false, true, false, 'toggleFrameData()')
+addHotkey('p', true, false, false, true, false, 'toggleProfiler()')
+addHotkey('p', true, false, true, true, false, 'profilerSort()')
 addHotkey('s', true, false, false, true, true, 'changeSpeed()')
 addHotkey('KP_PLUS', true, false, false, true, true, 'changeSpeed(1)')
 addHotkey('KP_MINUS', true, false, false, true, true, 'changeSpeed(-1)')
@@ -42,6 +46,14 @@ addHotkey('i', true, false, false, true, true, 'stand(1);stand(2);stand(3);stand
 addHotkey('PAUSE', false, false, false, true, false, 'togglePause();closeMenu()')
 addHotkey('PAUSE', true, false, false, true, false, 'step()')
 addHotkey('SCROLLLOCK', false, false, false, true, false, 'step()')
+addHotkey('F7', false, false, false, true, false, 'if gamemode("training") then saveState() end')
+addHotkey('F8', false, false, false, true, false, 'if gamemode("training") then loadState() end')
+addHotkey('COMMA', false, false, false, true, false, 'replaySkip(-5)')
+addHotkey('PERIOD', false, false, false, true, false, 'replaySkip(5)')
+addHotkey('COMMA', false, false, true, true, false, 'replaySkipRound(-1)')
+addHotkey('PERIOD', false, false, true, true, false, 'replaySkipRound(1)')
+addHotkey('SLASH', false, false, false, true, false, 'replaySpeed()')
+addHotkey('TAB', false, false, false, true, false, 'toggleReplayTimeline()')
 
 local speedMul = 1
 local speedAdd = 0
@@ -56,6 +68,34 @@ function changeSpeed(add)
 	setAccel(math.max(0.01, speedMul + speedAdd))
 end
 
+--seeks replay playback by a number of seconds
+function replaySkip(sec)
+	local r = replayInfo()
+	if r ~= nil then
+		replaySeek(r.frame + sec * r.fps)
+	end
+end
+
+--moves replay playback to the start of another round
+function replaySkipRound(add)
+	local r = replayInfo()
+	if r ~= nil then
+		replaySeekRound(math.max(1, r.round + add))
+	end
+end
+
+--cycles replay playback speed between x1, x2 and x4
+function replaySpeed()
+	local r = replayInfo()
+	if r ~= nil then
+		if r.speed >= 4 then
+			setAccel(1)
+		else
+			setAccel(r.speed * 2)
+		end
+	end
+end
+
 function toggleAI(p)
 	local oldid = id()
 	if player(p) then
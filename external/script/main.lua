@@ -1504,6 +1504,16 @@ function main.f_commandLine()
 	os.exit()
 end
 
+--measure the frame data of a character against P2, or against itself
+if main.flags['-framedata'] ~= nil then
+	main.flags['-p1'] = main.flags['-framedata']
+	if main.flags['-p2'] == nil then
+		main.flags['-p2'] = main.flags['-framedata']
+	end
+	main.flags['-rounds'] = '1'
+	main.flags['-time'] = '-1'
+end
+
 --initiate quick match only if -loadmotif flag is missing
 if main.flags['-p1'] ~= nil and main.flags['-p2'] ~= nil and main.flags['-loadmotif'] == nil then
 	main.f_commandLine()
@@ -3367,18 +3377,50 @@ function main.f_replay()
 			main.close = true
 		elseif main.f_input(main.t_players, {'pal', 's'}) then
 			sndPlay(motif.files.snd_data, motif[main.group].cursor_done_snd[1], motif[main.group].cursor_done_snd[2])
-			enterReplay(t[item].itemname)
-			synchronize()
-			math.randomseed(sszRandom())
-			main.f_cmdBufReset()
-			main.menu.submenu.server.loop()
-			replayStop()
-			exitNetPlay()
-			exitReplay()
+			local ok, err = enterReplay(t[item].itemname)
+			if not ok then
+				main.f_warning({err}, motif.replaybgdef)
+			elseif replayNextFight() then
+				--offline recordings hold the fights only, each selecting its own characters and stage
+				main.f_cmdBufReset()
+				repeat
+					loadStart()
+					game()
+				until not replayNextFight()
+				exitReplay()
+				esc(false)
+				main.f_bgReset(motif.replaybgdef.bg)
+				main.f_fadeReset('fadein', motif.replay_info)
+				if motif.music.replay_bgm ~= '' then
+					main.f_playBGM(false, motif.music.replay_bgm, motif.music.replay_bgm_loop, motif.music.replay_bgm_volume, motif.music.replay_bgm_loopstart, motif.music.replay_bgm_loopend)
+				end
+			else
+				synchronize()
+				math.randomseed(sszRandom())
+				main.f_cmdBufReset()
+				main.menu.submenu.server.loop()
+				replayStop()
+				exitNetPlay()
+				exitReplay()
+			end
 		end
 	end
 end
 
+--watches a netplay session as a spectator
+function main.f_spectate(server)
+	local ok, err = enterSpectate(server)
+	if not ok then
+		main.f_warning({err}, motif.titlebgdef)
+		return
+	end
+	synchronize()
+	math.randomseed(sszRandom())
+	main.f_cmdBufReset()
+	main.menu.submenu.server.loop()
+	exitReplay()
+end
+
 local txt_connecting = main.f_createTextImg(motif.title_info, 'connecting')
 local overlay_connecting = main.f_createOverlay(motif.title_info, 'connecting_overlay')
 function main.f_connect(server, t)
@@ -4136,6 +4178,10 @@ if main.flags['-p1'] ~= nil and main.flags['-p2'] ~= nil then
 	main.f_commandLine()
 end
 
+if main.flags['-spectate'] ~= nil then
+	main.f_spectate(main.flags['-spectate'])
+end
+
 if main.flags['-stresstest'] ~= nil then
 	main.f_default()
 	local frameskip = tonumber(main.flags['-stresstest'])
@@ -58,6 +58,19 @@ menu.t_valuename = {
 		{itemname = 'd', displayname = motif.training_info.menu_valuename_buttonjam_d},
 		{itemname = 'w', displayname = motif.training_info.menu_valuename_buttonjam_w},
 	},
+	inputslot = {
+		{itemname = '1', displayname = motif.training_info.menu_valuename_inputslot_1},
+		{itemname = '2', displayname = motif.training_info.menu_valuename_inputslot_2},
+		{itemname = '3', displayname = motif.training_info.menu_valuename_inputslot_3},
+		{itemname = '4', displayname = motif.training_info.menu_valuename_inputslot_4},
+		{itemname = '5', displayname = motif.training_info.menu_valuename_inputslot_5},
+	},
+	playback = {
+		{itemname = 'off', displayname = motif.training_info.menu_valuename_playback_off},
+		{itemname = 'once', displayname = motif.training_info.menu_valuename_playback_once},
+		{itemname = 'loop', displayname = motif.training_info.menu_valuename_playback_loop},
+		{itemname = 'random', displayname = motif.training_info.menu_valuename_playback_random},
+	},
 }
 
 -- Shared logic for training menu option change, returns 2 values:
@@ -169,6 +182,36 @@ menu.t_itemname = {
 		end
 		return true
 	end,
+	--Input Slot
+	['inputslot'] = function(t, item, cursorPosY, moveTxt, section)
+		if menu.f_valueChanged(t.items[item], motif[section]) then
+			menu.f_inputPlayback()
+		end
+		return true
+	end,
+	--Record
+	['record'] = function(t, item, cursorPosY, moveTxt, section)
+		if main.f_input(main.t_players, {'pal', 's'}) then
+			sndPlay(motif.files.snd_data, motif[section].cursor_done_snd[1], motif[section].cursor_done_snd[2])
+			-- Manual dummy control lets the dummy itself be recorded
+			local pn = 1
+			if menu.t_valuename.dummycontrol[menu.dummycontrol or 1].itemname == 'manual' then
+				pn = 2
+			end
+			trainingInputRecord(pn, menu.inputslot or 1)
+			togglePause(false)
+			main.pauseMenu = false
+			return false
+		end
+		return true
+	end,
+	--Playback
+	['playback'] = function(t, item, cursorPosY, moveTxt, section)
+		if menu.f_valueChanged(t.items[item], motif[section]) then
+			menu.f_inputPlayback()
+		end
+		return true
+	end,
 	--Key Config
 	['keyboard'] = function(t, item, cursorPosY, moveTxt, section)
 		if main.f_input(main.t_players, {'pal', 's'}) --[[or getKey('F1')]] then
@@ -331,6 +374,12 @@ menu.t_vardisplay = {
 	['buttonjam'] = function()
 		return menu.t_valuename.buttonjam[menu.buttonjam or 1].displayname
 	end,
+	['inputslot'] = function()
+		return menu.t_valuename.inputslot[menu.inputslot or 1].displayname
+	end,
+	['playback'] = function()
+		return menu.t_valuename.playback[menu.playback or 1].displayname
+	end,
 }
 
 -- Returns setting value rendered alongside menu item name (calls appropriate
@@ -477,6 +526,18 @@ function menu.f_trainingReset()
 	charMapSet(2, '_iksys_trainingFallRecovery', 0)
 	charMapSet(2, '_iksys_trainingDistance', 0)
 	charMapSet(2, '_iksys_trainingButtonJam', 0)
+	trainingInputStop()
+end
+
+-- Starts the dummy's playback of the recorded inputs selected in the training
+-- menu, from the start of the recording
+function menu.f_inputPlayback()
+	local mode = menu.t_valuename.playback[menu.playback or 1].itemname
+	if mode == 'off' then
+		trainingInputStop()
+	else
+		trainingInputPlay(2, menu.inputslot or 1, mode)
+	end
 end
 
 menu.movelistChar = 1
@@ -486,6 +547,8 @@ function menu.f_init()
 	main.pauseMenu = true
 	main.f_bgReset(motif.optionbgdef.bg)
 	if gamemode('training') then
+		-- Opening the menu ends a recording, and restarts the playback
+		menu.f_inputPlayback()
 		sndPlay(motif.files.snd_data, motif.training_info.enter_snd[1], motif.training_info.enter_snd[2])
 		main.f_bgReset(motif.trainingbgdef.bg)
 		main.f_fadeReset('fadein', motif.training_info)
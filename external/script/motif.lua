@@ -1153,6 +1153,11 @@ local motif =
 		menu_valuename_no = 'No', --Ikemen feature
 		menu_valuename_enabled = 'Enabled', --Ikemen feature
 		menu_valuename_disabled = 'Disabled', --Ikemen feature
+		menu_valuename_socdresolution_0 = 'Allow Both', --Ikemen feature
+		menu_valuename_socdresolution_1 = 'Last Input', --Ikemen feature
+		menu_valuename_socdresolution_2 = 'Absolute', --Ikemen feature
+		menu_valuename_socdresolution_3 = 'First Input', --Ikemen feature
+		menu_valuename_socdresolution_4 = 'Neutral', --Ikemen feature
 		keymenu_p1_pos = {39, 33}, --Ikemen feature
 		keymenu_p2_pos = {178, 33}, --Ikemen feature
 		--keymenu_bg_<itemname>_anim = -1, --Ikemen feature
@@ -1265,6 +1270,9 @@ local motif =
 		--menu_itemname_panningrange = "Panning Range", --Ikemen feature
 		--menu_itemname_keyboard = 'Key Config', --Ikemen feature
 		--menu_itemname_gamepad = 'Joystick Config', --Ikemen feature
+		--menu_itemname_socdresolution = 'SOCD Resolution', --Ikemen feature
+		--menu_itemname_buttonassist = 'Button Assist', --Ikemen feature
+		--menu_itemname_sticksensitivity = 'Stick Sensitivity', --Ikemen feature
 		--menu_itemname_inputdefault = 'Default', --Ikemen feature
 		--menu_itemname_players = 'Players', --Ikemen feature
 		--menu_itemname_debugkeys = 'Debug Keys', --Ikemen feature
@@ -1502,6 +1510,15 @@ local motif =
 		menu_valuename_buttonjam_s = "Start", --Ikemen feature
 		menu_valuename_buttonjam_d = "D", --Ikemen feature
 		menu_valuename_buttonjam_w = "W", --Ikemen feature
+		menu_valuename_inputslot_1 = "1", --Ikemen feature
+		menu_valuename_inputslot_2 = "2", --Ikemen feature
+		menu_valuename_inputslot_3 = "3", --Ikemen feature
+		menu_valuename_inputslot_4 = "4", --Ikemen feature
+		menu_valuename_inputslot_5 = "5", --Ikemen feature
+		menu_valuename_playback_off = "Off", --Ikemen feature
+		menu_valuename_playback_once = "Once", --Ikemen feature
+		menu_valuename_playback_loop = "Loop", --Ikemen feature
+		menu_valuename_playback_random = "Random", --Ikemen feature
 		--menu_itemname_dummycontrol = "Dummy Control", --Ikemen feature
 		--menu_itemname_ailevel = "AI Level", --Ikemen feature
 		--menu_itemname_dummymode = "Dummy Mode", --Ikemen feature
@@ -1509,6 +1526,9 @@ local motif =
 		--menu_itemname_fallrecovery = "Fall Recovery", --Ikemen feature
 		--menu_itemname_distance = "Distance", --Ikemen feature
 		--menu_itemname_buttonjam = "Button Jam", --Ikemen feature
+		--menu_itemname_inputslot = "Input Slot", --Ikemen feature
+		--menu_itemname_record = "Record", --Ikemen feature
+		--menu_itemname_playback = "Playback", --Ikemen feature
 	},
 	trainingbgdef =
 	{
@@ -2039,6 +2059,9 @@ function motif.setBaseOptionInfo()
 	motif.option_info.menu_itemname_menuinput = "Input Settings"
 	motif.option_info.menu_itemname_menuinput_keyboard = "Key Config"
 	motif.option_info.menu_itemname_menuinput_gamepad = "Joystick Config"
+	motif.option_info.menu_itemname_menuinput_socdresolution = "SOCD Resolution"
+	motif.option_info.menu_itemname_menuinput_buttonassist = "Button Assist"
+	motif.option_info.menu_itemname_menuinput_sticksensitivity = "Stick Sensitivity"
 	motif.option_info.menu_itemname_menuinput_empty = ""
 	motif.option_info.menu_itemname_menuinput_inputdefault = "Default"
 	motif.option_info.menu_itemname_menuinput_back = "Back"
@@ -2159,6 +2182,9 @@ function motif.setBaseOptionInfo()
 		"menuinput",
 		"menuinput_keyboard",
 		"menuinput_gamepad",
+		"menuinput_socdresolution",
+		"menuinput_buttonassist",
+		"menuinput_sticksensitivity",
 		"menuinput_empty",
 		"menuinput_inputdefault",
 		"menuinput_back",
@@ -2226,6 +2252,9 @@ function motif.setBaseTrainingInfo()
 	motif.training_info.menu_itemname_menutraining_fallrecovery = "Fall Recovery"
 	motif.training_info.menu_itemname_menutraining_distance = "Distance"
 	motif.training_info.menu_itemname_menutraining_buttonjam = "Button Jam"
+	motif.training_info.menu_itemname_menutraining_inputslot = "Input Slot"
+	motif.training_info.menu_itemname_menutraining_record = "Record"
+	motif.training_info.menu_itemname_menutraining_playback = "Playback"
 	motif.training_info.menu_itemname_menutraining_back = "Back"
 	motif.training_info.menu_itemname_menuinput = "Button Config"
 	motif.training_info.menu_itemname_menuinput_keyboard = "Key Config"
@@ -2251,6 +2280,9 @@ function motif.setBaseTrainingInfo()
 		"menutraining_fallrecovery",
 		"menutraining_distance",
 		"menutraining_buttonjam",
+		"menutraining_inputslot",
+		"menutraining_record",
+		"menutraining_playback",
 		"menutraining_back",
 		"menuinput",
 		"menuinput_keyboard",
@@ -26,6 +26,14 @@ function options.f_precision(v, decimal)
 	return tonumber(string.format(decimal, v))
 end
 
+--applies an input setting to every player, stored in their KeyConfig entries by setInputSettings
+function options.f_setInputSettings(key, value)
+	for pn = 1, #config.KeyConfig do
+		setInputSettings(pn, {[key] = value})
+	end
+	options.modified = true
+end
+
 --save configuration
 function options.f_saveCfg(reload)
 	--Data saving to config.json
@@ -985,6 +993,43 @@ options.t_itemname = {
 		end
 		return true
 	end,
+	--SOCD Resolution
+	['socdresolution'] = function(t, item, cursorPosY, moveTxt)
+		local socd = getInputSettings(1).SOCDResolution
+		if main.f_input(main.t_players, {'$F'}) and socd < 4 then
+			sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+			options.f_setInputSettings('SOCDResolution', socd + 1)
+			t.items[item].vardisplay = options.f_vardisplay('socdresolution')
+		elseif main.f_input(main.t_players, {'$B'}) and socd > 0 then
+			sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+			options.f_setInputSettings('SOCDResolution', socd - 1)
+			t.items[item].vardisplay = options.f_vardisplay('socdresolution')
+		end
+		return true
+	end,
+	--Button Assist
+	['buttonassist'] = function(t, item, cursorPosY, moveTxt)
+		if main.f_input(main.t_players, {'$F', '$B', 'pal', 's'}) then
+			sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+			options.f_setInputSettings('ButtonAssist', not getInputSettings(1).ButtonAssist)
+			t.items[item].vardisplay = options.f_vardisplay('buttonassist')
+		end
+		return true
+	end,
+	--Stick Sensitivity
+	['sticksensitivity'] = function(t, item, cursorPosY, moveTxt)
+		local sensitivity = options.f_precision(getInputSettings(1).StickSensitivity, '%.02f')
+		if main.f_input(main.t_players, {'$F'}) and sensitivity < 1 then
+			sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+			options.f_setInputSettings('StickSensitivity', math.min(1, sensitivity + 0.05))
+			t.items[item].vardisplay = options.f_vardisplay('sticksensitivity')
+		elseif main.f_input(main.t_players, {'$B'}) and sensitivity > 0.05 then
+			sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+			options.f_setInputSettings('StickSensitivity', math.max(0.05, sensitivity - 0.05))
+			t.items[item].vardisplay = options.f_vardisplay('sticksensitivity')
+		end
+		return true
+	end,
 	--Key Config
 	['keyboard'] = function(t, item, cursorPosY, moveTxt)
 		if main.f_input(main.t_players, {'pal', 's'}) --[[or getKey():match('^F[0-9]+$')]] then
@@ -1286,6 +1331,9 @@ options.t_vardisplay = {
 	['bgmvolume'] = function()
 		return config.VolumeBgm .. '%'
 	end,
+	['buttonassist'] = function()
+		return options.f_boolDisplay(getInputSettings(1).ButtonAssist, motif.option_info.menu_valuename_enabled, motif.option_info.menu_valuename_disabled)
+	end,
 	['credits'] = function()
 		return options.f_definedDisplay(config.Credits, {[0] = motif.option_info.menu_valuename_disabled}, config.Credits)
 	end,
@@ -1421,9 +1469,15 @@ options.t_vardisplay = {
 	['singlevsteamlife'] = function()
 		return config.Team1VS2Life .. '%'
 	end,
+	['socdresolution'] = function()
+		return motif.option_info['menu_valuename_socdresolution_' .. getInputSettings(1).SOCDResolution]
+	end,
 	['stereoeffects'] = function()
 		return options.f_boolDisplay(config.StereoEffects, motif.option_info.menu_valuename_enabled, motif.option_info.menu_valuename_disabled)
 	end,
+	['sticksensitivity'] = function()
+		return options.f_precision(getInputSettings(1).StickSensitivity, '%.02f')
+	end,
 	['stunbar'] = function()
 		return options.f_boolDisplay(config.BarStun)
 	end,
@@ -0,0 +1,226 @@
+package main
+
+// AIController decides the inputs of a player controlled by the computer.
+// It is called once per frame for each AI player and returns the buttons and
+// directions (IB_PL and IB_PR are screen directions, not back and forward) to
+// hold on that frame. Controllers must not keep any state of their own: what
+// they remember between frames goes in the player's AiInput, which is saved
+// and restored along with the rest of the match for rollback and replays.
+// Any randomness has to come from Rand, so that every machine in a netplay
+// session and every playback of a replay makes the same decisions.
+type AIController interface {
+	Update(ai *AiInput, c *Char, level float32) InputBits
+}
+
+type AIControllerType int32
+
+const (
+	AI_Random AIControllerType = iota
+	AI_Heuristic
+)
+
+var aiControllerNames = [...]string{"random", "heuristic"}
+
+var aiControllers = [...]AIController{randomAI{}, heuristicAI{}}
+
+// Returns the controller named in the configuration, or the random one if
+// the name is not known
+func aiControllerByName(name string) AIControllerType {
+	for i, n := range aiControllerNames {
+		if n == name {
+			return AIControllerType(i)
+		}
+	}
+	return AI_Random
+}
+
+func (t AIControllerType) String() string {
+	if t >= 0 && int(t) < len(aiControllerNames) {
+		return aiControllerNames[t]
+	}
+	return aiControllerNames[AI_Random]
+}
+
+func (t AIControllerType) controller() AIController {
+	if t >= 0 && int(t) < len(aiControllers) {
+		return aiControllers[t]
+	}
+	return aiControllers[AI_Random]
+}
+
+// The controller used in the current match. Netplay sessions use the one of
+// the host, and replays the one they were recorded with.
+func currentAIController() AIControllerType {
+	if sys.netInput != nil {
+		return sys.netInput.aiController
+	} else if sys.fileInput != nil {
+		return sys.fileInput.aiController
+	}
+	return sys.aiController
+}
+
+type AiInput struct {
+	ib InputBits // Inputs of the current frame
+	// Random controller
+	dir, dirt, at, bt, ct, xt, yt, zt, st, dt, wt, mt int32
+	// Heuristic controller
+	act     InputBits // Inputs held until actTime runs out
+	actTime int32
+	threat  bool  // Whether the opponent is attacking nearby
+	react   int32 // Frames left before guarding against it
+}
+
+func (ai *AiInput) Update(pn int, level float32) {
+	// Not during intros and win poses
+	if sys.intro != 0 {
+		*ai = AiInput{}
+		return
+	}
+	var c *Char
+	if pn < len(sys.chars) && len(sys.chars[pn]) > 0 {
+		c = sys.chars[pn][0]
+	}
+	ai.ib = currentAIController().controller().Update(ai, c, level)
+}
+
+// AI button jamming
+type randomAI struct{}
+
+func (randomAI) Update(ai *AiInput, c *Char, level float32) InputBits {
+	var chance, time int32 = 15, 60
+	jam := func(t *int32) bool {
+		(*t)--
+		if *t <= 0 {
+			// TODO: Balance AI Scaling
+			if Rand(1, chance) == 1 {
+				*t = Rand(1, time)
+				return true
+			}
+			*t = 0
+		}
+		return false
+	}
+	// Pick a random direction to press
+	if jam(&ai.dirt) {
+		ai.dir = Rand(0, 7)
+	}
+	chance, time = int32((-11.25*level+165)*7), 30
+	jam(&ai.at)
+	jam(&ai.bt)
+	jam(&ai.ct)
+	jam(&ai.xt)
+	jam(&ai.yt)
+	jam(&ai.zt)
+	jam(&ai.dt)
+	jam(&ai.wt)
+	chance = 3600 // Start is jammed less often
+	jam(&ai.st)
+	//jam(&ai.mt) // We really don't need the AI to jam the menu button
+
+	var ib InputBits
+	// 0 = U, 1 = UR, 2 = R, 3 = DR, 4 = D, 5 = DL, 6 = L, 7 = UL
+	if ai.dirt != 0 {
+		switch ai.dir {
+		case 7, 0, 1:
+			ib |= IB_PU
+		case 3, 4, 5:
+			ib |= IB_PD
+		}
+		switch ai.dir {
+		case 5, 6, 7:
+			ib |= IB_PL
+		case 1, 2, 3:
+			ib |= IB_PR
+		}
+	}
+	for _, b := range [...]struct {
+		t  int32
+		ib InputBits
+	}{{ai.at, IB_A}, {ai.bt, IB_B}, {ai.ct, IB_C}, {ai.xt, IB_X}, {ai.yt, IB_Y},
+		{ai.zt, IB_Z}, {ai.st, IB_S}, {ai.dt, IB_D}, {ai.wt, IB_W}, {ai.mt, IB_M}} {
+		if b.t != 0 {
+			ib |= b.ib
+		}
+	}
+	return ib
+}
+
+// A generic opponent for characters without AI of their own. It walks into
+// range and attacks, guards when the opponent attacks nearby and answers
+// jump-ins with a crouching punch. It knows nothing about the character's
+// moves, only the buttons most of them share. The level sets how fast and how
+// often it reacts.
+type heuristicAI struct{}
+
+func (heuristicAI) Update(ai *AiInput, c *Char, level float32) InputBits {
+	var p2 *Char
+	if c != nil {
+		p2 = c.p2()
+	}
+	if p2 == nil || sys.roundState() != 2 {
+		ai.act, ai.actTime, ai.threat = 0, 0, false
+		return 0
+	}
+	lv := int32(ClampF(level, 1, 8))
+	// Distances in the character's own coordinates, scaled to a 320 pixel
+	// wide screen
+	unit := c.stOgi().localcoord[0] / 320
+	dist := c.facing * c.bodyDistX(p2, c) / unit
+	height := -c.distY(p2, c) / unit
+	fwd, back := IB_PR, IB_PL
+	if c.facing < 0 {
+		fwd, back = IB_PL, IB_PR
+	}
+	// Guard against attacks from up close, after a reaction time that
+	// shortens as the level goes up
+	if p2.ss.moveType == MT_A && dist < 80 {
+		if !ai.threat {
+			ai.threat, ai.react = true, Rand(0, 2*(8-lv))
+		}
+		if ai.react > 0 {
+			ai.react--
+		} else if Rand(1, 10) <= lv+2 {
+			ai.act, ai.actTime = back, Rand(4, 10)
+			if p2.ss.stateType == ST_C {
+				ai.act |= IB_PD
+			}
+		}
+	} else {
+		ai.threat = false
+	}
+	if ai.actTime > 0 {
+		ai.actTime--
+		return ai.act
+	}
+	ai.act = 0
+	if !c.ctrl() || Rand(1, 12) > lv+4 {
+		// Hesitate for a moment, more often at low levels
+		ai.actTime = Rand(1, 9-lv)
+		return 0
+	}
+	switch {
+	case p2.ss.stateType == ST_A && height > 20 && dist < 60 && p2.vel[1] > 0:
+		// Anti-air a falling opponent
+		if Rand(1, 8) <= lv {
+			ai.act, ai.actTime = IB_PD|[...]InputBits{IB_Y, IB_Z}[Rand(0, 1)], 2
+		}
+	case dist > 40:
+		// Close in, sometimes with a jump
+		if Rand(1, 30) == 1 {
+			ai.act, ai.actTime = IB_PU|fwd, 3
+		} else {
+			ai.act, ai.actTime = fwd, Rand(5, 20)
+		}
+	case Rand(1, 10) == 1:
+		// Back off to reset the spacing
+		ai.act, ai.actTime = back, Rand(5, 15)
+	default:
+		// Attack, crouching now and then
+		ai.act = [...]InputBits{IB_A, IB_B, IB_C, IB_X, IB_Y, IB_Z}[Rand(0, 5)]
+		if Rand(1, 3) == 1 {
+			ai.act |= IB_PD
+		}
+		ai.actTime = Rand(1, 3)
+	}
+	return ai.act
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A bot is an external process that plays as one of the players, set with
+// -p<n>.bot <address>. The engine connects to the bot at the address, which
+// is a TCP host:port or unix:<path> for a Unix socket, when it starts. The
+// player must be human controlled (no -p<n>.ai), and the bot takes the place
+// of its keyboard or joystick for every match of the session.
+//
+// All values are little-endian. On connecting, the engine sends the magic
+// "IKBT", the protocol version as an int32 and the player number of the bot
+// as an int32 (1 for P1). Then, after every game tick of a fight, it sends an
+// observation:
+//
+//	int32    size in bytes of the rest of the observation
+//	int32    game time, the number of ticks since the match started
+//	int32    round state: 0 = pre-intro, 1 = intro, 2 = fight, 3 = KO,
+//	         4 = win poses
+//	int32    round number, starting at 1
+//	int32    round time left in ticks, or -1 when there is no time limit
+//	int32    number of chars that follow
+//
+// followed by each player and helper, players first:
+//
+//	int32    player number, starting at 1
+//	int32    helper ID, 0 for the player itself
+//	int32    team side, 1 or 2
+//	int32    facing, 1 for right and -1 for left
+//	float32  position x and y (y is 0 on the ground and negative above it)
+//	float32  velocity x and y, in screen directions
+//	int32    life, max life, power and max power
+//	int32    state number
+//	int32    state type: 0 = standing, 1 = crouching, 2 = air, 3 = lying
+//	int32    move type: 0 = idle, 1 = attacking, 2 = being hit
+//	int32    1 if the char has control, 0 otherwise
+//	int32    animation number and current element, starting at 1
+//	int32    number of attack boxes (Clsn1)
+//	float32  left, top, right and bottom of the area covered by the attack boxes
+//	int32    number of hurt boxes (Clsn2)
+//	float32  left, top, right and bottom of the area covered by the hurt boxes
+//
+// Positions and boxes are in stage coordinates, which have 320 units across
+// a 4:3 screen whatever the localcoord of the chars. The bot answers each
+// observation with the InputBits to hold on the next tick as an int32, the
+// same bits replays store: 1 up, 2 down, 4 left, 8 right (screen directions,
+// not back and forward), then 16 a, 32 b, 64 c, 128 x, 256 y, 512 z, 1024 s,
+// 2048 d, 4096 w and 8192 m.
+//
+// By default the match runs in real time, using the latest answer from the
+// bot on each tick, and observations the bot has not read yet are dropped.
+// With -botlockstep the engine waits for the answer to every observation
+// before running the next tick, so bots can take as long as they need.
+const (
+	BotMagic   = "IKBT"
+	BotVersion = 1
+)
+
+// Time allowed to connect to a bot
+const botTimeout = 10 * time.Second
+
+type BotInput struct {
+	bots     [MaxSimul*2 + MaxAttachedChar]*botConn
+	lockstep bool
+}
+
+type botConn struct {
+	pn   int
+	conn net.Conn
+	r    *bufio.Reader
+	ib   int32 // Latest answer, the InputBits of the player
+	obs  chan []byte
+	dead int32 // Set when the connection has failed in real time mode
+}
+
+// Connects to the bots given on the command line, or returns nil if there
+// are none
+func NewBotInput() (*BotInput, error) {
+	bi := &BotInput{}
+	_, bi.lockstep = sys.cmdFlags["-botlockstep"]
+	re := regexp.MustCompile(`^-p([0-9]+)\.bot$`)
+	found := false
+	for k, addr := range sys.cmdFlags {
+		m := re.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		pn, _ := strconv.Atoi(m[1])
+		if pn < 1 || pn > len(bi.bots) {
+			return nil, Error("Invalid bot player: " + k)
+		}
+		b, err := dialBot(pn-1, addr)
+		if err != nil {
+			bi.Close()
+			return nil, Error("Can not connect to the bot of P" + m[1] + ": " + err.Error())
+		}
+		bi.bots[pn-1] = b
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	if !bi.lockstep {
+		for _, b := range bi.bots {
+			if b != nil {
+				go b.receive()
+				go b.send()
+			}
+		}
+	}
+	return bi, nil
+}
+
+func dialBot(pn int, addr string) (*botConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", addr[len("unix:"):]
+	}
+	conn, err := net.DialTimeout(network, addr, botTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(BotMagic)
+	binary.Write(&b, binary.LittleEndian, [...]int32{BotVersion, int32(pn + 1)})
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &botConn{pn: pn, conn: conn, r: bufio.NewReader(conn),
+		obs: make(chan []byte, 1)}, nil
+}
+
+func (bc *botConn) receive() {
+	for {
+		var ib int32
+		if err := binary.Read(bc.r, binary.LittleEndian, &ib); err != nil {
+			bc.fail(err)
+			return
+		}
+		atomic.StoreInt32(&bc.ib, ib)
+	}
+}
+
+func (bc *botConn) send() {
+	for b := range bc.obs {
+		if _, err := bc.conn.Write(b); err != nil {
+			bc.fail(err)
+			return
+		}
+	}
+}
+
+func (bc *botConn) fail(err error) {
+	if atomic.CompareAndSwapInt32(&bc.dead, 0, 1) {
+		atomic.StoreInt32(&bc.ib, 0)
+		if err != io.EOF {
+			sys.errLog.Printf("Bot of P%v disconnected: %v\n", bc.pn+1, err)
+		}
+	}
+}
+
+// Sends the state after a game tick to the bots and gets their inputs for
+// the next one
+func (bi *BotInput) Update() {
+	obs := newBotObservation()
+	for i, b := range bi.bots {
+		if b == nil {
+			continue
+		}
+		if !bi.lockstep {
+			if atomic.LoadInt32(&b.dead) != 0 {
+				continue
+			}
+			// A bot that has not read the previous observation yet misses
+			// this one
+			select {
+			case b.obs <- obs:
+			default:
+			}
+			continue
+		}
+		var ib int32
+		_, err := b.conn.Write(obs)
+		if err == nil {
+			err = binary.Read(b.r, binary.LittleEndian, &ib)
+		}
+		if err != nil {
+			b.fail(err)
+			b.conn.Close()
+			bi.bots[i] = nil
+			continue
+		}
+		b.ib = ib
+	}
+}
+
+// Reads the inputs of player i if it is played by a bot
+func (bi *BotInput) Input(cb *CommandBuffer, i int, facing int32) bool {
+	if i < 0 || i >= len(bi.bots) || bi.bots[i] == nil {
+		return false
+	}
+	InputBits(atomic.LoadInt32(&bi.bots[i].ib)).BitsToKeys(cb, facing,
+		sys.matchInputSettings[i].SOCDResolution)
+	return true
+}
+
+func (bi *BotInput) Close() {
+	for i, b := range bi.bots {
+		if b != nil {
+			if !bi.lockstep {
+				close(b.obs)
+			}
+			b.conn.Close()
+			bi.bots[i] = nil
+		}
+	}
+}
+
+// Observation sent to the bots, including the size prefix
+func newBotObservation() []byte {
+	var chars []*Char
+	for _, p := range sys.chars {
+		if len(p) > 0 {
+			chars = append(chars, p[0])
+		}
+	}
+	for _, p := range sys.chars {
+		if len(p) == 0 {
+			continue
+		}
+		for _, c := range p[1:] {
+			if !c.csf(CSF_destroy) {
+				chars = append(chars, c)
+			}
+		}
+	}
+	var b bytes.Buffer
+	w := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	w([...]int32{0, sys.gameTime, sys.roundState(), sys.round, sys.time,
+		int32(len(chars))})
+	for _, c := range chars {
+		w([...]int32{int32(c.playerNo + 1), c.helperId, int32(c.teamside + 1),
+			int32(c.facing)})
+		ls := c.localscl
+		w([...]float32{c.pos[0] * ls, c.pos[1] * ls,
+			c.vel[0] * c.facing * ls, c.vel[1] * ls})
+		var st, mt int32
+		switch c.ss.stateType {
+		case ST_C:
+			st = 1
+		case ST_A:
+			st = 2
+		case ST_L:
+			st = 3
+		}
+		switch c.ss.moveType {
+		case MT_A:
+			mt = 1
+		case MT_H:
+			mt = 2
+		}
+		var elem int32
+		if c.anim != nil {
+			elem = c.anim.current + 1
+		}
+		w([...]int32{c.life, c.lifeMax, c.power, c.powerMax, c.ss.no, st, mt,
+			Btoi(c.ctrl()), c.animNo, elem})
+		var clsn1, clsn2 []float32
+		if c.curFrame != nil {
+			clsn1, clsn2 = c.curFrame.Clsn1(), c.curFrame.Clsn2()
+		}
+		for _, clsn := range [...][]float32{clsn1, clsn2} {
+			n, box := botBoxes(c, clsn, ls)
+			w(n)
+			w(box)
+		}
+	}
+	data := b.Bytes()
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
+
+// Number of boxes and the area they cover, in the coordinates scaled by ls
+func botBoxes(c *Char, clsn []float32, ls float32) (int32, [4]float32) {
+	n := int32(len(clsn) / 4)
+	if n == 0 {
+		return 0, [4]float32{}
+	}
+	box := [...]float32{float32(math.Inf(1)), float32(math.Inf(1)),
+		float32(math.Inf(-1)), float32(math.Inf(-1))}
+	xs, ys := c.facing*c.clsnScale[0]*ls, c.clsnScale[1]*ls
+	x, y := c.pos[0]*ls, c.pos[1]*ls
+	for i := int32(0); i < n; i++ {
+		l, r := x+clsn[i*4]*xs, x+clsn[i*4+2]*xs
+		if l > r {
+			l, r = r, l
+		}
+		box[0], box[2] = MinF(box[0], l), MaxF(box[2], r)
+		box[1] = MinF(box[1], y+clsn[i*4+1]*ys)
+		box[3] = MaxF(box[3], y+clsn[i*4+3]*ys)
+	}
+	return n, box
+}
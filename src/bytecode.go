@@ -636,6 +636,7 @@ const (
 	OC_ex_fightscreenvar_round_over_wintime
 	OC_ex_fightscreenvar_round_slow_time
 	OC_ex_fightscreenvar_round_start_waittime
+	OC_ex_simplespecials
 )
 const (
 	OC_ex2_index OpCode = iota
@@ -685,6 +686,7 @@ const (
 	OC_ex2_gameoption_sound_bgmvolume
 	OC_ex2_gameoption_sound_maxvolume
 	OC_ex2_groundlevel
+	OC_ex2_debugtrigger
 )
 const (
 	NumVar     = 60
@@ -1123,6 +1125,9 @@ func (BytecodeExp) lerp(v1 *BytecodeValue, v2 BytecodeValue, v3 BytecodeValue) {
 	v1.SetF(float32(v1.v + (v2.v-v1.v)*amount))
 }
 func (be BytecodeExp) run(c *Char) BytecodeValue {
+	if sys.profiler != nil && !sys.profiler.inExp {
+		return sys.profiler.exp(be, c)
+	}
 	oc := c
 	for i := 1; i <= len(be); i++ {
 		switch be[i-1] {
@@ -2653,6 +2658,8 @@ func (be BytecodeExp) run_ex(c *Char, i *int, oc *Char) {
 		sys.bcStack.PushI(c.alphaTrg[0])
 	case OC_ex_alpha_d:
 		sys.bcStack.PushI(c.alphaTrg[1])
+	case OC_ex_simplespecials:
+		sys.bcStack.PushB(c.simpleSpecials())
 	case OC_ex_selfcommand:
 		if c.cmd == nil {
 			sys.bcStack.PushB(false)
@@ -2793,6 +2800,9 @@ func (be BytecodeExp) run_ex2(c *Char, i *int, oc *Char) {
 		sys.bcStack.PushI(int32(sys.wavVolume))
 	case OC_ex2_groundlevel:
 		sys.bcStack.PushF(c.groundLevel)
+	case OC_ex2_debugtrigger:
+		sys.debugger.trigger(int(*(*int32)(unsafe.Pointer(&be[*i]))), *sys.bcStack.Top())
+		*i += 4
 	default:
 		sys.errLog.Printf("%v\n", be[*i-1])
 		c.panic()
@@ -2943,7 +2953,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 			}
 			// Run state controllers
 			if !interrupt {
-				for _, sc := range b.ctrls {
+				for i, sc := range b.ctrls {
 					switch sc.(type) {
 					case StateBlock:
 					default:
@@ -2951,7 +2961,17 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 							continue
 						}
 					}
-					if sc.Run(c, ps) {
+					if sys.debugger != nil {
+						sys.debugger.ctrl(b.ctrls, i)
+					}
+					var changeState bool
+					// Blocks are not timed, the controllers in them are
+					if _, ok := sc.(StateBlock); !ok && sys.profiler != nil {
+						changeState = sys.profiler.ctrl(sc, c, ps)
+					} else {
+						changeState = sc.Run(c, ps)
+					}
+					if changeState {
 						if sys.loopBreak {
 							sys.loopBreak = false
 							interrupt = true
@@ -2996,7 +3016,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 			}
 			return false
 		}
-		for _, sc := range b.ctrls {
+		for i, sc := range b.ctrls {
 			switch sc.(type) {
 			case StateBlock:
 			default:
@@ -3004,7 +3024,16 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 					continue
 				}
 			}
-			if sc.Run(c, ps) {
+			if sys.debugger != nil {
+				sys.debugger.ctrl(b.ctrls, i)
+			}
+			var changeState bool
+			if _, ok := sc.(StateBlock); !ok && sys.profiler != nil {
+				changeState = sys.profiler.ctrl(sc, c, ps)
+			} else {
+				changeState = sc.Run(c, ps)
+			}
+			if changeState {
 				return true
 			}
 		}
@@ -10122,10 +10151,12 @@ type StateBytecode struct {
 	moveType  MoveType
 	physics   StateType
 	playerNo  int
+	no        int32
 	stateDef  stateDef
 	block     StateBlock
 	ctrlsps   []int32
 	numVars   int32
+	debug     *stateDebugInfo // Only with the debugger on
 }
 
 // StateDef bytecode creation function
@@ -10157,9 +10188,18 @@ func (sb *StateBytecode) init(c *Char) {
 	sb.stateDef.Run(c)
 }
 func (sb *StateBytecode) run(c *Char) (changeState bool) {
+	if sys.profiler != nil {
+		defer sys.profiler.state(c, sb, sys.profiler.begin())
+	}
 	sys.bcVar = sys.bcVarStack.Alloc(int(sb.numVars))
 	sys.workingState = sb
-	changeState = sb.block.Run(c, sb.ctrlsps)
+	if sys.debugger != nil {
+		sys.debugger.enterState(c, sb)
+		changeState = sb.block.Run(c, sb.ctrlsps)
+		sys.debugger.exitState()
+	} else {
+		changeState = sb.block.Run(c, sb.ctrlsps)
+	}
 	if len(sys.bcStack) != 0 {
 		sys.errLog.Println(sys.cgi[sb.playerNo].def)
 		for _, v := range sys.bcStack {
@@ -2281,6 +2281,42 @@ func (c *Char) ocd() *OverrideCharData {
 	}
 	return &sys.sel.ocd[c.teamside][c.memberNo]
 }
+
+// Constants of every character, before those of its own cns file
+func commonConstants(def string) (map[string]float32, error) {
+	constants := make(map[string]float32)
+	constants["default.attack.lifetopowermul"] = 0.7
+	constants["default.gethit.lifetopowermul"] = 0.6
+	constants["super.targetdefencemul"] = 1.5
+	constants["default.lifetoguardpointsmul"] = 1.5
+	constants["super.lifetoguardpointsmul"] = -0.33
+	constants["default.lifetodizzypointsmul"] = 1.8
+	constants["super.lifetodizzypointsmul"] = 0
+	constants["default.lifetoredlifemul"] = 0.75
+	constants["super.lifetoredlifemul"] = 0.75
+	constants["default.legacygamedistancespec"] = 0
+	constants["default.ignoredefeatedenemies"] = 1
+	constants["input.pauseonhitpause"] = 1
+
+	for _, s := range sys.commonConst {
+		if err := LoadFile(&s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"}, func(filename string) error {
+			str, err := LoadText(filename)
+			if err != nil {
+				return err
+			}
+			lines, i := SplitAndTrim(str, "\n"), 0
+			is, _, _ := ReadIniSection(lines, &i)
+			for key, value := range is {
+				constants[key] = float32(Atof(value))
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return constants, nil
+}
+
 func (c *Char) load(def string) error {
 	gi := &sys.cgi[c.playerNo]
 	gi.def, gi.displayname, gi.lifebarname, gi.author = def, "", "", ""
@@ -2366,35 +2402,8 @@ func (c *Char) load(def string) error {
 		}
 	}
 
-	gi.constants = make(map[string]float32)
-	gi.constants["default.attack.lifetopowermul"] = 0.7
-	gi.constants["default.gethit.lifetopowermul"] = 0.6
-	gi.constants["super.targetdefencemul"] = 1.5
-	gi.constants["default.lifetoguardpointsmul"] = 1.5
-	gi.constants["super.lifetoguardpointsmul"] = -0.33
-	gi.constants["default.lifetodizzypointsmul"] = 1.8
-	gi.constants["super.lifetodizzypointsmul"] = 0
-	gi.constants["default.lifetoredlifemul"] = 0.75
-	gi.constants["super.lifetoredlifemul"] = 0.75
-	gi.constants["default.legacygamedistancespec"] = 0
-	gi.constants["default.ignoredefeatedenemies"] = 1
-	gi.constants["input.pauseonhitpause"] = 1
-
-	for _, s := range sys.commonConst {
-		if err := LoadFile(&s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"}, func(filename string) error {
-			str, err = LoadText(filename)
-			if err != nil {
-				return err
-			}
-			lines, i = SplitAndTrim(str, "\n"), 0
-			is, _, _ := ReadIniSection(lines, &i)
-			for key, value := range is {
-				gi.constants[key] = float32(Atof(value))
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
+	if gi.constants, err = commonConstants(def); err != nil {
+		return err
 	}
 
 	// Init constants
@@ -3335,6 +3344,13 @@ func (c *Char) isHelper(hid BytecodeValue) BytecodeValue {
 func (c *Char) isHost() bool {
 	return sys.netInput != nil && sys.netInput.host
 }
+
+// Whether the player has simple specials on, so that characters can scale
+// the damage of the specials done with them
+func (c *Char) simpleSpecials() bool {
+	return c.playerNo >= 0 && c.playerNo < len(sys.chars) &&
+		sys.matchInputSettings[c.playerNo].SimpleSpecials && sys.com[c.playerNo] == 0
+}
 func (c *Char) jugglePoints(hid BytecodeValue) BytecodeValue {
 	if hid.IsSF() {
 		return BytecodeSF()
@@ -3737,7 +3753,8 @@ func (c *Char) winType(wt WinType) bool {
 }
 func (c *Char) playSound(ffx string, lowpriority bool, loopCount int32, g, n, chNo, vol int32,
 	p, freqmul, ls float32, x *float32, log bool, priority int32, loopstart, loopend, startposition int, stopgh, stopcs bool) {
-	if g < 0 {
+	// Sounds were already heard the first time a frame was simulated
+	if g < 0 || sys.resimulating {
 		return
 	}
 	var s *Sound
@@ -3888,6 +3905,7 @@ func (c *Char) stateChange1(no int32, pn int) bool {
 			sys.errLog.Printf("Invalid state: P%v:%v\n", pn+1, no)
 		}
 		c.ss.sb = *newStateBytecode(pn)
+		c.ss.sb.no = c.ss.no
 		c.ss.sb.stateType, c.ss.sb.moveType, c.ss.sb.physics = ST_U, MT_U, ST_U
 	}
 	// Reset persistent counters for this state (Ikemen chars)
@@ -7166,7 +7184,7 @@ func (c *Char) cueDraw() {
 						nhbtxt += " Any"
 					}
 					// Attack
-					if flags&int32(AT_NA) == 0 || flags&int32(AT_SA) == 0 || flags&int32(AT_SA) == 0 {
+					if flags&int32(AT_NA) == 0 || flags&int32(AT_SA) == 0 || flags&int32(AT_HA) == 0 {
 						if nhbtxt != "" {
 							nhbtxt += ", "
 						}
@@ -7182,7 +7200,7 @@ func (c *Char) cueDraw() {
 						nhbtxt += " Atk"
 					}
 					// Throw
-					if flags&int32(AT_NT) == 0 || flags&int32(AT_ST) == 0 || flags&int32(AT_ST) == 0 {
+					if flags&int32(AT_NT) == 0 || flags&int32(AT_ST) == 0 || flags&int32(AT_HT) == 0 {
 						if nhbtxt != "" {
 							nhbtxt += ", "
 						}
@@ -7198,7 +7216,7 @@ func (c *Char) cueDraw() {
 						nhbtxt += " Thr"
 					}
 					// Projectile
-					if flags&int32(AT_NP) == 0 || flags&int32(AT_SP) == 0 || flags&int32(AT_SP) == 0 {
+					if flags&int32(AT_NP) == 0 || flags&int32(AT_SP) == 0 || flags&int32(AT_HP) == 0 {
 						if nhbtxt != "" {
 							nhbtxt += ", "
 						}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The command tester runs a scripted sequence of inputs through the commands
+// of a .cmd file and reports on which frames each command completes and how
+// long the command trigger then stays true, the same way a character facing
+// right would see them. Input scripts have one step per line:
+//
+//	<inputs> [frames]
+//
+// where inputs are keys joined with '+', held for the given number of frames
+// (1 if omitted). Keys are the directions U, D, B, F, L and R and their
+// diagonals such as DF, and the buttons a, b, c, x, y, z, s, d, w and m. A
+// '-' holds nothing, and a plain number is taken as InputBits. Text after a
+// ';' is a comment. For example, a quarter circle forward punch:
+//
+//	D     2
+//	DF    2
+//	F+x
+//	-     10
+
+// A command completed by the inputs
+type CommandTestHit struct {
+	Frame int32 // Starting at 1
+	Until int32 // Last frame the command stays true, before it completes again
+	Name  string
+	Def   int // Which of the commands with this name, starting at 1
+}
+
+// Symbols of the command syntax, longest first so that DF is not read as D
+var cmdDirSymbols = [...]string{"DB", "DF", "DL", "DR", "UB", "UF", "UL", "UR",
+	"B", "D", "F", "U", "L", "R"}
+
+const cmdButtonSymbols = "abcxyzsdwm"
+
+// Returns the problems in a command definition that ReadCommand lets through,
+// such as unknown symbols or a time too short to ever complete it
+func CheckCommand(cm *Command, cmdstr string) (warnings []string) {
+	warn := func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}
+	readDir := func(e string) string {
+		for _, d := range cmdDirSymbols {
+			if strings.HasPrefix(e, d) {
+				return d
+			}
+		}
+		return ""
+	}
+	for n, elem := range strings.Split(cmdstr, ",") {
+		e := strings.Join(strings.Fields(elem), "")
+		if e == "" {
+			warn("element %v is empty", n+1)
+			continue
+		}
+		i := 0
+		if e[i] == '>' {
+			i++
+		}
+		if i < len(e) && e[i] == '/' {
+			i++
+		} else if i < len(e) && e[i] == '~' {
+			// Charge time
+			i++
+			for i < len(e) && e[i] >= '0' && e[i] <= '9' {
+				i++
+			}
+		}
+		keys := 0
+		for ; i < len(e); i++ {
+			switch e[i] {
+			case '+', '~':
+				continue
+			case '$':
+				d := readDir(e[i+1:])
+				if d == "" || len(d) == 2 && d[1] != 'B' && d[1] != 'F' {
+					warn("element %v: $ must be followed by B, D, DB, DF, F, U, UB, UF, L or R", n+1)
+					continue
+				}
+				i += len(d)
+				keys++
+				continue
+			}
+			if d := readDir(e[i:]); d != "" {
+				i += len(d) - 1
+			} else if !strings.ContainsRune(cmdButtonSymbols, rune(e[i])) {
+				warn("element %v: unknown symbol '%c'", n+1, e[i])
+				continue
+			}
+			keys++
+		}
+		if keys == 0 {
+			warn("element %v has no key", n+1)
+		}
+	}
+	if cm == nil || len(cm.cmd) == 0 {
+		return
+	}
+	// Each element takes a frame of its own, except buttons pressed along
+	// with the direction before them
+	frames := int32(0)
+	for i := range cm.cmd {
+		if i == 0 || !cm.cmd[i-1].IsDirToButton(cm.cmd[i]) {
+			frames++
+		}
+	}
+	if cm.cmd[0].slash {
+		frames--
+	}
+	if frames-1 > cm.time {
+		warn("needs at least %v frames to complete but time is %v", frames, cm.time)
+	}
+	return
+}
+
+// Reads an input script into the inputs of each frame
+func ParseInputScript(script string) ([]InputBits, error) {
+	var frames []InputBits
+	for n, line := range strings.Split(script, "\n") {
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		lineErr := func(msg string) error {
+			return Error(fmt.Sprintf("Line %v: %v", n+1, msg))
+		}
+		count := 1
+		if len(f) > 2 {
+			return nil, lineErr("too many fields")
+		} else if len(f) == 2 {
+			c, err := strconv.Atoi(f[1])
+			if err != nil || c < 1 {
+				return nil, lineErr("invalid frame count " + f[1])
+			}
+			count = c
+		}
+		ib, err := parseInputScriptKeys(f[0])
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		for i := 0; i < count; i++ {
+			frames = append(frames, ib)
+		}
+	}
+	return frames, nil
+}
+
+func parseInputScriptKeys(str string) (InputBits, error) {
+	if str == "-" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(str); err == nil {
+		return InputBits(n), nil
+	}
+	var ib InputBits
+	for _, k := range strings.Split(str, "+") {
+		if len(k) == 1 && strings.Contains(cmdButtonSymbols, k) {
+			ib |= IB_A << uint(strings.Index(cmdButtonSymbols, k))
+			continue
+		}
+		if k == "" || len(k) > 2 {
+			return 0, Error("unknown key " + k)
+		}
+		for _, d := range k {
+			switch d {
+			case 'U':
+				ib |= IB_PU
+			case 'D':
+				ib |= IB_PD
+			case 'B', 'L':
+				ib |= IB_PL
+			case 'F', 'R':
+				ib |= IB_PR
+			default:
+				return 0, Error("unknown key " + k)
+			}
+		}
+	}
+	return ib, nil
+}
+
+// Feeds the inputs to the commands of the list one frame at a time and
+// returns every completion
+func (cl *CommandList) Test(inputs []InputBits) []CommandTestHit {
+	cl.BufReset()
+	var hits []CommandTestHit
+	// Latest completion of each name, while the command is still true
+	open := make(map[string]int)
+	for f, ib := range inputs {
+		// Scripts get exactly the directions they hold
+		ib.BitsToKeys(cl.Buffer, 1, 0)
+		for i := range cl.Commands {
+			for j := range cl.Commands[i] {
+				c := &cl.Commands[i][j]
+				c.Step(cl.Buffer, false, false, 0)
+				if c.completeflag {
+					open[c.name] = len(hits)
+					hits = append(hits, CommandTestHit{Frame: int32(f + 1),
+						Until: int32(f + 1), Name: c.name, Def: j + 1})
+				}
+			}
+		}
+		cl.clearCompleted()
+		for name, h := range open {
+			if cl.GetState(name) {
+				hits[h].Until = int32(f + 1)
+			} else {
+				delete(open, name)
+			}
+		}
+	}
+	return hits
+}
+
+// Loads a command file for testing, along with the warnings about each of
+// its commands
+func loadCommandTest(cmdfile string) (*CommandList, []string, error) {
+	str, err := LoadText(cmdfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cl := NewCommandList(NewCommandBuffer())
+	var warnings []string
+	err = cl.ReadCommands(str, cmdfile, func(cm *Command, cmdstr string) {
+		for _, w := range CheckCommand(cm, cmdstr) {
+			warnings = append(warnings, fmt.Sprintf("%v (%v): %v", cm.name,
+				strings.TrimSpace(cmdstr), w))
+		}
+	})
+	return cl, warnings, err
+}
+
+// Runs the command tester from the command line and returns the exit code
+func runCommandTest(cmdfile, scriptfile string) int {
+	cl, warnings, err := loadCommandTest(cmdfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, w := range warnings {
+		fmt.Println("Warning: " + w)
+	}
+	if scriptfile == "" {
+		return 0
+	}
+	script, err := LoadText(scriptfile)
+	var inputs []InputBits
+	if err == nil {
+		inputs, err = ParseInputScript(script)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, scriptfile+": "+err.Error())
+		return 1
+	}
+	completed := make(map[string]bool)
+	for _, h := range cl.Test(inputs) {
+		if h.Until > h.Frame {
+			fmt.Printf("Frames %v-%v: %v", h.Frame, h.Until, h.Name)
+		} else {
+			fmt.Printf("Frame %v: %v", h.Frame, h.Name)
+		}
+		if len(cl.Get(h.Name)) > 1 {
+			fmt.Printf(" #%v", h.Def)
+		}
+		fmt.Println()
+		completed[h.Name] = true
+	}
+	var missed []string
+	for name := range cl.Names {
+		if !completed[name] {
+			missed = append(missed, name)
+		}
+	}
+	sort.Strings(missed)
+	fmt.Printf("%v frames, %v of %v commands completed\n", len(inputs),
+		len(completed), len(cl.Names))
+	if len(missed) > 0 {
+		fmt.Println("Not completed: " + strings.Join(missed, ", "))
+	}
+	return 0
+}
@@ -17,12 +17,18 @@ const (
 )
 
 func Random() int32 {
-	w := sys.randseed / 127773
-	sys.randseed = (sys.randseed-w*127773)*16807 - w*2836
-	if sys.randseed <= 0 {
-		sys.randseed += IMax - Btoi(sys.randseed == 0)
+	return nextRandom(&sys.randseed)
+}
+
+// Advances seed the way the match RNG is advanced, for random streams that
+// are kept apart from it
+func nextRandom(seed *int32) int32 {
+	w := *seed / 127773
+	*seed = (*seed-w*127773)*16807 - w*2836
+	if *seed <= 0 {
+		*seed += IMax - Btoi(*seed == 0)
 	}
-	return sys.randseed
+	return *seed
 }
 func Srand(s int32)             { sys.randseed = s }
 func Rand(min, max int32) int32 { return min + Random()/(IMax/(max-min+1)+1) }
@@ -30,6 +30,10 @@ type Compiler struct {
 	funcs            map[string]bytecodeFunction
 	funcUsed         map[string]bool
 	stateNo          int32
+	lint             *Linter  // Set when checking a character, see lint.go
+	sources          []string // Files read by Compile, for the state cache
+	// Set when the states are optimized, see optimizer.go
+	optimizer *stateOptimizer
 }
 
 func newCompiler() *Compiler {
@@ -410,6 +414,7 @@ var triggerMap = map[string]int{
 	"scale":              1,
 	"selfcommand":        1,
 	"sign":               1,
+	"simplespecials":     1,
 	"score":              1,
 	"scoretotal":         1,
 	"selfstatenoexist":   1,
@@ -1094,10 +1099,21 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		return bv, nil
 	}
 	_var := func(sys, f bool) error {
-		_, err := c.oneArg(out, in, rd, true)
+		bv, err := c.oneArg(out, in, rd, false)
 		if err != nil {
 			return err
 		}
+		if !bv.IsNone() {
+			if c.lint != nil {
+				c.lint.checkVar(sys, f, bv.ToI())
+			}
+			var be BytecodeExp
+			be.appendValue(bv)
+			if rd {
+				out.appendI32Op(OC_nordrun, int32(len(be)))
+			}
+			out.append(be...)
+		}
 		var oc OpCode
 		c.token = c.tokenizer(in)
 		set := c.token == ":="
@@ -3427,6 +3443,8 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			return bvNone(), err
 		}
 		out.append(OC_ex_, OC_ex_selfstatenoexist)
+	case "simplespecials":
+		out.append(OC_ex_, OC_ex_simplespecials)
 	case "sprpriority":
 		out.append(OC_ex_, OC_ex_sprpriority)
 	case "stagebackedgedist", "stagebackedge": // Latter is deprecated
@@ -4057,7 +4075,7 @@ func (c *Compiler) argExpression(in *string, vt ValueType) (BytecodeExp,
 			*in = oldin
 		}
 	}
-	return be, nil
+	return c.optimizeParam(be), nil
 }
 func (c *Compiler) fullExpression(in *string, vt ValueType) (BytecodeExp,
 	error) {
@@ -4068,7 +4086,7 @@ func (c *Compiler) fullExpression(in *string, vt ValueType) (BytecodeExp,
 	if len(c.token) > 0 {
 		return nil, Error("Invalid data: " + c.token)
 	}
-	return be, nil
+	return c.optimizeParam(be), nil
 }
 func (c *Compiler) parseSection(
 	sctrl func(name, data string) error) (IniSection, bool, error) {
@@ -4164,7 +4182,14 @@ func (c *Compiler) stateParam(is IniSection, name string,
 	f func(string) error) error {
 	data, ok := is[name]
 	if ok {
-		if err := f(data); err != nil {
+		if c.optimizer != nil {
+			c.optimizer.param = name
+		}
+		err := f(data)
+		if c.optimizer != nil {
+			c.optimizer.param = ""
+		}
+		if err != nil {
 			return Error(data + "\n" + name + ": " + err.Error())
 		}
 		delete(is, name)
@@ -4172,6 +4197,22 @@ func (c *Compiler) stateParam(is IniSection, name string,
 	return nil
 }
 
+// Names the controller whose parameters are compiled next, or "" once they
+// are, for the optimizer to know which expressions are parameters
+func (c *Compiler) paramsOf(ctrl string) {
+	if c.optimizer != nil {
+		c.optimizer.ctrl = ctrl
+	}
+}
+
+// Optimizes be if it is the expression of a parameter
+func (c *Compiler) optimizeParam(be BytecodeExp) BytecodeExp {
+	if c.optimizer == nil || c.optimizer.ctrl == "" {
+		return be
+	}
+	return c.optimizer.paramExp(be, c.stateNo)
+}
+
 // Returns FX prefix from a data string, removes prefix from the data
 func (c *Compiler) getDataPrefix(data *string, ffxDefault bool) (prefix string) {
 	if len(*data) > 1 {
@@ -4642,12 +4683,15 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			if err != nil {
 				return err
 			}
+			c.sources = append(c.sources, filename)
 			str = string(b)
-			return c.stateCompileZ(states, fnz, str, constants)
+			return c.stateCompileZ(states, filename, str, constants)
 		}
 
 		// Try reading as an st file
-		str, err = LoadText(filename)
+		if str, err = LoadText(filename); err == nil {
+			c.sources = append(c.sources, filename)
+		}
 		return err
 	}); err != nil {
 		// If filename doesn't exist, see if a zss file exists
@@ -4658,16 +4702,33 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return err
 			}
 			str = string(b)
+			c.sources = append(c.sources, filename)
 			return nil
 		}); err == nil {
 			return c.stateCompileZ(states, fnz, str, constants)
 		}
 		return err
 	}
+	// The zss file is already compiled
+	if zss {
+		return nil
+	}
 	c.lines, c.i = SplitAndTrim(str, "\n"), 0
 	errmes := func(err error) error {
 		return Error(fmt.Sprintf("%v:%v:\n%v", filename, c.i+1, err.Error()))
 	}
+	// The linter collects the errors and skips to the next state or state
+	// controller instead
+	lintErr := func(err error) bool {
+		if c.lint == nil {
+			return false
+		}
+		c.lint.add(filename, c.i+1, LintError, err.Error())
+		return true
+	}
+	if c.lint != nil {
+		c.lint.file = filename
+	}
 	// Keep a map of states that have already been found in this file
 	existInThisFile := make(map[int32]bool)
 	c.vars = make(map[string]uint8)
@@ -4687,6 +4748,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 		line = line[10:]
 		var err error
 		if c.stateNo, err = c.scanStateDef(&line, constants); err != nil {
+			if lintErr(err) {
+				continue
+			}
 			return errmes(err)
 		}
 
@@ -4695,19 +4759,36 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			continue
 		}
 		existInThisFile[c.stateNo] = true
+		if c.lint != nil {
+			c.lint.statedef(c.stateNo, c.i+1)
+		}
+		defLine := c.i + 1
 
 		c.i++
 		// Parse the statedef properties
 		is, _, err := c.parseSection(nil)
 		if err != nil {
+			if lintErr(err) {
+				continue
+			}
 			return errmes(err)
 		}
 		sbc := newStateBytecode(c.playerNo)
 		if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
 			*sbc = states[c.stateNo]
 		}
+		sbc.no = c.stateNo
+		if sys.debugger != nil {
+			sbc.debug = newStateDebugInfo(c.stateNo, filename, defLine, sbc.debug)
+		}
 		// Interpret the statedef properties
-		if err := c.stateDef(is, sbc); err != nil {
+		c.paramsOf("statedef")
+		err = c.stateDef(is, sbc)
+		c.paramsOf("")
+		if err != nil {
+			if lintErr(err) {
+				continue
+			}
 			return errmes(err)
 		}
 
@@ -4724,6 +4805,15 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				c.i--
 				break
 			}
+			if c.lint != nil {
+				c.lint.line = c.i + 1
+			}
+			header := strings.TrimSpace(strings.SplitN(c.lines[c.i], ";", 2)[0])
+			header = strings.TrimSpace(header[1 : len(header)-1])
+			var dbg *ctrlDebugInfo
+			if sys.debugger != nil {
+				dbg = &ctrlDebugInfo{line: c.i + 1, header: header}
+			}
 			c.i++
 
 			// Create this sctrl and get its properties
@@ -4744,6 +4834,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					if !ok {
 						return Error("Invalid state controller: " + data)
 					}
+					if dbg != nil {
+						dbg.typ = data
+					}
 				case "persistent":
 					if c.stateNo >= 0 {
 						c.block.persistent = Atoi(data)
@@ -4762,17 +4855,21 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					c.block.ignorehitpause = Btoi(ih) - 2
 					c.block.ctrlsIgnorehitpause = ih
 				case "triggerall":
+					text := data
 					be, err := c.fullExpression(&data, VT_Bool)
 					if err != nil {
 						return err
 					}
+					if dbg != nil {
+						dbg.triggers = append(dbg.triggers, ctrlTrigger{name, text, be})
+					}
 					// If triggerall = 0 is encountered, flag it
 					if len(be) == 2 && be[0] == OC_int8 {
 						if be[1] == 0 {
 							allUtikiri = true
 						}
 					} else if !allUtikiri {
-						triggerall = append(triggerall, be)
+						triggerall = append(triggerall, dbg.record(be))
 					}
 				default:
 					// Get the trigger number
@@ -4793,6 +4890,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					}
 					tn--
 					// Parse trigger condition into a bytecode expression
+					text := data
 					be, err := c.fullExpression(&data, VT_Bool)
 					if err != nil {
 						if sys.ignoreMostErrors {
@@ -4809,6 +4907,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 						}
 						return err
 					}
+					if dbg != nil {
+						dbg.triggers = append(dbg.triggers, ctrlTrigger{name, text, be})
+					}
 					// If trigger is a constant int value
 					if len(be) == 2 && be[0] == OC_int8 {
 						// If trigger is always false (0)
@@ -4819,22 +4920,30 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 							trexist[tn] = 1
 						}
 					} else if !allUtikiri && trexist[tn] >= 0 {
-						trigger[tn] = append(trigger[tn], be)
+						trigger[tn] = append(trigger[tn], dbg.record(be))
 						trexist[tn] = 1
 					}
 				}
 				return nil
 			})
 			if err != nil {
+				if lintErr(err) {
+					continue
+				}
 				return errmes(err)
 			}
 
 			// Check that the sctrl has a valid type parameter
 			if scf == nil {
-				return errmes(Error("type parameter not specified"))
+				err = Error("type parameter not specified")
+			} else if len(trexist) == 0 || (!allUtikiri && trexist[0] == 0) {
+				err = Error("Missing trigger1")
 			}
-			if len(trexist) == 0 || (!allUtikiri && trexist[0] == 0) {
-				return errmes(Error("Missing trigger1"))
+			if err != nil {
+				if lintErr(err) {
+					continue
+				}
+				return errmes(err)
 			}
 
 			/* Create trigger bytecode */
@@ -4903,8 +5012,13 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			}
 
 			// For this sctrl type, call the function to construct the sctrl
+			c.paramsOf("[" + header + "]")
 			sctrl, err := scf(is, sc, _ihp)
+			c.paramsOf("")
 			if err != nil {
+				if lintErr(err) {
+					continue
+				}
 				return errmes(err)
 			}
 
@@ -4929,6 +5043,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					c.block.ignorehitpause < -1 {
 					if _, ok := sctrl.(NullStateController); !ok {
 						sbc.block.ctrls = append(sbc.block.ctrls, sctrl)
+						if dbg != nil {
+							sbc.debug.addCtrl(sbc, *dbg)
+						}
 					}
 				} else {
 					if _, ok := sctrl.(NullStateController); !ok {
@@ -4938,6 +5055,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					if c.block.ignorehitpause >= -1 {
 						sbc.block.ignorehitpause = -1
 					}
+					if dbg != nil {
+						sbc.debug.addCtrl(sbc, *dbg)
+					}
 				}
 			}
 		}
@@ -5720,17 +5840,23 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 						return err
 					}
 				}
+				c.paramsOf(fmt.Sprintf("%v at line %v", scname, c.i+1))
 				if scname == "explod" || scname == "modifyexplod" {
 					if err := c.paramValue(is, sc, "ignorehitpause",
 						explod_ignorehitpause, VT_Bool, 1, false); err != nil {
+						c.paramsOf("")
 						return err
 					}
 				}
-				if sctrl, err := scf(is, sc, -1); err != nil {
+				if c.lint != nil {
+					c.lint.line = c.i + 1
+				}
+				sctrl, err := scf(is, sc, -1)
+				c.paramsOf("")
+				if err != nil {
 					return err
-				} else {
-					*ctrls = append(*ctrls, sctrl)
 				}
+				*ctrls = append(*ctrls, sctrl)
 				c.scan(line)
 				continue
 			} else {
@@ -5814,7 +5940,16 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 		}
 	}()
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, stop(), err.Error()))
+		line := stop()
+		if c.lint != nil {
+			// The rest of the file can not be read
+			c.lint.add(filename, line, LintError, err.Error())
+			c.lint.reported = true
+		}
+		return Error(fmt.Sprintf("%v:%v:\n%v", filename, line, err.Error()))
+	}
+	if c.lint != nil {
+		c.lint.file = filename
 	}
 	existInThisFile := make(map[int32]bool)
 	funcExistInThisFile := make(map[string]bool)
@@ -5847,6 +5982,10 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 				}
 			}
 			existInThisFile[c.stateNo] = true
+			if c.lint != nil {
+				c.lint.statedef(c.stateNo, c.i+1)
+			}
+			defLine := c.i + 1
 			is := NewIniSection()
 			for c.token != "]" {
 				switch c.token {
@@ -5862,8 +6001,15 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 			if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
 				*sbc = states[c.stateNo]
 			}
+			sbc.no = c.stateNo
+			if sys.debugger != nil {
+				sbc.debug = newStateDebugInfo(c.stateNo, filename, defLine, sbc.debug)
+			}
 			c.vars = make(map[string]uint8)
-			if err := c.stateDef(is, sbc); err != nil {
+			c.paramsOf("statedef")
+			err = c.stateDef(is, sbc)
+			c.paramsOf("")
+			if err != nil {
 				return errmes(err)
 			}
 			if err := c.statementEnd(&line); err != nil {
@@ -5877,7 +6023,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 				states[c.stateNo] = *sbc
 			}
 		case "function":
-			name := c.scan(&line)
+			name, fnLine := c.scan(&line), c.i+1
 			if name == "" || name == "(" || name == "]" {
 				return errmes(c.wrongClosureToken())
 			}
@@ -5930,6 +6076,9 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 				continue
 				//return errmes(Error("Function already defined in other file: " + name))
 			}
+			if c.lint != nil {
+				c.lint.function(name, fnLine)
+			}
 			c.funcs[name] = fun
 			//c.funcUsed[name] = true
 		default:
@@ -5942,7 +6091,16 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 // Compile a character definition file
 func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (map[int32]StateBytecode, error) {
 	c.playerNo = pn
+	c.sources = []string{def}
 	states := make(map[int32]StateBytecode)
+	// The linter carries on with the other files after an error
+	fail := func(err error) bool {
+		if c.lint == nil {
+			return true
+		}
+		c.lint.fileError(err)
+		return false
+	}
 
 	/* Load initial data from definition file */
 	str, err := LoadText(def)
@@ -6018,9 +6176,13 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			if err != nil {
 				return err
 			}
+			c.sources = append(c.sources, filename)
 			return nil
 		}); err != nil {
-			return nil, err
+			if fail(err) {
+				return nil, err
+			}
+			cmd = ""
 		}
 	}
 	for _, s := range sys.commonCmd {
@@ -6029,13 +6191,13 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			if err != nil {
 				return err
 			}
+			c.sources = append(c.sources, filename)
 			str += "\n" + txt
 			return nil
-		}); err != nil {
+		}); err != nil && fail(err) {
 			return nil, err
 		}
 	}
-	lines, i = SplitAndTrim(str, "\n"), 0
 
 	// Initialize command list data
 	if sys.chars[pn][0].cmd == nil {
@@ -6046,100 +6208,35 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 		}
 	}
 	c.cmdl = &sys.chars[pn][0].cmd[pn]
-	remap, defaults, ckr := true, true, NewCommandKeyRemap()
-
-	var cmds []IniSection
-	for i < len(lines) {
-		// Read ini sections of command file
-		is, name, _ := ReadIniSection(lines, &i)
-		switch name {
-		case "remap":
-			// Read controller remap
-			if remap {
-				remap = false
-				rm := func(name string, k, nk *CommandKey) {
-					switch strings.ToLower(is[name]) {
-					case "x":
-						*k, *nk = CK_x, CK_rx
-					case "y":
-						*k, *nk = CK_y, CK_ry
-					case "z":
-						*k, *nk = CK_z, CK_rz
-					case "a":
-						*k, *nk = CK_a, CK_ra
-					case "b":
-						*k, *nk = CK_b, CK_rb
-					case "c":
-						*k, *nk = CK_c, CK_rc
-					case "s":
-						*k, *nk = CK_s, CK_rs
-					case "d":
-						*k, *nk = CK_d, CK_rd
-					case "w":
-						*k, *nk = CK_w, CK_rw
-					case "m":
-						*k, *nk = CK_m, CK_rm
-					}
-				}
-				rm("x", &ckr.x, &ckr.nx)
-				rm("y", &ckr.y, &ckr.ny)
-				rm("z", &ckr.z, &ckr.nz)
-				rm("a", &ckr.a, &ckr.na)
-				rm("b", &ckr.b, &ckr.nb)
-				rm("c", &ckr.c, &ckr.nc)
-				rm("s", &ckr.s, &ckr.ns)
-				rm("d", &ckr.d, &ckr.nd)
-				rm("w", &ckr.w, &ckr.nw)
-				rm("m", &ckr.m, &ckr.nm)
-			}
-		case "defaults":
-			// Read default command time and buffer time
-			if defaults {
-				defaults = false
-				is.ReadI32("command.time", &c.cmdl.DefaultTime)
-				var i32 int32
-				if is.ReadI32("command.buffer.time", &i32) {
-					c.cmdl.DefaultBufferTime = Max(1, i32)
-				}
-			}
-		default:
-			// Read input commands
-			if len(name) >= 7 && name[:7] == "command" {
-				cmds = append(cmds, is)
-			}
-		}
-	}
-	// Parse input commands
-	for _, is := range cmds {
-		name, _, err := is.getText("name")
-		if err != nil {
-			return nil, Error(fmt.Sprintf("%v:\nname: %v\n%v",
-				cmd, name, err.Error()))
-		}
-		cm, err := ReadCommand(name, is["command"], ckr)
-		if err != nil {
-			return nil, Error(cmd + ":\nname = " + is["name"] +
-				"\ncommand = " + is["command"] + "\n" + err.Error())
-		}
-		cm.time, cm.buftime = c.cmdl.DefaultTime, c.cmdl.DefaultBufferTime
-		is.ReadI32("time", &cm.time)
-		var i32 int32
-		if is.ReadI32("buffer.time", &i32) {
-			cm.buftime = Max(1, i32)
-		}
-		c.cmdl.Add(*cm)
+	if err := c.cmdl.ReadCommands(str, cmd, nil); err != nil && fail(err) {
+		return nil, err
 	}
 
 	/* Compile states */
+	// Unless they are in the cache from an earlier load
+	useCache := sys.stateCache && c.lint == nil && sys.bytecodeDump == "" &&
+		sys.debugger == nil
+	if useCache {
+		if cached := loadStateCache(pn, def, constants); cached != nil {
+			return cached, nil
+		}
+	}
 	sys.stringPool[pn].Clear()
 	sys.cgi[pn].wakewakaLength = 0
 	c.funcUsed = make(map[string]bool)
+	var dump *strings.Builder
+	if sys.optimizeBytecode && c.lint == nil && sys.debugger == nil {
+		if sys.bytecodeDump != "" {
+			dump = &strings.Builder{}
+		}
+		c.optimizer = newStateOptimizer(dump)
+	}
 	// Compile state files
 	for _, s := range st {
 		if len(s) > 0 {
 			if err := c.stateCompile(states, s, []string{def, "", sys.motifDir, "data/"},
 				sys.cgi[pn].ikemenver[0] == 0 &&
-					sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
+					sys.cgi[pn].ikemenver[1] == 0, constants); err != nil && fail(err) {
 				return nil, err
 			}
 		}
@@ -6148,24 +6245,40 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 	if len(cmd) > 0 {
 		if err := c.stateCompile(states, cmd, []string{def, "", sys.motifDir, "data/"},
 			sys.cgi[pn].ikemenver[0] == 0 &&
-				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
+				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil && fail(err) {
 			return nil, err
 		}
 	}
+	// Only the character's own files are checked for unused states and
+	// functions
+	if c.lint != nil {
+		c.lint.common = true
+	}
 	// Compile states in stcommon state file
 	if len(stcommon) > 0 {
 		if err := c.stateCompile(states, stcommon, []string{def, "", sys.motifDir, "data/"},
 			sys.cgi[pn].ikemenver[0] == 0 &&
-				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
+				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil && fail(err) {
 			return nil, err
 		}
 	}
 	// Compile common states
 	for _, s := range sys.commonStates {
 		if err := c.stateCompile(states, s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"},
-			false, constants); err != nil {
+			false, constants); err != nil && fail(err) {
 			return nil, err
 		}
 	}
+	if c.optimizer != nil {
+		c.optimizer.states(states)
+		if dump != nil {
+			writeBytecodeDump(def, dump.String())
+		}
+	}
+	if useCache {
+		if err := saveStateCache(pn, def, constants, c.sources, states); err != nil {
+			sys.errLog.Printf("Failed to cache the states of %v: %v\n", def, err)
+		}
+	}
 	return states, nil
 }
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The state controller debugger stops the simulation in the middle of a frame
+// when a character runs a statedef or a state controller with a breakpoint,
+// and then steps through the controllers one at a time. It is turned on with
+//
+//	-debugger [port]
+//
+// and takes one command per line, from the console (stdin) while stopped,
+// from the debugger("...") Lua function, or from any number of editors
+// connected to 127.0.0.1:<port>. Replies go to where the command came from,
+// and stops are reported to the console and to every editor:
+//
+//	break <state>[:<ctrl>] [p<n>]  Stops when player n (any char if left out)
+//	                               enters the statedef, or runs its ctrl-th
+//	                               controller, numbered from 1 as in list
+//	delete [<id>]                  Removes a breakpoint, or all of them
+//	breaks                         Lists the breakpoints
+//	list [<state>]                 Lists the controllers of a statedef
+//	pause                          Stops at the next controller that runs
+//	step, s                        Runs one controller and stops again
+//	continue, c                    Resumes the game
+//	where                          Shows the statedefs being run
+//	triggers                       Shows the value each trigger of the
+//	                               controller had when it was run
+//	vars, fvars, sysvars, maps     Shows the variables of the char
+//	help                           Lists the commands
+//
+// The debugger never stops during netplay. Characters are compiled without
+// the bytecode optimizer and the state cache while it is on, so that each
+// controller can be found in its file, and with their triggers recording the
+// values they are run to for the triggers command. The controllers of ZSS
+// statedefs are numbered and can be stopped at too, but their lines and
+// triggers are not known.
+
+// Where a state controller of a .cns file comes from
+type ctrlDebugInfo struct {
+	line     int
+	header   string // eg. "State 200, Punch"
+	typ      string
+	triggers []ctrlTrigger
+}
+
+type ctrlTrigger struct {
+	name, text string
+	exp        BytecodeExp
+}
+
+// Has be record the value it is run to as the trigger last added to ci, if
+// ci is not nil
+func (ci *ctrlDebugInfo) record(be BytecodeExp) BytecodeExp {
+	if ci == nil {
+		return be
+	}
+	out := append(BytecodeExp{}, be...)
+	out.append(OC_ex2_)
+	out.appendI32Op(OC_ex2_debugtrigger, int32(len(ci.triggers)-1))
+	return out
+}
+
+// Where a statedef comes from, with its top level controllers in the order
+// they are run. ZSS statedefs have no controllers listed.
+type stateDebugInfo struct {
+	no    int32
+	file  string
+	line  int
+	ctrls []ctrlDebugInfo
+}
+
+// The debug info of a statedef, extending that of prev for negative states
+// defined in more than one file
+func newStateDebugInfo(no int32, file string, line int,
+	prev *stateDebugInfo) *stateDebugInfo {
+	sd := &stateDebugInfo{no: no, file: file, line: line}
+	if prev != nil {
+		sd.ctrls = append(sd.ctrls, prev.ctrls...)
+	}
+	return sd
+}
+
+// Records where the controller last added to sb comes from. Controllers
+// added by a file without debug info, such as a .zss file for a negative
+// state, are left blank.
+func (sd *stateDebugInfo) addCtrl(sb *StateBytecode, ci ctrlDebugInfo) {
+	for len(sd.ctrls) < len(sb.block.ctrls)-1 {
+		sd.ctrls = append(sd.ctrls, ctrlDebugInfo{})
+	}
+	sd.ctrls = append(sd.ctrls, ci)
+}
+
+// The source of the n-th controller of the statedef, from 1
+func (sd *stateDebugInfo) ctrl(n int) *ctrlDebugInfo {
+	if n < 1 || n > len(sd.ctrls) || sd.ctrls[n-1].line == 0 {
+		return nil
+	}
+	return &sd.ctrls[n-1]
+}
+
+type breakpoint struct {
+	id    int
+	state int32
+	ctrl  int // 0 to stop on entering the statedef
+	pn    int // 0 for any char
+}
+
+func (bp breakpoint) String() string {
+	s := fmt.Sprintf("#%v state %v", bp.id, bp.state)
+	if bp.ctrl > 0 {
+		s += fmt.Sprintf(" controller %v", bp.ctrl)
+	}
+	if bp.pn > 0 {
+		s += fmt.Sprintf(" p%v", bp.pn)
+	}
+	return s
+}
+
+// A statedef being run
+type debugFrame struct {
+	c        *Char
+	sb       *StateBytecode
+	ctrl     int // Top level controller being run, from 1
+	sc       StateController
+	triggers []BytecodeValue // Of ctrl, none for those not run
+}
+
+type debugCommand struct {
+	line string
+	out  io.Writer
+}
+
+type Debugger struct {
+	breaks   []breakpoint
+	nextID   int
+	frames   []debugFrame
+	stepping bool
+	stopped  bool
+	cmds     chan debugCommand
+	ln       net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+// Writes to the shell and the in-game console
+type consoleWriter struct{}
+
+func (consoleWriter) Write(p []byte) (int, error) {
+	for _, s := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		fmt.Printf("%s\n", s)
+		sys.appendToConsole(s)
+	}
+	return len(p), nil
+}
+
+func NewDebugger(port string) (*Debugger, error) {
+	d := &Debugger{nextID: 1, cmds: make(chan debugCommand, 16)}
+	if port != "" {
+		ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			return nil, err
+		}
+		d.ln = ln
+		go d.accept()
+	}
+	return d, nil
+}
+
+func (d *Debugger) accept() {
+	for {
+		conn, err := d.ln.Accept()
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.conns = append(d.conns, conn)
+		d.mu.Unlock()
+		go d.read(conn)
+	}
+}
+
+func (d *Debugger) read(conn net.Conn) {
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		d.cmds <- debugCommand{sc.Text(), conn}
+	}
+	conn.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, c := range d.conns {
+		if c == conn {
+			d.conns = append(d.conns[:i], d.conns[i+1:]...)
+			break
+		}
+	}
+}
+
+// Sends a message to the console and every connected editor
+func (d *Debugger) broadcast(format string, a ...interface{}) {
+	s := fmt.Sprintf(format+"\n", a...)
+	consoleWriter{}.Write([]byte(s))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.conns {
+		io.WriteString(c, s)
+	}
+}
+
+func (d *Debugger) Close() {
+	if d.ln != nil {
+		d.ln.Close()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.conns {
+		c.Close()
+	}
+}
+
+// Runs the commands received from editors while the game is running
+func (d *Debugger) poll() {
+	for {
+		select {
+		case cmd := <-d.cmds:
+			d.exec(cmd.line, cmd.out)
+		default:
+			return
+		}
+	}
+}
+
+// Called by StateBytecode.run before running the controllers of sb
+func (d *Debugger) enterState(c *Char, sb *StateBytecode) {
+	d.frames = append(d.frames, debugFrame{c: c, sb: sb})
+	if sb.debug == nil {
+		return
+	}
+	if d.stepping || d.breakAt(c, sb.debug.no, 0) {
+		d.stop()
+	}
+}
+
+func (d *Debugger) exitState() {
+	if len(d.frames) > 0 {
+		d.frames = d.frames[:len(d.frames)-1]
+	}
+}
+
+// Called by StateBlock.Run before running ctrls[i]. The statedef's own
+// controllers are numbered, and the debugger stops before those that are not
+// blocks, once the triggers of the blocks they are in are true.
+func (d *Debugger) ctrl(ctrls []StateController, i int) {
+	if len(d.frames) == 0 {
+		return
+	}
+	f := &d.frames[len(d.frames)-1]
+	if top := f.sb.block.ctrls; len(top) > 0 && &ctrls[0] == &top[0] {
+		f.ctrl, f.triggers = i+1, f.triggers[:0]
+	}
+	f.sc = ctrls[i]
+	if _, ok := ctrls[i].(StateBlock); ok || f.sb.debug == nil {
+		return
+	}
+	if d.stepping || d.breakAt(f.c, f.sb.debug.no, f.ctrl) {
+		d.stop()
+	}
+}
+
+// Called by the triggers of the controller being run with the value they
+// are run to
+func (d *Debugger) trigger(i int, v BytecodeValue) {
+	if len(d.frames) == 0 {
+		return
+	}
+	f := &d.frames[len(d.frames)-1]
+	for len(f.triggers) <= i {
+		f.triggers = append(f.triggers, bvNone())
+	}
+	f.triggers[i] = v
+}
+
+func (d *Debugger) breakAt(c *Char, state int32, ctrl int) bool {
+	for _, bp := range d.breaks {
+		if bp.state == state && bp.ctrl == ctrl && (bp.pn == 0 || bp.pn == c.playerNo+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocks the game until a command resumes it. Window events are still
+// processed meanwhile so that the window does not stop responding.
+func (d *Debugger) stop() {
+	if sys.netInput != nil || sys.resimulating || sys.window.shouldClose() {
+		return
+	}
+	d.stepping, d.stopped = false, true
+	d.broadcast("Stopped: %v", d.location(len(d.frames)-1))
+	tick := time.NewTicker(time.Second / time.Duration(FPS))
+	defer tick.Stop()
+	for d.stopped {
+		select {
+		case cmd := <-d.cmds:
+			d.exec(cmd.line, cmd.out)
+		case line := <-sys.commandLine:
+			d.exec(line, consoleWriter{})
+		case <-tick.C:
+			sys.window.pollEvents()
+			if sys.window.shouldClose() {
+				d.stopped = false
+			}
+		}
+	}
+}
+
+func charName(c *Char) string {
+	if c.helperIndex != 0 {
+		return fmt.Sprintf("P%v helper %v (%v)", c.playerNo+1, c.helperId, c.name)
+	}
+	return fmt.Sprintf("P%v (%v)", c.playerNo+1, c.name)
+}
+
+// The type of a state controller as written in its file, as near as can be
+// told from the compiled one
+func ctrlTypeName(sc StateController) string {
+	switch sc := sc.(type) {
+	case StateBlock:
+		if len(sc.ctrls) == 1 && !sc.loopBlock {
+			return ctrlTypeName(sc.ctrls[0])
+		}
+		return "block"
+	case StateExpr:
+		return "expression"
+	case varAssign:
+		return "assignment"
+	case callFunction:
+		return "function call"
+	}
+	return reflect.TypeOf(sc).Name()
+}
+
+func (d *Debugger) location(i int) string {
+	if i < 0 || i >= len(d.frames) {
+		return "nowhere"
+	}
+	f := d.frames[i]
+	if f.sb.debug == nil {
+		return charName(f.c) + " in a statedef without debug info"
+	}
+	sd := f.sb.debug
+	s := fmt.Sprintf("%v state %v", charName(f.c), sd.no)
+	if f.ctrl == 0 {
+		return fmt.Sprintf("%v, entering (%v:%v)", s, sd.file, sd.line)
+	}
+	if ci := sd.ctrl(f.ctrl); ci != nil {
+		return fmt.Sprintf("%v controller %v [%v] type %v (%v:%v)",
+			s, f.ctrl, ci.header, ci.typ, sd.file, ci.line)
+	}
+	return fmt.Sprintf("%v controller %v %v (%v)", s, f.ctrl, ctrlTypeName(f.sc), sd.file)
+}
+
+func (d *Debugger) exec(line string, out io.Writer) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+	reply := func(format string, a ...interface{}) {
+		fmt.Fprintf(out, format+"\n", a...)
+	}
+	stopped := func() bool {
+		if !d.stopped || len(d.frames) == 0 {
+			reply("Not stopped")
+			return false
+		}
+		return true
+	}
+	switch strings.ToLower(args[0]) {
+	case "break":
+		bp, err := d.parseBreak(args[1:])
+		if err != nil {
+			reply("%v", err)
+			return
+		}
+		d.breaks = append(d.breaks, bp)
+		reply("Breakpoint %v", bp)
+	case "delete":
+		if len(args) < 2 {
+			d.breaks = nil
+			reply("Deleted all breakpoints")
+			return
+		}
+		id, _ := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		for i, bp := range d.breaks {
+			if bp.id == id {
+				d.breaks = append(d.breaks[:i], d.breaks[i+1:]...)
+				reply("Deleted breakpoint %v", bp)
+				return
+			}
+		}
+		reply("No breakpoint #%v", id)
+	case "breaks":
+		if len(d.breaks) == 0 {
+			reply("No breakpoints")
+		}
+		for _, bp := range d.breaks {
+			reply("%v", bp)
+		}
+	case "list":
+		d.list(args[1:], reply)
+	case "pause":
+		d.stepping = true
+	case "step", "s":
+		if stopped() {
+			d.stepping, d.stopped = true, false
+		}
+	case "continue", "c":
+		if stopped() {
+			d.stopped = false
+		}
+	case "where":
+		if stopped() {
+			for i := len(d.frames) - 1; i >= 0; i-- {
+				reply("%v", d.location(i))
+			}
+		}
+	case "triggers":
+		if stopped() {
+			d.triggers(reply)
+		}
+	case "vars", "fvars", "sysvars", "maps":
+		if stopped() {
+			d.vars(strings.ToLower(args[0]), reply)
+		}
+	case "help":
+		reply("break <state>[:<ctrl>] [p<n>], delete [<id>], breaks, list [<state>], " +
+			"pause, step, continue, where, triggers, vars, fvars, sysvars, maps")
+	default:
+		reply("Unknown debugger command: %v", args[0])
+	}
+}
+
+func (d *Debugger) parseBreak(args []string) (bp breakpoint, err error) {
+	if len(args) == 0 {
+		return bp, Error("Usage: break <state>[:<ctrl>] [p<n>]")
+	}
+	st, ctrl, hasCtrl := strings.Cut(args[0], ":")
+	no, err := strconv.ParseInt(st, 10, 32)
+	if err != nil {
+		return bp, Error("Invalid state number: " + st)
+	}
+	bp.state = int32(no)
+	if hasCtrl {
+		if bp.ctrl, err = strconv.Atoi(ctrl); err != nil || bp.ctrl < 1 {
+			return bp, Error("Invalid controller number: " + ctrl)
+		}
+	}
+	if len(args) > 1 {
+		p := strings.TrimPrefix(strings.ToLower(args[1]), "p")
+		if bp.pn, err = strconv.Atoi(p); err != nil || bp.pn < 1 || bp.pn > MaxSimul*2+MaxAttachedChar {
+			return bp, Error("Invalid player: " + args[1])
+		}
+	}
+	bp.id = d.nextID
+	d.nextID++
+	return bp, nil
+}
+
+// Lists the controllers of a statedef of the char the debugger is stopped in,
+// or of player 1
+func (d *Debugger) list(args []string, reply func(string, ...interface{})) {
+	c := sys.chars[0]
+	if len(c) == 0 {
+		reply("No characters loaded")
+		return
+	}
+	ch := c[0]
+	var sb *StateBytecode
+	if len(d.frames) > 0 {
+		f := d.frames[len(d.frames)-1]
+		ch, sb = f.c, f.sb
+	}
+	if len(args) > 0 {
+		no, err := strconv.ParseInt(args[0], 10, 32)
+		if err != nil {
+			reply("Invalid state number: %v", args[0])
+			return
+		}
+		pn := ch.playerNo
+		if sb != nil {
+			pn = sb.playerNo
+		}
+		st, ok := sys.cgi[pn].states[int32(no)]
+		if !ok {
+			reply("No state %v", no)
+			return
+		}
+		sb = &st
+	}
+	if sb == nil || sb.debug == nil {
+		reply("No debug info for this statedef")
+		return
+	}
+	sd := sb.debug
+	reply("State %v (%v:%v)", sd.no, sd.file, sd.line)
+	for i, sc := range sb.block.ctrls {
+		if ci := sd.ctrl(i + 1); ci != nil {
+			reply("%4v  [%v] type %v, line %v", i+1, ci.header, ci.typ, ci.line)
+		} else {
+			reply("%4v  %v", i+1, ctrlTypeName(sc))
+		}
+	}
+}
+
+// Shows the values the triggers of the controller the debugger is stopped at
+// were run to. Those after a false triggerall or a true triggerN are not run.
+func (d *Debugger) triggers(reply func(string, ...interface{})) {
+	f := d.frames[len(d.frames)-1]
+	var ci *ctrlDebugInfo
+	if f.sb.debug != nil {
+		ci = f.sb.debug.ctrl(f.ctrl)
+	}
+	if ci == nil {
+		reply("No triggers known for this controller")
+		return
+	}
+	for i, t := range ci.triggers {
+		v := bvNone()
+		if i < len(f.triggers) {
+			v = f.triggers[i]
+		}
+		switch {
+		case !v.IsNone():
+			if v.IsSF() {
+				reply("%v = %v -> SFalse", t.name, t.text)
+			} else {
+				reply("%v = %v -> %v", t.name, t.text, v.ToI())
+			}
+		case len(t.exp) == 2 && t.exp[0] == OC_int8:
+			// Constants are left out of the trigger
+			reply("%v = %v -> %v (constant)", t.name, t.text, int8(t.exp[1]))
+		default:
+			reply("%v = %v -> not run", t.name, t.text)
+		}
+	}
+}
+
+func (d *Debugger) vars(kind string, reply func(string, ...interface{})) {
+	c := d.frames[len(d.frames)-1].c
+	row := func(name string, first int, vals []string) {
+		for i := 0; i < len(vals); i += 10 {
+			end := i + 10
+			if end > len(vals) {
+				end = len(vals)
+			}
+			reply("%v(%v-%v): %v", name, first+i, first+end-1, strings.Join(vals[i:end], " "))
+		}
+	}
+	switch kind {
+	case "vars":
+		vals := make([]string, NumVar)
+		for i := range vals {
+			vals[i] = fmt.Sprint(c.ivar[i])
+		}
+		row("var", 0, vals)
+	case "fvars":
+		vals := make([]string, NumFvar)
+		for i := range vals {
+			vals[i] = fmt.Sprint(c.fvar[i])
+		}
+		row("fvar", 0, vals)
+	case "sysvars":
+		vals := make([]string, NumSysVar)
+		for i := range vals {
+			vals[i] = fmt.Sprint(c.ivar[NumVar+i])
+		}
+		row("sysvar", 0, vals)
+		vals = make([]string, NumSysFvar)
+		for i := range vals {
+			vals[i] = fmt.Sprint(c.fvar[NumFvar+i])
+		}
+		row("sysfvar", 0, vals)
+	case "maps":
+		keys := make([]string, 0, len(c.mapArray))
+		for k := range c.mapArray {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if len(keys) == 0 {
+			reply("No maps")
+		}
+		for _, k := range keys {
+			reply("map(%v) = %v", k, c.mapArray[k])
+		}
+	}
+}
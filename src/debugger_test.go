@@ -0,0 +1,149 @@
+//go:build headless
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDebuggerParseBreak(t *testing.T) {
+	tests := []struct {
+		args []string
+		want breakpoint
+		err  bool
+	}{
+		{[]string{"200"}, breakpoint{id: 1, state: 200}, false},
+		{[]string{"200:3"}, breakpoint{id: 1, state: 200, ctrl: 3}, false},
+		{[]string{"-1:2", "p2"}, breakpoint{id: 1, state: -1, ctrl: 2, pn: 2}, false},
+		{[]string{"200", "P1"}, breakpoint{id: 1, state: 200, pn: 1}, false},
+		{nil, breakpoint{}, true},
+		{[]string{"punch"}, breakpoint{}, true},
+		{[]string{"200:0"}, breakpoint{}, true},
+		{[]string{"200:x"}, breakpoint{}, true},
+		{[]string{"200", "p0"}, breakpoint{}, true},
+		{[]string{"200", "p99"}, breakpoint{}, true},
+	}
+	for _, tt := range tests {
+		d := &Debugger{nextID: 1}
+		bp, err := d.parseBreak(tt.args)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: got error %v", tt.args, err)
+		} else if !tt.err && bp != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.args, bp, tt.want)
+		}
+	}
+	d := &Debugger{nextID: 1}
+	d.parseBreak([]string{"200"})
+	if bp, _ := d.parseBreak([]string{"201"}); bp.id != 2 {
+		t.Errorf("the second breakpoint is #%v, want #2", bp.id)
+	}
+}
+
+func TestDebuggerBreakAt(t *testing.T) {
+	d := &Debugger{breaks: []breakpoint{
+		{id: 1, state: 200},
+		{id: 2, state: 210, ctrl: 3},
+		{id: 3, state: 220, ctrl: 1, pn: 2},
+	}}
+	p1, p2 := &Char{playerNo: 0}, &Char{playerNo: 1}
+	tests := []struct {
+		c     *Char
+		state int32
+		ctrl  int
+		want  bool
+	}{
+		{p1, 200, 0, true},
+		{p2, 200, 0, true},
+		{p1, 200, 1, false},
+		{p1, 210, 3, true},
+		{p1, 210, 0, false},
+		{p1, 210, 2, false},
+		{p2, 220, 1, true},
+		{p1, 220, 1, false},
+		{p1, 230, 0, false},
+	}
+	for _, tt := range tests {
+		if got := d.breakAt(tt.c, tt.state, tt.ctrl); got != tt.want {
+			t.Errorf("P%v state %v controller %v: got %v, want %v",
+				tt.c.playerNo+1, tt.state, tt.ctrl, got, tt.want)
+		}
+	}
+}
+
+// Compiles the states of src/testdata/debugger with the debugger on, and
+// runs state 0 for c, with the commands given to the debugger each time it
+// stops. Returns the replies to the commands.
+func runDebuggerState(t *testing.T, c *Char, breaks []string, cmds []string) string {
+	initTestEngine(t)
+	d, err := NewDebugger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(chars []*Char) {
+		sys.debugger, sys.chars[0] = nil, chars
+	}(sys.chars[0])
+	sys.debugger, sys.chars[0] = d, []*Char{c}
+	states := make(map[int32]StateBytecode)
+	if err := newCompiler().stateCompile(states, "src/testdata/debugger/debugger.cns",
+		[]string{""}, false, make(map[string]float32)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	for _, b := range breaks {
+		d.exec("break "+b, &out)
+	}
+	for _, cmd := range cmds {
+		d.cmds <- debugCommand{cmd, &out}
+	}
+	out.Reset()
+	sb := states[0]
+	sb.run(c)
+	return out.String()
+}
+
+// The controllers are numbered as the list command shows them, leaving out
+// those that are never run
+func TestDebuggerNumbering(t *testing.T) {
+	c := &Char{name: "Test"}
+	c.ivar[4] = 1
+	out := runDebuggerState(t, c, []string{"0:1", "0:2"},
+		[]string{"list", "where", "continue", "where", "continue"})
+	file := "./src/testdata/debugger/debugger.cns"
+	want := strings.Join([]string{
+		"State 0 (" + file + ":3)",
+		"   1  [State 0, Always] type VarSet, line 7",
+		"   2  [State 0, Counted] type VarSet, line 21",
+		"P1 (Test) state 0 controller 1 [State 0, Always] type VarSet (" + file + ":7)",
+		"P1 (Test) state 0 controller 2 [State 0, Counted] type VarSet (" + file + ":21)",
+	}, "\n") + "\n"
+	if out != want {
+		t.Errorf("got\n%v\nwant\n%v", out, want)
+	}
+}
+
+// The triggers command shows the values the triggers were run to, without
+// running them again
+func TestDebuggerTriggers(t *testing.T) {
+	c := &Char{}
+	c.ivar[2], c.ivar[3] = 2, 3
+	out := runDebuggerState(t, c, []string{"0:2"}, []string{"triggers", "triggers", "continue"})
+	want := strings.Repeat(strings.Join([]string{
+		"triggerall = var(0) := var(0) + 1 -> 1",
+		"triggerall = 1 -> 1 (constant)",
+		"trigger1 = var(1) = 1 -> 0",
+		"trigger2 = var(2) = 2 -> 1",
+		"trigger2 = var(3) = 3 -> 1",
+		"trigger3 = var(4) -> not run",
+	}, "\n")+"\n", 2)
+	if out != want {
+		t.Errorf("got\n%v\nwant\n%v", out, want)
+	}
+	if c.ivar[0] != 1 {
+		t.Errorf("the triggerall is run %v times, want 1", c.ivar[0])
+	}
+	if c.ivar[12] != 1 {
+		t.Error("the controller is not run")
+	}
+}
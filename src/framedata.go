@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Frame data of an attack, in game ticks. Startup is the first frame with
+// an active attack box, counting the first frame of the move as 1. Frames
+// spent in hitpause are not counted. Advantage is how many frames before the
+// opponent the attacker gets control back after the attack hits or is
+// guarded, negative if the opponent recovers first.
+type FrameData struct {
+	StateNo   int32  `json:"stateno"`
+	Startup   int32  `json:"startup"`
+	Active    int32  `json:"active"`
+	Recovery  int32  `json:"recovery"`
+	Total     int32  `json:"total"`
+	Guarded   bool   `json:"-"`
+	Advantage *int32 `json:"-"`
+}
+
+// Frames after which a move that never gives control back is given up on
+const frameDataTimeout = 600
+
+// Follows one attack of a player from its first frame until both the
+// attacker and, if it made contact, the opponent have control again. Only
+// the player's own boxes are measured, not those of its helpers and
+// projectiles.
+type frameDataTracker struct {
+	tracking    bool
+	stateNo     int32
+	frame       int32 // Frames of the move outside hitpause, starting at 1
+	ticks       int32 // Ticks since the move started, including hitpause
+	firstActive int32
+	lastActive  int32
+	ready       int32 // Frame the attacker got control back
+	readyTick   int32
+	opp         *Char // Opponent the attack made contact with
+	guarded     bool
+	oppReady    int32 // Tick the opponent got control back
+}
+
+func (t *frameDataTracker) start(c *Char) {
+	*t = frameDataTracker{tracking: true, stateNo: c.ss.no}
+}
+
+// Advances the tracker after a game tick and returns the frame data of the
+// attack once it is over
+func (t *frameDataTracker) update(c *Char) *FrameData {
+	if !t.tracking {
+		if c.ss.moveType != MT_A {
+			return nil
+		}
+		t.start(c)
+	}
+	t.ticks++
+	if t.ticks > frameDataTimeout || t.ready == 0 && c.ss.moveType == MT_H {
+		// Interrupted, or it never ends
+		t.tracking = false
+		return nil
+	}
+	if t.ready == 0 {
+		if !c.hitPause() {
+			t.frame++
+		}
+		if t.opp == nil {
+			if c.moveHit() != 0 || c.moveGuarded() != 0 {
+				t.opp, t.guarded = c.p2(), c.moveGuarded() != 0
+			}
+		}
+		if c.curFrame != nil && len(c.curFrame.Clsn1()) > 0 &&
+			(c.atktmp != 0 && c.hitdef.attr > 0 || t.opp != nil) {
+			if t.firstActive == 0 {
+				t.firstActive = t.frame
+			}
+			t.lastActive = t.frame
+		}
+		if c.ctrl() && c.ss.moveType != MT_A {
+			t.ready, t.readyTick = t.frame, t.ticks
+		}
+	}
+	if t.opp != nil && t.oppReady == 0 && t.opp.ctrl() &&
+		t.opp.ss.moveType != MT_H && !t.opp.inGuardState() {
+		t.oppReady = t.ticks
+	}
+	if t.ready == 0 || t.opp != nil && t.oppReady == 0 {
+		return nil
+	}
+	t.tracking = false
+	if t.firstActive == 0 {
+		// Not an attack after all, such as a taunt or a throw whiff
+		return nil
+	}
+	fd := &FrameData{StateNo: t.stateNo, Startup: t.firstActive,
+		Active:   t.lastActive - t.firstActive + 1,
+		Recovery: t.ready - t.lastActive - 1, Total: t.ready - 1,
+		Guarded: t.guarded}
+	if t.opp != nil {
+		adv := t.oppReady - t.readyTick
+		fd.Advantage = &adv
+	}
+	return fd
+}
+
+type FrameDataMeter struct {
+	enabled  bool
+	trackers [MaxSimul * 2]frameDataTracker
+	last     [MaxSimul * 2]*FrameData
+	count    [MaxSimul * 2]int32 // Number of attacks measured so far
+	batch    *frameDataBatch
+}
+
+func (fm *FrameDataMeter) Toggle() {
+	fm.enabled = !fm.enabled
+}
+
+// Measures the attacks of every player after a game tick
+func (fm *FrameDataMeter) update() {
+	if sys.gameMode == "training" || fm.batch != nil {
+		for i := range fm.trackers {
+			if len(sys.chars[i]) == 0 {
+				fm.trackers[i].tracking = false
+				continue
+			}
+			if fd := fm.trackers[i].update(sys.chars[i][0]); fd != nil {
+				fm.last[i] = fd
+				fm.count[i]++
+			}
+		}
+	}
+	if fm.batch != nil {
+		fm.batch.step()
+	}
+}
+
+func (fd *FrameData) String() string {
+	s := fmt.Sprintf("%v  S:%v A:%v R:%v", fd.StateNo, fd.Startup, fd.Active,
+		fd.Recovery)
+	if fd.Advantage != nil {
+		label := "Hit"
+		if fd.Guarded {
+			label = "Guard"
+		}
+		s += fmt.Sprintf(" %v:%+d", label, *fd.Advantage)
+	}
+	return s
+}
+
+// Shows the last attack measured of each player at the bottom of the screen
+func (fm *FrameDataMeter) draw() {
+	if !fm.enabled || sys.gameMode != "training" || sys.debugFont == nil {
+		return
+	}
+	xscl, yscl := sys.debugFont.xscl/sys.widthScale, sys.debugFont.yscl/sys.heightScale
+	lh := float32(sys.debugFont.fnt.Size[1]) * yscl
+	left := (320-float32(sys.gameWidth))/2 + 2
+	bottom := float32(236)
+	sys.debugFont.SetColor(255, 255, 255)
+	for i, fd := range fm.last {
+		if fd == nil {
+			continue
+		}
+		x, align := left, int32(1)
+		if i&1 != 0 {
+			x, align = left+float32(sys.gameWidth)-4, -1
+		}
+		sys.debugFont.fnt.Print(fd.String(), x, bottom-float32(i/2)*lh, xscl, yscl,
+			0, align, &sys.scrrect, sys.debugFont.palfx, sys.debugFont.frgba)
+	}
+}
+
+// Row of the table written by -framedata
+type frameDataRow struct {
+	FrameData
+	OnHit   *int32 `json:"onhit"`
+	OnGuard *int32 `json:"onguard"`
+}
+
+// Runs every attack state of P1 against P2, first letting the attacks hit
+// and then having P2 guard them, and writes the results to a file. The
+// match is set up by the Lua scripts from the -framedata flag.
+type frameDataBatch struct {
+	out    string
+	states []int32
+	idx    int
+	guard  bool
+	wait   int32 // Ticks spent on the current step
+	count  int32 // Attacks measured when the current state was started
+	active bool  // Whether a state is being measured
+	rows   map[int32]*frameDataRow
+}
+
+func newFrameDataBatch() *frameDataBatch {
+	if _, ok := sys.cmdFlags["-framedata"]; !ok {
+		return nil
+	}
+	out := sys.cmdFlags["-framedataout"]
+	if out == "" {
+		out = "framedata.json"
+	}
+	return &frameDataBatch{out: out, rows: make(map[int32]*frameDataRow)}
+}
+
+func (fb *frameDataBatch) step() {
+	if sys.roundState() != 2 || len(sys.chars[0]) == 0 || len(sys.chars[1]) == 0 {
+		return
+	}
+	p1, p2 := sys.chars[0][0], sys.chars[1][0]
+	if fb.states == nil {
+		for no, sb := range p1.gi().states {
+			if sb.moveType == MT_A {
+				fb.states = append(fb.states, no)
+			}
+		}
+		sort.Slice(fb.states, func(i, j int) bool { return fb.states[i] < fb.states[j] })
+		if len(fb.states) == 0 {
+			fb.finish()
+			return
+		}
+	}
+	// Nobody gets knocked out while measuring
+	p1.life, p2.life = p1.lifeMax, p2.lifeMax
+	fb.wait++
+	if fb.active {
+		if sys.frameData.count[0] != fb.count {
+			fb.record(sys.frameData.last[0])
+		} else if fb.wait > frameDataTimeout+60 {
+			fb.record(nil)
+		}
+		return
+	}
+	// Wait for both players to stand still before starting the next state
+	settled := func(c *Char) bool {
+		return c.ctrl() && c.ss.moveType == MT_I && c.ss.stateType != ST_A
+	}
+	if (!settled(p1) || !settled(p2)) && fb.wait < frameDataTimeout {
+		return
+	}
+	fb.start(p1, p2)
+}
+
+// Puts the players next to each other and starts the current state
+func (fb *frameDataBatch) start(p1, p2 *Char) {
+	for _, c := range [...]*Char{p1, p2} {
+		c.posReset()
+	}
+	gap := (p1.width[0]*p1.localscl + p2.width[0]*p2.localscl) / 2
+	p1.setX(-gap / p1.localscl)
+	p2.setX(gap / p2.localscl)
+	sys.autoguard[p2.playerNo] = fb.guard
+	p2.setCtrl(true)
+	p2.stateChange1(0, p2.playerNo)
+	p1.setCtrl(false)
+	p1.stateChange1(fb.states[fb.idx], p1.playerNo)
+	sys.frameData.trackers[0].tracking = false
+	fb.count, fb.wait, fb.active = sys.frameData.count[0], 0, true
+}
+
+func (fb *frameDataBatch) record(fd *FrameData) {
+	no := fb.states[fb.idx]
+	row := fb.rows[no]
+	if row == nil {
+		row = &frameDataRow{FrameData: FrameData{StateNo: no}}
+		fb.rows[no] = row
+	}
+	if fd != nil {
+		if !fb.guard || row.Total == 0 {
+			row.FrameData = *fd
+		}
+		if fd.Advantage != nil {
+			if fd.Guarded {
+				row.OnGuard = fd.Advantage
+			} else {
+				row.OnHit = fd.Advantage
+			}
+		}
+	}
+	fb.active, fb.wait = false, 0
+	if fb.idx++; fb.idx >= len(fb.states) {
+		if fb.guard {
+			fb.finish()
+			return
+		}
+		fb.idx, fb.guard = 0, true
+	}
+}
+
+// Writes the table and ends the match
+func (fb *frameDataBatch) finish() {
+	rows := make([]*frameDataRow, 0, len(fb.states))
+	for _, no := range fb.states {
+		if row := fb.rows[no]; row != nil && row.Total > 0 {
+			rows = append(rows, row)
+		}
+	}
+	if err := fb.write(rows); err != nil {
+		sys.errLog.Printf("Failed to write frame data to %v: %v\n", fb.out, err)
+	} else {
+		fmt.Printf("Frame data of %v attacks written to %v\n", len(rows), fb.out)
+	}
+	sys.frameData.batch = nil
+	sys.endMatch = true
+}
+
+func (fb *frameDataBatch) write(rows []*frameDataRow) error {
+	f, err := os.Create(fb.out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !strings.EqualFold(filepath.Ext(fb.out), ".csv") {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"stateno", "startup", "active", "recovery", "total",
+		"onhit", "onguard"})
+	itoa := func(i int32) string { return strconv.Itoa(int(i)) }
+	adv := func(a *int32) string {
+		if a == nil {
+			return ""
+		}
+		return itoa(*a)
+	}
+	for _, r := range rows {
+		w.Write([]string{itoa(r.StateNo), itoa(r.Startup), itoa(r.Active),
+			itoa(r.Recovery), itoa(r.Total), adv(r.OnHit), adv(r.OnGuard)})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -178,10 +186,10 @@ func OnTextEntered(s string) {
 }
 
 func JoystickState(joy, button int) bool {
-	if joy < 0 {
+	if joy == -1 {
 		return sys.keyState[Key(button)]
 	}
-	if joy >= input.GetMaxJoystickCount() {
+	if joy < 0 || joy >= input.GetMaxJoystickCount() {
 		return false
 	}
 	if button >= 0 {
@@ -215,10 +223,20 @@ func JoystickState(joy, button int) bool {
 			return false
 		}
 
-		return val > sys.controllerStickSensitivity
+		return val > joystickSensitivity(joy)
 	}
 }
 
+// Stick sensitivity of the player using the joystick
+func joystickSensitivity(joy int) float32 {
+	for i, jc := range sys.joystickConfig {
+		if jc.Joy == joy {
+			return localInputSettings(i).StickSensitivity
+		}
+	}
+	return sys.inputDefaults.StickSensitivity
+}
+
 type KeyConfig struct{ Joy, dU, dD, dL, dR, kA, kB, kC, kX, kY, kZ, kS, kD, kW, kM int }
 
 func (kc KeyConfig) U() bool { return JoystickState(kc.Joy, kc.dU) }
@@ -236,6 +254,256 @@ func (kc KeyConfig) d() bool { return JoystickState(kc.Joy, kc.kD) }
 func (kc KeyConfig) w() bool { return JoystickState(kc.Joy, kc.kW) }
 func (kc KeyConfig) m() bool { return JoystickState(kc.Joy, kc.kM) }
 
+// Input settings of a player, which config.json keeps in their KeyConfig
+type InputSettings struct {
+	SOCDResolution   int32 // 0 to 4, see SocdResolution
+	ButtonAssist     bool
+	StickSensitivity float32
+	SimpleSpecials   bool // One button specials, see SimpleSpecials
+	Macros           bool // Whether the player has macro or turbo buttons set
+}
+
+// Settings of the local controls at index in of the configs
+func localInputSettings(in int) InputSettings {
+	if in >= 0 && in < len(sys.inputSettings) {
+		return sys.inputSettings[in]
+	}
+	return sys.inputDefaults
+}
+
+// Settings of every input slot, for offline matches those of the controls
+// of each player
+func currentInputSettings() (is [MaxSimul*2 + MaxAttachedChar]InputSettings) {
+	if sys.netInput != nil {
+		return sys.netInput.inputSettings
+	} else if sys.fileInput != nil {
+		return sys.fileInput.inputSettings
+	}
+	for i := range is {
+		is[i] = localInputSettings(sys.inputRemap[i])
+	}
+	return
+}
+
+// Resolves the settings of each player into sys.matchInputSettings once the
+// match is synchronized, for the per frame code and triggers to read. Netplay
+// sessions and their replays keep the settings of each input slot,
+// and the slot of a player is the one they are remapped to, while offline
+// matches and their replays keep them by player already.
+func resolveInputSettings() {
+	is := currentInputSettings()
+	byPlayer := sys.netInput == nil && (sys.fileInput == nil || sys.fileInput.local)
+	for i := range sys.matchInputSettings {
+		if byPlayer {
+			sys.matchInputSettings[i] = is[i]
+		} else {
+			sys.matchInputSettings[i] = is[sys.inputRemap[i]]
+		}
+	}
+}
+
+// Packs the settings into int32s to send them over netplay
+func (is InputSettings) pack() [2]int32 {
+	return [...]int32{is.SOCDResolution | Btoi(is.ButtonAssist)<<8 |
+		Btoi(is.SimpleSpecials)<<9 | Btoi(is.Macros)<<10,
+		int32(math.Float32bits(is.StickSensitivity))}
+}
+
+func unpackInputSettings(v [2]int32) InputSettings {
+	return InputSettings{SOCDResolution: Clamp(v[0]&0xff, 0, 4),
+		ButtonAssist: v[0]&0x100 != 0, StickSensitivity: math.Float32frombits(uint32(v[1])),
+		SimpleSpecials: v[0]&0x200 != 0, Macros: v[0]&0x400 != 0}
+}
+
+// A key that presses several buttons at once
+type InputMacro struct {
+	joystick bool // A button of the joystick config instead of the keyboard one
+	key      int
+	buttons  InputBits
+}
+
+// Macro and turbo buttons of a player, from config.json. Like button assist
+// they change the inputs before they are sent or recorded, so that playback
+// and the other machines in a netplay session see the buttons pressed.
+type InputMacros struct {
+	macros []InputMacro
+	turbo  InputBits // Buttons with autofire
+}
+
+func (im *InputMacros) add(joystick bool, key int, buttons string) {
+	im.macros = append(im.macros, InputMacro{joystick, key, buttonBits(buttons)})
+}
+
+// InputBits of the buttons named by letters such as "xyz"
+func buttonBits(str string) (ib InputBits) {
+	for _, r := range str {
+		if i := strings.IndexRune(cmdButtonSymbols, r); i >= 0 {
+			ib |= IB_A << uint(i)
+		}
+	}
+	return
+}
+
+// Whether macro and turbo buttons can be used in the current match. Netplay
+// sessions follow the rule of the host, and replays the one they were
+// recorded with.
+func currentAllowMacros() bool {
+	if sys.netInput != nil {
+		return sys.netInput.allowMacros
+	} else if sys.fileInput != nil {
+		return sys.fileInput.allowMacros
+	}
+	return sys.allowMacros
+}
+
+// Joy of the joystick config of a player without a joystick
+const JoystickNone = -2
+
+// JoystickSlots keeps each player on the same joystick when controllers are
+// plugged in, unplugged or enumerated in a different order. The Joy of each
+// joystick config is the slot in config.json until the player's device is
+// known, after which the player follows that device by its ID. A device no
+// player knows stays unclaimed until start is pressed on it, which gives it
+// to the first player without a joystick. The IDs are kept in
+// save/joysticks.json.
+type JoystickSlots struct {
+	configJoy []int    // Joy of each player in config.json
+	devices   []string // ID of the device of each player, "" if not known yet
+	unclaimed []int    // Joysticks present that no player has
+}
+
+const joystickSlotsFile = "save/joysticks.json"
+
+// ID of the joystick at an index, the GUID if the backend knows it or else
+// the name. Identical controllers share their ID, and players who use them
+// get them in the order they are enumerated.
+func joystickID(joy int) string {
+	if guid := input.GetJoystickGUID(joy); guid != "" {
+		return guid
+	}
+	return input.GetJoystickName(joy)
+}
+
+// Reads the devices of the players and assigns the joysticks present, once
+// the input backend is running
+func (js *JoystickSlots) load() {
+	js.configJoy = make([]int, len(sys.joystickConfig))
+	for i, jc := range sys.joystickConfig {
+		js.configJoy[i] = jc.Joy
+	}
+	js.devices = make([]string, len(sys.joystickConfig))
+	if b, err := os.ReadFile(joystickSlotsFile); err == nil {
+		var devices []string
+		if err := json.Unmarshal(b, &devices); err != nil {
+			sys.errLog.Printf("Failed to read %v: %v\n", joystickSlotsFile, err)
+		}
+		copy(js.devices, devices)
+	}
+	js.refresh()
+}
+
+func (js *JoystickSlots) save() {
+	b, err := json.MarshalIndent(js.devices, "", "  ")
+	if err == nil {
+		err = os.WriteFile(joystickSlotsFile, b, 0644)
+	}
+	if err != nil {
+		sys.errLog.Printf("Failed to save %v: %v\n", joystickSlotsFile, err)
+	}
+}
+
+// Assigns the joysticks present to the players
+func (js *JoystickSlots) refresh() {
+	if len(js.devices) != len(sys.joystickConfig) {
+		return
+	}
+	used := make([]bool, input.GetMaxJoystickCount())
+	present := func(joy int) bool {
+		return joy >= 0 && joy < len(used) && !used[joy] && input.IsJoystickPresent(joy)
+	}
+	// Known devices first, wherever they are now
+	for i := range sys.joystickConfig {
+		sys.joystickConfig[i].Joy = JoystickNone
+		if js.devices[i] == "" {
+			continue
+		}
+		for joy := range used {
+			if present(joy) && joystickID(joy) == js.devices[i] {
+				sys.joystickConfig[i].Joy, used[joy] = joy, true
+				break
+			}
+		}
+	}
+	// Then players who have not used a joystick yet get the one of their
+	// slot in config.json, which they keep from now on
+	changed := false
+	for i, joy := range js.configJoy {
+		if js.devices[i] == "" && present(joy) {
+			sys.joystickConfig[i].Joy, used[joy] = joy, true
+			js.devices[i], changed = joystickID(joy), true
+		}
+	}
+	js.unclaimed = js.unclaimed[:0]
+	for joy := range used {
+		if present(joy) {
+			js.unclaimed = append(js.unclaimed, joy)
+		}
+	}
+	if changed {
+		js.save()
+	}
+}
+
+// Gives the joystick at index joy to player i, or takes the player's
+// joystick away if joy is negative
+func (js *JoystickSlots) Assign(i, joy int) {
+	if i < 0 || i >= len(js.devices) {
+		return
+	}
+	js.devices[i] = ""
+	if joy >= 0 && input.IsJoystickPresent(joy) {
+		id := joystickID(joy)
+		// Whoever had the device loses it
+		for j, jc := range sys.joystickConfig {
+			if jc.Joy == joy {
+				js.devices[j] = ""
+			}
+		}
+		js.devices[i] = id
+	}
+	js.save()
+	js.refresh()
+}
+
+// Lets unclaimed joysticks claim a player by pressing start
+func (js *JoystickSlots) update() {
+	for _, joy := range js.unclaimed {
+		for i, jc := range sys.joystickConfig {
+			if jc.Joy != JoystickNone {
+				continue
+			}
+			if JoystickState(joy, jc.kS) {
+				sys.errLog.Printf("Joystick %v (%v) claimed by P%v\n", joy,
+					input.GetJoystickName(joy), i+1)
+				js.Assign(i, joy)
+				return
+			}
+			// Start is read with the layout of the first free player
+			break
+		}
+	}
+}
+
+// Called by the input backend when a joystick is plugged in or unplugged
+func OnJoystickConnected(joy int, connected bool) {
+	if connected {
+		sys.errLog.Printf("Joystick %v connected: %v\n", joy, input.GetJoystickName(joy))
+	} else {
+		sys.errLog.Printf("Joystick %v disconnected\n", joy)
+	}
+	sys.joystickSlots.refresh()
+}
+
 type InputBits int32
 
 const (
@@ -274,8 +542,9 @@ func (ib *InputBits) KeysToBits(U, D, L, R, a, b, c, x, y, z, s, d, w, m bool) {
 		Btoi(m)<<13)
 }
 
-// Convert received input bits back into keys
-func (ib InputBits) BitsToKeys(cb *CommandBuffer, facing int32) {
+// Convert received input bits back into keys, resolving SOCD with the
+// method of the player who sent them
+func (ib InputBits) BitsToKeys(cb *CommandBuffer, facing int32, socd int32) {
 	var U, D, B, F, L, R, a, b, c, x, y, z, s, d, w, m bool
 	// Convert bits to logical symbols
 	U = ib&IB_PU != 0
@@ -297,17 +566,12 @@ func (ib InputBits) BitsToKeys(cb *CommandBuffer, facing int32) {
 	d = ib&IB_D != 0
 	w = ib&IB_W != 0
 	m = ib&IB_M != 0
-	// Absolute priority SOCD resolution is enforced during netplay
-	// TODO: Port the other options as well
-	if U && D {
-		D = false
-	}
-	if B && F {
-		B = false
+	U, D, B, F = cb.InputReader.SocdResolution(U, D, B, F, socd)
+	if L && R {
 		if facing < 0 {
-			R = false
+			R, L = B, F
 		} else {
-			L = false
+			L, R = B, F
 		}
 	}
 	cb.Input(B, D, F, U, L, R, a, b, c, x, y, z, s, d, w, m)
@@ -325,8 +589,10 @@ func NewCommandKeyRemap() *CommandKeyRemap {
 type InputReader struct {
 	SocdAllow          [4]bool
 	SocdFirst          [4]bool
+	SocdInput          [4]bool // U, D, B and F before the last resolution
 	ButtonAssist       bool
 	ButtonAssistBuffer [9]bool
+	TurboTime          [10]int32 // Frames each turbo button has been held
 }
 
 func NewInputReader() *InputReader {
@@ -335,6 +601,7 @@ func NewInputReader() *InputReader {
 		SocdFirst:          [4]bool{},
 		ButtonAssist:       false,
 		ButtonAssistBuffer: [9]bool{},
+		TurboTime:          [10]int32{},
 	}
 }
 
@@ -381,156 +648,187 @@ func (ir *InputReader) LocalInput(in int) (bool, bool, bool, bool, bool, bool, b
 			m = m || sys.joystickConfig[in].m()
 		}
 	}
+	// So are macros, which the match rules may forbid
+	if in < len(sys.inputMacros) && currentAllowMacros() {
+		ir.MacroCheck(in, [...]*bool{&a, &b, &c, &x, &y, &z, &s, &d, &w, &m})
+	}
 	// Button assist is checked locally so that the sent inputs are already processed
-	if sys.inputButtonAssist {
+	if localInputSettings(in).ButtonAssist {
 		a, b, c, x, y, z, s, d, w = ir.ButtonAssistCheck(a, b, c, x, y, z, s, d, w)
 	}
 	return U, D, L, R, a, b, c, x, y, z, s, d, w, m
 }
 
-// Resolve Simultaneous Opposing Cardinal Directions
-// Left and Right are solved in CommandList Input
-func (ir *InputReader) SocdResolution(U, D, B, F bool) (bool, bool, bool, bool) {
-	// Absolute priority SOCD resolution is enforced during netplay
-	if sys.netInput != nil || sys.fileInput != nil {
-		if U && D {
-			D = false
-		}
-		if B && F {
-			B = false
-		}
-	} else {
-		// Check first direction held between U and D
-		if U || D {
-			if !U {
-				ir.SocdFirst[0] = false
-			}
-			if !D {
-				ir.SocdFirst[1] = false
-			}
-			if !ir.SocdFirst[0] && !ir.SocdFirst[1] {
-				if D {
-					ir.SocdFirst[1] = true
-				} else {
-					ir.SocdFirst[0] = true
-				}
-			}
-		} else {
+// Resolve Simultaneous Opposing Cardinal Directions with the given method
+// Left and Right are solved by the callers from the resolved Back and Forward
+func (ir *InputReader) SocdResolution(U, D, B, F bool, method int32) (bool, bool, bool, bool) {
+	ir.SocdInput = [...]bool{U, D, B, F}
+	// Check first direction held between U and D
+	if U || D {
+		if !U {
 			ir.SocdFirst[0] = false
+		}
+		if !D {
 			ir.SocdFirst[1] = false
 		}
-		// Check first direction held between B and F
-		if B || F {
-			if !B {
-				ir.SocdFirst[2] = false
-			}
-			if !F {
-				ir.SocdFirst[3] = false
-			}
-			if !ir.SocdFirst[2] && !ir.SocdFirst[3] {
-				if B {
-					ir.SocdFirst[2] = true
-				} else {
-					ir.SocdFirst[3] = true
-				}
+		if !ir.SocdFirst[0] && !ir.SocdFirst[1] {
+			if D {
+				ir.SocdFirst[1] = true
+			} else {
+				ir.SocdFirst[0] = true
 			}
-		} else {
+		}
+	} else {
+		ir.SocdFirst[0] = false
+		ir.SocdFirst[1] = false
+	}
+	// Check first direction held between B and F
+	if B || F {
+		if !B {
 			ir.SocdFirst[2] = false
+		}
+		if !F {
 			ir.SocdFirst[3] = false
 		}
-		// SOCD for back and forward
-		if B && F {
-			switch sys.inputSOCDresolution {
-			// Type 0 - Allow both directions (no resolution)
-			case 0:
+		if !ir.SocdFirst[2] && !ir.SocdFirst[3] {
+			if B {
+				ir.SocdFirst[2] = true
+			} else {
+				ir.SocdFirst[3] = true
+			}
+		}
+	} else {
+		ir.SocdFirst[2] = false
+		ir.SocdFirst[3] = false
+	}
+	// SOCD for back and forward
+	if B && F {
+		switch method {
+		// Type 0 - Allow both directions (no resolution)
+		case 0:
+			ir.SocdAllow[2] = true
+			ir.SocdAllow[3] = true
+		// Type 1 - Last direction priority
+		case 1:
+			// if F was held before B, disable F
+			if ir.SocdFirst[3] {
 				ir.SocdAllow[2] = true
-				ir.SocdAllow[3] = true
-			// Type 1 - Last direction priority
-			case 1:
-				// if F was held before B, disable F
-				if ir.SocdFirst[3] {
-					ir.SocdAllow[2] = true
-					ir.SocdAllow[3] = false
-				} else {
-					// else disable B
-					ir.SocdAllow[2] = false
-					ir.SocdAllow[3] = true
-				}
-			// Type 2 - Absolute priority (offense over defense)
-			case 2:
+				ir.SocdAllow[3] = false
+			} else {
+				// else disable B
 				ir.SocdAllow[2] = false
 				ir.SocdAllow[3] = true
-			// Type 3 - First direction priority
-			case 3:
-				// if F was held before B, disable B
-				if ir.SocdFirst[3] {
-					ir.SocdAllow[2] = false
-					ir.SocdAllow[3] = true
-				} else {
-					// else disable F
-					ir.SocdAllow[2] = true
-					ir.SocdAllow[3] = false
-				}
-			// Type 4 - Deny either direction (neutral)
-			default:
+			}
+		// Type 2 - Absolute priority (offense over defense)
+		case 2:
+			ir.SocdAllow[2] = false
+			ir.SocdAllow[3] = true
+		// Type 3 - First direction priority
+		case 3:
+			// if F was held before B, disable B
+			if ir.SocdFirst[3] {
 				ir.SocdAllow[2] = false
+				ir.SocdAllow[3] = true
+			} else {
+				// else disable F
+				ir.SocdAllow[2] = true
 				ir.SocdAllow[3] = false
 			}
-		} else {
-			ir.SocdAllow[2] = true
-			ir.SocdAllow[3] = true
+		// Type 4 - Deny either direction (neutral)
+		default:
+			ir.SocdAllow[2] = false
+			ir.SocdAllow[3] = false
 		}
-		// SOCD for down and up
-		if D && U {
-			switch sys.inputSOCDresolution {
-			// Type 0 - Allow both directions (no resolution)
-			case 0:
-				ir.SocdAllow[0] = true
+	} else {
+		ir.SocdAllow[2] = true
+		ir.SocdAllow[3] = true
+	}
+	// SOCD for down and up
+	if D && U {
+		switch method {
+		// Type 0 - Allow both directions (no resolution)
+		case 0:
+			ir.SocdAllow[0] = true
+			ir.SocdAllow[1] = true
+		// Type 1 - Last direction priority
+		case 1:
+			// if U was held before D, disable U
+			if ir.SocdFirst[0] {
+				ir.SocdAllow[0] = false
 				ir.SocdAllow[1] = true
-			// Type 1 - Last direction priority
-			case 1:
-				// if U was held before D, disable U
-				if ir.SocdFirst[0] {
-					ir.SocdAllow[0] = false
-					ir.SocdAllow[1] = true
-				} else {
-					// else disable D
-					ir.SocdAllow[0] = true
-					ir.SocdAllow[1] = false
-				}
-			// Type 2 - Absolute priority (offense over defense)
-			case 2:
+			} else {
+				// else disable D
 				ir.SocdAllow[0] = true
 				ir.SocdAllow[1] = false
-			// Type 3 - First direction priority
-			case 3:
-				// if U was held before D, disable D
-				if ir.SocdFirst[0] {
-					ir.SocdAllow[0] = true
-					ir.SocdAllow[1] = false
-				} else {
-					// else disable U
-					ir.SocdAllow[0] = false
-					ir.SocdAllow[1] = true
-				}
-			// Type 4 - Deny either direction (neutral)
-			default:
-				ir.SocdAllow[0] = false
-				ir.SocdAllow[1] = false
 			}
-		} else {
-			ir.SocdAllow[1] = true
+		// Type 2 - Absolute priority (offense over defense)
+		case 2:
 			ir.SocdAllow[0] = true
+			ir.SocdAllow[1] = false
+		// Type 3 - First direction priority
+		case 3:
+			// if U was held before D, disable D
+			if ir.SocdFirst[0] {
+				ir.SocdAllow[0] = true
+				ir.SocdAllow[1] = false
+			} else {
+				// else disable U
+				ir.SocdAllow[0] = false
+				ir.SocdAllow[1] = true
+			}
+		// Type 4 - Deny either direction (neutral)
+		default:
+			ir.SocdAllow[0] = false
+			ir.SocdAllow[1] = false
 		}
-		// Apply rules
-		U = U && ir.SocdAllow[0]
-		D = D && ir.SocdAllow[1]
-		B = B && ir.SocdAllow[2]
-		F = F && ir.SocdAllow[3]
-	}
+	} else {
+		ir.SocdAllow[1] = true
+		ir.SocdAllow[0] = true
+	}
+	// Apply rules
+	U = U && ir.SocdAllow[0]
+	D = D && ir.SocdAllow[1]
+	B = B && ir.SocdAllow[2]
+	F = F && ir.SocdAllow[3]
 	return U, D, B, F
 }
 
+// Presses the buttons of the macro keys held, then makes the turbo buttons
+// alternate between pressed and released while they are held. The buttons
+// are given in the order of their InputBits.
+func (ir *InputReader) MacroCheck(in int, btns [10]*bool) {
+	im := &sys.inputMacros[in]
+	var ib InputBits
+	for _, mc := range im.macros {
+		joy := -1
+		if mc.joystick {
+			if in >= len(sys.joystickConfig) {
+				continue
+			}
+			joy = sys.joystickConfig[in].Joy
+		} else if in < len(sys.keyConfig) {
+			joy = sys.keyConfig[in].Joy
+		}
+		if JoystickState(joy, mc.key) {
+			ib |= mc.buttons
+		}
+	}
+	for k, p := range btns {
+		bit := IB_A << uint(k)
+		*p = *p || ib&bit != 0
+		if im.turbo&bit == 0 {
+			continue
+		}
+		if !*p {
+			ir.TurboTime[k] = 0
+			continue
+		}
+		// Pressed on the first frame
+		*p = ir.TurboTime[k]/sys.turboInterval%2 == 0
+		ir.TurboTime[k]++
+	}
+}
+
 // Add extra frame of leniency when checking button presses
 func (ir *InputReader) ButtonAssistCheck(a, b, c, x, y, z, s, d, w bool) (bool, bool, bool, bool, bool, bool, bool, bool, bool) {
 	// Set buttons to buffered state
@@ -582,6 +880,18 @@ func (c *CommandBuffer) Reset() {
 	}
 }
 
+// Input bits of the keys held in the buffer, with B and F turned back into
+// L and R so that the bits match what BitsToKeys expects
+func (__ *CommandBuffer) bits(facing int32) (ib InputBits) {
+	L, R := __.B > 0, __.F > 0
+	if facing < 0 {
+		L, R = R, L
+	}
+	ib.KeysToBits(__.U > 0, __.D > 0, L, R, __.a > 0, __.b > 0, __.c > 0,
+		__.x > 0, __.y > 0, __.z > 0, __.s > 0, __.d > 0, __.w > 0, __.m > 0)
+	return
+}
+
 // Update command buffer according to received inputs
 func (__ *CommandBuffer) Input(B, D, F, U, L, R, a, b, c, x, y, z, s, d, w, m bool) {
 	// SOCD resolution is now handled beforehand, so that it may be easier to port to netplay later
@@ -927,10 +1237,16 @@ func (__ *CommandBuffer) LastChangeTime() int32 {
 		Abs(__.mb))
 }
 
+// The frame counters are shared with the network goroutines, which receive
+// the remote slots and send the local ones, so they are accessed atomically
 type NetBuffer struct {
 	buf              [32]InputBits
 	curT, inpT, senT int32
 	InputReader      *InputReader
+	// Rollback mode reads predicted inputs for frames not yet received
+	pred    [32]InputBits
+	predict bool
+	inpTime [32]time.Time
 }
 
 func (nb *NetBuffer) reset(time int32) {
@@ -940,126 +1256,361 @@ func (nb *NetBuffer) reset(time int32) {
 
 // Check local inputs
 func (nb *NetBuffer) localUpdate(in int) {
-	if nb.inpT-nb.curT < 32 {
-		nb.buf[nb.inpT&31].KeysToBits(nb.InputReader.LocalInput(in))
-		nb.inpT++
+	if t := nb.frames(); t-nb.curT < 32 {
+		nb.buf[t&31].KeysToBits(nb.InputReader.LocalInput(in))
+		nb.inpTime[t&31] = time.Now()
+		atomic.AddInt32(&nb.inpT, 1)
 	}
 }
 
+// Number of frames whose inputs are in the buffer
+func (nb *NetBuffer) frames() int32 {
+	return atomic.LoadInt32(&nb.inpT)
+}
+
+func (nb *NetBuffer) setCurT(t int32) {
+	atomic.StoreInt32(&nb.curT, t)
+}
+
 // Convert bits to keys
-func (nb *NetBuffer) input(cb *CommandBuffer, facing int32) {
-	if nb.curT < nb.inpT {
-		nb.buf[nb.curT&31].BitsToKeys(cb, facing)
+func (nb *NetBuffer) input(cb *CommandBuffer, facing int32, socd int32) {
+	if nb.predict {
+		nb.pred[nb.curT&31].BitsToKeys(cb, facing, socd)
+	} else if nb.curT < nb.frames() {
+		nb.buf[nb.curT&31].BitsToKeys(cb, facing, socd)
+	}
+}
+
+// Input bits in effect for the current frame
+func (nb *NetBuffer) bits() InputBits {
+	if nb.predict {
+		return nb.pred[nb.curT&31]
 	}
+	return nb.buf[nb.curT&31]
 }
 
+// NetInput runs a session between two or more machines. The guests connect
+// to the host, which relays the inputs of each machine to the others, so
+// every machine receives the inputs of all the input slots it does not own.
+// The goroutine that connects sets local and ready under mu.
 type NetInput struct {
-	ln           *net.TCPListener
-	conn         *net.TCPConn
+	ln           io.Closer // Listening socket of the host
+	mu           sync.Mutex
+	peers        []*netPeer
+	numPeers     int   // Machines in the session, the host included
+	local        []int // Input slots of the players on this machine
+	ready        bool  // Whether every machine has been given its slots
 	st           NetState
-	sendEnd      chan bool
-	recvEnd      chan bool
 	buf          [MaxSimul*2 + MaxAttachedChar]NetBuffer
-	locIn        int
-	remIn        int
 	time         int32
 	stoppedcnt   int32
 	delay        int32
-	rep          *os.File
+	rep          *ReplayWriter
+	spec         *ReplayWriter // Stream sent to spectators by the host
 	host         bool
 	preFightTime int32
+	aiController AIControllerType // The host's, used by every machine
+	allowMacros  bool             // Also the host's
+	// Settings of each slot, from the machine the slot belongs to
+	inputSettings [MaxSimul*2 + MaxAttachedChar]InputSettings
+	inputDelay    int32
+	rollback      int32
+	latency       time.Duration
+	rb            *Rollback
+	// Desync detection
+	syncIn    chan syncMessage
+	syncLocal map[int32]*SyncState
+	desync    int32 // First frame that differed from another machine, or -1
+}
+
+// Connection to another machine of the session. The host has one per guest
+// and guests have one to the host.
+type netPeer struct {
+	conn    NetTransport
+	recv    []int // Slots whose inputs arrive from the peer, in stream order
+	send    []int // Slots whose inputs are sent to the peer
+	senT    int32 // Next frame to send, accessed atomically
+	sendEnd chan bool
+	recvEnd chan bool
+	syncOut chan []int32
+	// Hashes received from the peer, by frame
+	syncRemote map[int32]uint32
+}
+
+func newNetPeer(conn NetTransport) *netPeer {
+	p := &netPeer{conn: conn, sendEnd: make(chan bool, 1), recvEnd: make(chan bool, 1),
+		syncOut: make(chan []int32, 64)}
+	p.sendEnd <- true
+	p.recvEnd <- true
+	return p
 }
 
 func NewNetInput() *NetInput {
 	ni := &NetInput{st: NS_Stop,
-		sendEnd: make(chan bool, 1), recvEnd: make(chan bool, 1)}
-	ni.sendEnd <- true
-	ni.recvEnd <- true
+		inputDelay: sys.netplayInputDelay, rollback: sys.netplayRollbackFrames,
+		syncIn: make(chan syncMessage, 64), desync: -1}
+	if ms, err := strconv.Atoi(sys.cmdFlags["-netlatency"]); err == nil && ms > 0 {
+		ni.latency = time.Duration(ms) * time.Millisecond
+	}
 	return ni
 }
 
 func (ni *NetInput) Close() {
-	if ni.ln != nil {
-		ni.ln.Close()
-		ni.ln = nil
-	}
-	if ni.conn != nil {
-		ni.conn.Close()
-	}
-	if ni.sendEnd != nil {
-		<-ni.sendEnd
-		close(ni.sendEnd)
-		ni.sendEnd = nil
-	}
-	if ni.recvEnd != nil {
-		<-ni.recvEnd
-		close(ni.recvEnd)
-		ni.recvEnd = nil
-	}
-	ni.conn = nil
-}
-
-func (ni *NetInput) GetHostGuestRemap() (host, guest int) {
-	host, guest = -1, -1
+	if ni.spec != nil {
+		ni.spec.Close()
+		ni.spec = nil
+	}
+	ni.mu.Lock()
+	peers, ln := ni.peers, ni.ln
+	ni.peers, ni.ln = nil, nil
+	ni.mu.Unlock()
+	// The UDP transports of the host send a goodbye on the listening socket,
+	// so the connections are closed first
+	for _, p := range peers {
+		p.conn.Close()
+	}
+	if ln != nil {
+		ln.Close()
+	}
+	for _, p := range peers {
+		<-p.sendEnd
+		close(p.sendEnd)
+		<-p.recvEnd
+		close(p.recvEnd)
+	}
+	ni.mu.Lock()
+	ni.ready = false
+	ni.mu.Unlock()
+}
+
+// Input slots in the order they are given to machines: the ones of human
+// players first
+func netplaySlots() (slots []int) {
 	for i, c := range sys.com {
 		if c == 0 {
-			if host < 0 {
-				host = i
-			} else if guest < 0 {
-				guest = i
-			}
+			slots = append(slots, i)
 		}
 	}
-	if host < 0 {
-		host = 0
-	}
-	if guest < 0 {
-		guest = (host + 1) % len(ni.buf)
+	for i, c := range sys.com {
+		if c != 0 {
+			slots = append(slots, i)
+		}
 	}
 	return
 }
 
 func (ni *NetInput) Accept(port string) error {
+	ni.host = true
+	ni.numPeers = int(sys.netplayPeers)
+	if sys.netplaySpectatorPort != "" {
+		if ss, err := NewSpectatorServer(sys.netplaySpectatorPort); err != nil {
+			sys.errLog.Printf("Failed to accept spectators: %v", err)
+		} else {
+			ni.spec = newReplayWriter(ss, 1)
+		}
+	}
+	if sys.netplayTransport == "udp" {
+		addr, err := net.ResolveUDPAddr("udp", ":"+port)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		sock := newUDPSocket(conn, false)
+		ni.ln = sock
+		go ni.acceptPeers(func() (NetTransport, error) { return sock.accept() })
+		return nil
+	}
 	if ln, err := net.Listen("tcp", ":"+port); err != nil {
 		return err
 	} else {
-		ni.ln = ln.(*net.TCPListener)
-		ni.host = true
-		ni.locIn, ni.remIn = ni.GetHostGuestRemap()
+		ni.ln = ln
 		go func() {
-			ln := ni.ln
-			if conn, err := ln.AcceptTCP(); err == nil {
-				ni.conn = conn
-			}
+			ni.acceptPeers(func() (NetTransport, error) {
+				conn, err := ln.(*net.TCPListener).AcceptTCP()
+				if err != nil {
+					return nil, err
+				}
+				return &tcpTransport{conn}, nil
+			})
 			ln.Close()
 		}()
 	}
 	return nil
 }
 
+// Waits for the guests, each of which starts by sending the number of
+// players on their machine, then tells every guest which slots it owns
+func (ni *NetInput) acceptPeers(accept func() (NetTransport, error)) {
+	slots := netplaySlots()
+	take := func(n int) (s []int) {
+		s, slots = slots[:n], slots[n:]
+		return
+	}
+	local := take(int(sys.netplayLocalPlayers))
+	var active []int
+	active = append(active, local...)
+	var owned [][]int
+	for len(owned) < ni.numPeers-1 {
+		conn, err := accept()
+		if err != nil {
+			return
+		}
+		n, err := conn.ReadI32()
+		if err != nil || n < 1 || int(n) > len(slots) {
+			conn.Close()
+			continue
+		}
+		ni.mu.Lock()
+		if ni.ln == nil {
+			// Closed while waiting
+			ni.mu.Unlock()
+			conn.Close()
+			return
+		}
+		ni.peers = append(ni.peers, newNetPeer(conn))
+		ni.mu.Unlock()
+		owned = append(owned, take(int(n)))
+		active = append(active, owned[len(owned)-1]...)
+	}
+	for i, p := range ni.peers {
+		p.recv = owned[i]
+		p.send = slotsExcept(active, owned[i])
+		msg := []int32{int32(len(active))}
+		for _, s := range active {
+			msg = append(msg, int32(s))
+		}
+		msg = append(msg, int32(len(owned[i])))
+		for _, s := range owned[i] {
+			msg = append(msg, int32(s))
+		}
+		for _, v := range msg {
+			if p.conn.WriteI32(v) != nil {
+				return
+			}
+		}
+	}
+	ni.mu.Lock()
+	ni.local, ni.ready = local, true
+	ni.mu.Unlock()
+}
+
+func slotsExcept(slots, except []int) (s []int) {
+	for _, i := range slots {
+		found := false
+		for _, j := range except {
+			found = found || i == j
+		}
+		if !found {
+			s = append(s, i)
+		}
+	}
+	return
+}
+
 func (ni *NetInput) Connect(server, port string) {
 	ni.host = false
-	ni.remIn, ni.locIn = ni.GetHostGuestRemap()
 	go func() {
-		if conn, err := net.Dial("tcp", server+":"+port); err == nil {
-			ni.conn = conn.(*net.TCPConn)
+		var conn NetTransport
+		if sys.netplayTransport == "udp" {
+			addr, err := net.ResolveUDPAddr("udp", server+":"+port)
+			if err != nil {
+				return
+			}
+			c, err := net.DialUDP("udp", nil, addr)
+			if err != nil {
+				return
+			}
+			if conn, err = dialUDP(c); err != nil {
+				c.Close()
+				return
+			}
+		} else {
+			c, err := net.Dial("tcp", server+":"+port)
+			if err != nil {
+				return
+			}
+			conn = &tcpTransport{c.(*net.TCPConn)}
+		}
+		if ni.joinHost(conn) != nil {
+			conn.Close()
 		}
 	}()
 }
 
+// Tells the host how many players are on this machine and reads the slots
+// they were given
+func (ni *NetInput) joinHost(conn NetTransport) error {
+	if err := conn.WriteI32(sys.netplayLocalPlayers); err != nil {
+		return err
+	}
+	readSlots := func() (s []int, err error) {
+		var n, v int32
+		if n, err = conn.ReadI32(); err != nil {
+			return
+		}
+		for ; n > 0; n-- {
+			if v, err = conn.ReadI32(); err != nil {
+				return
+			}
+			if v < 0 || int(v) >= len(ni.buf) {
+				return nil, Error("Invalid netplay slot")
+			}
+			s = append(s, int(v))
+		}
+		return
+	}
+	active, err := readSlots()
+	if err != nil {
+		return err
+	}
+	local, err := readSlots()
+	if err != nil {
+		return err
+	} else if len(local) == 0 {
+		return Error("No netplay slot given by the host")
+	}
+	p := newNetPeer(conn)
+	p.recv, p.send = slotsExcept(active, local), local
+	ni.mu.Lock()
+	ni.peers = append(ni.peers, p)
+	ni.local, ni.ready = local, true
+	ni.mu.Unlock()
+	return nil
+}
+
+// Returns the replay file and spectator stream the confirmed inputs are
+// written to
+func (ni *NetInput) writers() (w []*ReplayWriter) {
+	for _, rw := range [...]*ReplayWriter{ni.rep, ni.spec} {
+		if rw != nil {
+			w = append(w, rw)
+		}
+	}
+	return
+}
+
 func (ni *NetInput) IsConnected() bool {
-	return ni != nil && ni.conn != nil
+	if ni == nil {
+		return false
+	}
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	return ni.ready
 }
 
 func (ni *NetInput) Input(cb *CommandBuffer, i int, facing int32) {
 	if i >= 0 && i < len(ni.buf) {
-		ni.buf[sys.inputRemap[i]].input(cb, facing)
+		s := sys.inputRemap[i]
+		ni.buf[s].input(cb, facing, ni.inputSettings[s].SOCDResolution)
 	}
 }
 
 func (ni *NetInput) AnyButton() bool {
-	for _, nb := range ni.buf {
-		if nb.buf[nb.curT&31]&IB_anybutton != 0 {
+	for i := range ni.buf {
+		if ni.buf[i].bits()&IB_anybutton != 0 {
 			return true
 		}
 	}
@@ -1067,16 +1618,19 @@ func (ni *NetInput) AnyButton() bool {
 }
 
 func (ni *NetInput) Stop() {
+	ni.stopRollback()
 	if sys.esc {
 		ni.end()
 	} else {
 		if ni.st != NS_End && ni.st != NS_Error {
 			ni.st = NS_Stop
 		}
-		<-ni.sendEnd
-		ni.sendEnd <- true
-		<-ni.recvEnd
-		ni.recvEnd <- true
+		for _, p := range ni.peers {
+			<-p.sendEnd
+			p.sendEnd <- true
+			<-p.recvEnd
+			p.recvEnd <- true
+		}
 	}
 }
 
@@ -1087,18 +1641,56 @@ func (ni *NetInput) end() {
 	ni.Close()
 }
 
-func (ni *NetInput) readI32() (int32, error) {
-	b := [4]byte{}
-	if _, err := ni.conn.Read(b[:]); err != nil {
-		return 0, err
+// Sends v from the host to every guest, returning the value the host sent
+func (ni *NetInput) share(v int32) (int32, error) {
+	if !ni.host {
+		return ni.peers[0].conn.ReadI32()
+	}
+	for _, p := range ni.peers {
+		if err := p.conn.WriteI32(v); err != nil {
+			return 0, err
+		}
 	}
-	return int32(b[0]) | int32(b[1])<<8 | int32(b[2])<<16 | int32(b[3])<<24, nil
+	return v, nil
 }
 
-func (ni *NetInput) writeI32(i32 int32) error {
-	b := [...]byte{byte(i32), byte(i32 >> 8), byte(i32 >> 16), byte(i32 >> 24)}
-	if _, err := ni.conn.Write(b[:]); err != nil {
-		return err
+// Gathers the input settings of every slot on the host, from the machine the
+// slot belongs to, and sends them all to every guest
+func (ni *NetInput) shareInputSettings() error {
+	if !ni.host {
+		for i := range ni.local {
+			for _, v := range localInputSettings(i).pack() {
+				if err := ni.peers[0].conn.WriteI32(v); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		for i, s := range ni.local {
+			ni.inputSettings[s] = localInputSettings(i)
+		}
+		for _, p := range ni.peers {
+			for _, s := range p.recv {
+				var v [2]int32
+				for j := range v {
+					var err error
+					if v[j], err = p.conn.ReadI32(); err != nil {
+						return err
+					}
+				}
+				ni.inputSettings[s] = unpackInputSettings(v)
+			}
+		}
+	}
+	for s := range ni.inputSettings {
+		var v [2]int32
+		for j, pv := range ni.inputSettings[s].pack() {
+			var err error
+			if v[j], err = ni.share(pv); err != nil {
+				return err
+			}
+		}
+		ni.inputSettings[s] = unpackInputSettings(v)
 	}
 	return nil
 }
@@ -1107,93 +1699,236 @@ func (ni *NetInput) Synchronize() error {
 	if !ni.IsConnected() || ni.st == NS_Error {
 		return Error("Can not connect to the other player")
 	}
+	// The first local slot paces the input of this machine
+	if len(ni.local) == 0 {
+		return Error("No netplay slot for the players on this machine")
+	}
 	ni.Stop()
 	var seed int32
 	if ni.host {
 		seed = Random()
-		if err := ni.writeI32(seed); err != nil {
+	}
+	seed, err := ni.share(seed)
+	if err != nil {
+		return err
+	}
+	Srand(seed)
+	pfTime, err := ni.share(sys.preFightTime)
+	if err != nil {
+		return err
+	}
+	ni.preFightTime = pfTime
+	aiController, err := ni.share(int32(sys.aiController))
+	if err != nil {
+		return err
+	}
+	ni.aiController = AIControllerType(aiController)
+	allowMacros, err := ni.share(Btoi(sys.allowMacros))
+	if err != nil {
+		return err
+	}
+	ni.allowMacros = allowMacros != 0
+	if err := ni.shareInputSettings(); err != nil {
+		return err
+	}
+	for _, rw := range ni.writers() {
+		rw.writeMatch(newReplayMatch(seed, pfTime))
+	}
+	for _, p := range ni.peers {
+		if err := p.conn.WriteI32(ni.time); err != nil {
 			return err
 		}
-	} else {
-		var err error
-		if seed, err = ni.readI32(); err != nil {
+	}
+	for _, p := range ni.peers {
+		if tmp, err := p.conn.ReadI32(); err != nil {
 			return err
+		} else if tmp != ni.time {
+			return Error("Synchronization error")
 		}
 	}
-	Srand(seed)
-	var pfTime int32
-	if ni.host {
-		pfTime = sys.preFightTime
-		if err := ni.writeI32(pfTime); err != nil {
-			return err
+	for _, s := range ni.local {
+		ni.buf[s].reset(ni.time)
+	}
+	for _, p := range ni.peers {
+		atomic.StoreInt32(&p.senT, ni.time)
+		p.syncRemote = map[int32]uint32{}
+		for _, s := range p.recv {
+			ni.buf[s].reset(ni.time)
 		}
-	} else {
+	}
+	ni.syncLocal = map[int32]*SyncState{}
+	ni.desync = -1
+	ni.st = NS_Playing
+	for _, p := range ni.peers {
+		<-p.sendEnd
+		go ni.sendInputs(p)
+		<-p.recvEnd
+		go ni.receiveInputs(p)
+	}
+	ni.Update()
+	return nil
+}
+
+// Whether the inputs of frame p.senT can be sent to p
+func (ni *NetInput) sendable(p *netPeer) bool {
+	senT := atomic.LoadInt32(&p.senT)
+	for _, s := range p.send {
+		nb := &ni.buf[s]
+		if nb.frames() <= senT {
+			return false
+		}
+		// Outgoing local inputs can be held back to simulate latency
+		if ni.latency > 0 && ni.isLocal(s) && time.Since(nb.inpTime[senT&31]) < ni.latency {
+			return false
+		}
+	}
+	return len(p.send) > 0
+}
+
+func (ni *NetInput) sendInputs(p *netPeer) {
+	defer func() { p.sendEnd <- true }()
+	for ni.st == NS_Playing {
+		select {
+		case msg := <-p.syncOut:
+			for _, v := range msg {
+				if err := p.conn.WriteI32(v); err != nil {
+					ni.st = NS_Error
+					return
+				}
+			}
+		default:
+		}
+		if ni.sendable(p) {
+			senT := atomic.LoadInt32(&p.senT)
+			for _, s := range p.send {
+				if err := p.conn.WriteI32(int32(ni.buf[s].buf[senT&31])); err != nil {
+					ni.st = NS_Error
+					return
+				}
+			}
+			atomic.AddInt32(&p.senT, 1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.conn.WriteI32(-1)
+}
+
+// Whether the buffers of the slots received from p have room for a frame. The
+// host also keeps the frames it has not relayed to every guest yet.
+func (ni *NetInput) receivable(p *netPeer) bool {
+	sent := ni.sentT()
+	for _, s := range p.recv {
+		nb := &ni.buf[s]
+		if nb.frames()-Min(atomic.LoadInt32(&nb.curT), sent) >= 32 {
+			return false
+		}
+	}
+	return true
+}
+
+func (ni *NetInput) receiveInputs(p *netPeer) {
+	defer func() { p.recvEnd <- true }()
+	for ni.st == NS_Playing {
+		if ni.receivable(p) {
+			tmp, err := p.conn.ReadI32()
+			if err != nil {
+				ni.st = NS_Error
+				return
+			}
+			if tmp < -1 {
+				if err := ni.readSyncMessage(p, tmp); err != nil {
+					ni.st = NS_Error
+					return
+				}
+				continue
+			}
+			if tmp < 0 {
+				ni.st = NS_Stopped
+				return
+			}
+			for i, s := range p.recv {
+				if i > 0 {
+					if tmp, err = p.conn.ReadI32(); err != nil {
+						ni.st = NS_Error
+						return
+					}
+				}
+				ni.buf[s].buf[ni.buf[s].frames()&31] = InputBits(tmp)
+			}
+			for _, s := range p.recv {
+				atomic.AddInt32(&ni.buf[s].inpT, 1)
+			}
+			continue
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for tmp := int32(0); tmp != -1; {
 		var err error
-		if pfTime, err = ni.readI32(); err != nil {
-			return err
+		if tmp, err = p.conn.ReadI32(); err != nil {
+			break
+		}
+		if tmp < -1 && ni.readSyncMessage(p, tmp) != nil {
+			break
 		}
 	}
-	ni.preFightTime = pfTime
-	if ni.rep != nil {
-		binary.Write(ni.rep, binary.LittleEndian, &seed)
-		binary.Write(ni.rep, binary.LittleEndian, &pfTime)
+}
+
+func (ni *NetInput) isLocal(slot int) bool {
+	for _, s := range ni.local {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of frames sent to every other machine
+func (ni *NetInput) sentT() int32 {
+	t := int32(math.MaxInt32)
+	for _, p := range ni.peers {
+		t = Min(t, atomic.LoadInt32(&p.senT))
+	}
+	return t
+}
+
+// Number of frames received from every other machine
+func (ni *NetInput) received() int32 {
+	t := int32(math.MaxInt32)
+	for _, p := range ni.peers {
+		for _, s := range p.recv {
+			t = Min(t, ni.buf[s].frames())
+		}
+	}
+	return t
+}
+
+// Reads the next frame of the players on this machine
+func (ni *NetInput) localUpdate() {
+	for i, s := range ni.local {
+		ni.buf[s].localUpdate(i)
+	}
+}
+
+// Points the buffers of every slot in the session at frame t
+func (ni *NetInput) setCurT(t int32) {
+	for _, s := range ni.local {
+		ni.buf[s].setCurT(t)
+	}
+	for _, p := range ni.peers {
+		for _, s := range p.recv {
+			ni.buf[s].setCurT(t)
+		}
 	}
-	if err := ni.writeI32(ni.time); err != nil {
-		return err
+}
+
+func (ni *NetInput) writeReplayFrame(t int32) {
+	var ib [len(ni.buf)]InputBits
+	for i := range ni.buf {
+		ib[i] = ni.buf[i].buf[t&31]
 	}
-	if tmp, err := ni.readI32(); err != nil {
-		return err
-	} else if tmp != ni.time {
-		return Error("Synchronization error")
+	for _, rw := range ni.writers() {
+		rw.writeFrame(ib[:])
 	}
-	ni.buf[ni.locIn].reset(ni.time)
-	ni.buf[ni.remIn].reset(ni.time)
-	ni.st = NS_Playing
-	<-ni.sendEnd
-	go func(nb *NetBuffer) {
-		defer func() { ni.sendEnd <- true }()
-		for ni.st == NS_Playing {
-			if nb.senT < nb.inpT {
-				if err := ni.writeI32(int32(nb.buf[nb.senT&31])); err != nil {
-					ni.st = NS_Error
-					return
-				}
-				nb.senT++
-			}
-			time.Sleep(time.Millisecond)
-		}
-		ni.writeI32(-1)
-	}(&ni.buf[ni.locIn])
-	<-ni.recvEnd
-	go func(nb *NetBuffer) {
-		defer func() { ni.recvEnd <- true }()
-		for ni.st == NS_Playing {
-			if nb.inpT-nb.curT < 32 {
-				if tmp, err := ni.readI32(); err != nil {
-					ni.st = NS_Error
-					return
-				} else {
-					nb.buf[nb.inpT&31] = InputBits(tmp)
-					if tmp < 0 {
-						ni.st = NS_Stopped
-						return
-					} else {
-						nb.inpT++
-						nb.senT = nb.inpT
-					}
-				}
-			}
-			time.Sleep(time.Millisecond)
-		}
-		for tmp := int32(0); tmp != -1; {
-			var err error
-			if tmp, err = ni.readI32(); err != nil {
-				break
-			}
-		}
-	}(&ni.buf[ni.remIn])
-	ni.Update()
-	return nil
 }
 
 func (ni *NetInput) Update() bool {
@@ -1210,11 +1945,17 @@ func (ni *NetInput) Update() bool {
 			}
 			fallthrough
 		case NS_Playing:
+			if ni.rb != nil {
+				ni.rollbackUpdate()
+				break
+			}
 			for {
-				foo := Min(ni.buf[ni.locIn].senT, ni.buf[ni.remIn].senT)
-				tmp := ni.buf[ni.remIn].inpT + ni.delay>>3 - ni.buf[ni.locIn].inpT
+				// The frames received from every machine, whose local inputs
+				// have been sent to every machine
+				foo := Min(ni.sentT(), ni.received())
+				tmp := ni.received() + ni.delay>>3 - ni.buf[ni.local[0]].frames()
 				if tmp >= 0 {
-					ni.buf[ni.locIn].localUpdate(0)
+					ni.localUpdate()
 					if ni.delay > 0 {
 						ni.delay--
 					}
@@ -1227,16 +1968,11 @@ func (ni *NetInput) Update() bool {
 					}
 					continue
 				}
-				ni.buf[ni.locIn].curT = ni.time
-				ni.buf[ni.remIn].curT = ni.time
-				if ni.rep != nil {
-					for _, nb := range ni.buf {
-						binary.Write(ni.rep, binary.LittleEndian, &nb.buf[ni.time&31])
-					}
-				}
+				ni.setCurT(ni.time)
+				ni.confirmFrame(ni.time, nil)
 				ni.time++
 				if ni.time >= foo {
-					ni.buf[ni.locIn].localUpdate(0)
+					ni.localUpdate()
 				}
 				break
 			}
@@ -1251,15 +1987,58 @@ func (ni *NetInput) Update() bool {
 }
 
 type FileInput struct {
-	f      *os.File
+	f      io.ReadCloser
+	live   *spectatorStream // Set when watching a netplay session
 	ib     [MaxSimul*2 + MaxAttachedChar]InputBits
 	pfTime int32
-}
-
-func OpenFileInput(filename string) *FileInput {
-	fi := &FileInput{}
-	fi.f, _ = os.Open(filename)
-	return fi
+	frames []InputBits // Rest of the current input chunk
+	// AI controller, input settings and macro rule of the recorded matches
+	aiController  AIControllerType
+	inputSettings [MaxSimul*2 + MaxAttachedChar]InputSettings
+	allowMacros   bool
+	width         int32
+	local         bool // Frames are indexed by player instead of input slot
+	offline       bool // Recorded offline, so each fight selects its own match
+	// Chunk read ahead by peekChunk
+	peekTag  string
+	peekData []byte
+	// Checksum of a round that ends before the frame read ahead of it
+	roundSum []byte
+	// Playback controls
+	index     []replayMatchIndex
+	match     int   // Index of the current match
+	frame     int32 // Number of frames read since the match started
+	keyframes []replayKeyframe
+	rewind    *replayKeyframe // Keyframe to restore on the next update
+	seekFrame int32           // Frame to fast forward to, or -1
+	seekPause bool            // Pause state to restore once the seek is done
+	timeline  bool
+	desync    int32 // First frame that played back differently, or -1
+}
+
+// Snapshot of the match taken when playback reaches a keyframe chunk
+type replayKeyframe struct {
+	frame  int32
+	offset int64 // Position of the input chunk after the keyframe
+	state  *GameState
+}
+
+func OpenFileInput(filename string) (*FileInput, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readReplayHeader(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	index, err := indexReplay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileInput{f: f, index: index, offline: len(index) > 0 && index[0].local,
+		match: -1, seekFrame: -1, timeline: true, desync: -1}, nil
 }
 
 func (fi *FileInput) Close() {
@@ -1271,8 +2050,16 @@ func (fi *FileInput) Close() {
 
 // Convert bits to keys
 func (fi *FileInput) Input(cb *CommandBuffer, i int, facing int32) {
-	if i >= 0 && i < len(fi.ib) {
-		fi.ib[sys.inputRemap[i]].BitsToKeys(cb, facing)
+	if fi.local {
+		if i < 0 {
+			i = ^i
+		}
+		if i < len(fi.ib) {
+			fi.ib[i].BitsToKeys(cb, facing, fi.inputSettings[i].SOCDResolution)
+		}
+	} else if i >= 0 && i < len(fi.ib) {
+		s := sys.inputRemap[i]
+		fi.ib[s].BitsToKeys(cb, facing, fi.inputSettings[s].SOCDResolution)
 	}
 }
 
@@ -1285,17 +2072,108 @@ func (fi *FileInput) AnyButton() bool {
 	return false
 }
 
-func (fi *FileInput) Synchronize() {
-	if fi.f != nil {
-		var seed int32
-		if binary.Read(fi.f, binary.LittleEndian, &seed) == nil {
-			Srand(seed)
+// Returns the next chunk, skipping the ones this version does not use
+func (fi *FileInput) readChunk() (tag string, data []byte, err error) {
+	if fi.peekTag != "" {
+		tag, data = fi.peekTag, fi.peekData
+		fi.peekTag, fi.peekData = "", nil
+		return
+	}
+	for {
+		if fi.live != nil {
+			tag, data, err = fi.live.next()
+		} else {
+			tag, data, err = readReplayChunk(fi.f)
+		}
+		if err != nil {
+			return
+		}
+		switch tag {
+		case rcMatch, rcInput, rcChecksum, rcKeyframe, rcSyncState:
+			return
+		}
+	}
+}
+
+func (fi *FileInput) peekChunk() (tag string, data []byte, err error) {
+	if tag, data, err = fi.readChunk(); err == nil {
+		fi.peekTag, fi.peekData = tag, data
+	}
+	return
+}
+
+func (fi *FileInput) Synchronize() error {
+	if fi.f == nil {
+		return nil
+	}
+	if len(fi.frames) > 0 {
+		fi.Close()
+		return Error("Replay desynchronized: match started before the recorded one")
+	}
+	tag, data, err := fi.readChunk()
+	if err != nil {
+		fi.Close()
+		return nil
+	}
+	var m ReplayMatch
+	if tag != rcMatch {
+		err = Error("Replay desynchronized: match started before the recorded one")
+	} else if err = m.decode(data); err == nil {
+		err = m.validate(newReplayMatch(m.seed, m.pfTime))
+	}
+	if err != nil {
+		fi.Close()
+		return err
+	}
+	Srand(m.seed)
+	fi.pfTime = m.pfTime
+	fi.aiController = AIControllerType(m.aiController)
+	fi.inputSettings = m.inputSettings
+	fi.allowMacros = m.allowMacros
+	if fi.local = m.local; fi.local {
+		sys.com = m.com
+		for pn, p := range sys.chars {
+			if len(p) > 0 {
+				p[0].key = pn
+				if sys.com[pn] != 0 {
+					p[0].key ^= -1
+				}
+			}
+		}
+	}
+	fi.match++
+	fi.frame = 0
+	fi.keyframes, fi.rewind, fi.seekFrame = nil, nil, -1
+	fi.Update()
+	return nil
+}
+
+// Selects the teams and stage of the next fight of an offline replay, which
+// the fight then loads and plays back. Returns false at the end of the replay.
+func (fi *FileInput) selectFight() bool {
+	if fi.f == nil || !fi.offline {
+		return false
+	}
+	for {
+		tag, data, err := fi.peekChunk()
+		if err != nil {
+			return false
+		}
+		if tag != rcMatch {
+			// Left over from the end of the last fight
+			fi.readChunk()
+			continue
 		}
-		var pfTime int32
-		if binary.Read(fi.f, binary.LittleEndian, &pfTime) == nil {
-			fi.pfTime = pfTime
-			fi.Update()
+		var m ReplayMatch
+		if err = m.decode(data); err == nil {
+			err = m.selectFight()
 		}
+		if err != nil {
+			sys.errLog.Println(err.Error())
+			fi.Close()
+			return false
+		}
+		return true
 	}
 }
 
@@ -1303,8 +2181,12 @@ func (fi *FileInput) Update() bool {
 	if fi.f == nil {
 		sys.esc = true
 	} else {
-		if sys.oldNextAddTime > 0 &&
-			binary.Read(fi.f, binary.LittleEndian, fi.ib[:]) != nil {
+		if fi.rewind != nil {
+			if !fi.loadKeyframe(fi.rewind) {
+				sys.esc = true
+			}
+			fi.rewind = nil
+		} else if sys.oldNextAddTime > 0 && !fi.readFrame() {
 			sys.esc = true
 		}
 		if sys.esc {
@@ -1314,65 +2196,482 @@ func (fi *FileInput) Update() bool {
 	return !sys.gameEnd
 }
 
-type AiInput struct {
-	dir, dirt, at, bt, ct, xt, yt, zt, st, dt, wt, mt int32
+// Reads the inputs of the next frame
+func (fi *FileInput) readFrame() bool {
+	for len(fi.frames) == 0 {
+		tag, data, err := fi.readChunk()
+		if err != nil {
+			return false
+		}
+		if tag == rcKeyframe {
+			fi.addKeyframe(data)
+			continue
+		}
+		if tag == rcSyncState {
+			fi.checkSyncState(data)
+			continue
+		}
+		// Offline recordings write the checksum after the last frame of the
+		// round, which the frame read ahead here comes after
+		if tag == rcChecksum && fi.roundSum == nil {
+			fi.roundSum = data
+			continue
+		}
+		if tag != rcInput {
+			sys.errLog.Println("Replay desynchronized: recorded " + tag +
+				" chunk reached during playback")
+			return false
+		}
+		var count int32
+		r := bytes.NewReader(data)
+		if binary.Read(r, binary.LittleEndian, &count) != nil ||
+			binary.Read(r, binary.LittleEndian, &fi.width) != nil || fi.width <= 0 {
+			return false
+		}
+		fi.frames = make([]InputBits, count*fi.width)
+		if binary.Read(r, binary.LittleEndian, fi.frames) != nil {
+			return false
+		}
+	}
+	fi.ib = [len(fi.ib)]InputBits{}
+	copy(fi.ib[:], fi.frames[:fi.width])
+	fi.frames = fi.frames[fi.width:]
+	fi.frame++
+	if fi.seekFrame >= 0 && fi.position() >= fi.seekFrame {
+		fi.seekFrame = -1
+		sys.paused = fi.seekPause
+	}
+	return true
+}
+
+// Index of the frame whose inputs are loaded
+func (fi *FileInput) position() int32 {
+	return fi.frame - 1
+}
+
+func (fi *FileInput) seeking() bool {
+	return fi.seekFrame >= 0 || fi.rewind != nil || fi.live != nil && fi.live.catchingUp()
+}
+
+// Whether the current match is a fight of a replay file, which has an index
+// to seek in
+func (fi *FileInput) fight() bool {
+	return fi.match >= 0 && fi.match < len(fi.index) && fi.index[fi.match].fight
 }
 
-// AI button jamming
-func (ai *AiInput) Update(level float32) {
-	// Not during intros and win poses
-	if sys.intro != 0 {
-		ai.dirt, ai.at, ai.bt, ai.ct = 0, 0, 0, 0
-		ai.xt, ai.yt, ai.zt, ai.st = 0, 0, 0, 0
-		ai.dt, ai.wt, ai.mt = 0, 0, 0
+// Snapshots the match at a keyframe the first time playback reaches it
+func (fi *FileInput) addKeyframe(data []byte) {
+	if !fi.fight() || len(data) < 4 {
 		return
 	}
-	var chance, time int32 = 15, 60
-	jam := func(t *int32) bool {
-		(*t)--
-		if *t <= 0 {
-			// TODO: Balance AI Scaling
-			if Rand(1, chance) == 1 {
-				*t = Rand(1, time)
-				return true
+	frame := int32(binary.LittleEndian.Uint32(data))
+	if frame != fi.frame {
+		return
+	}
+	for _, kf := range fi.keyframes {
+		if kf.frame == frame {
+			return
+		}
+	}
+	offset, err := fi.f.(io.Seeker).Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	kf := replayKeyframe{frame: frame, offset: offset, state: &GameState{}}
+	kf.state.save()
+	fi.keyframes = append(fi.keyframes, kf)
+}
+
+// Restores the match to a keyframe and reads the inputs that follow it
+func (fi *FileInput) loadKeyframe(kf *replayKeyframe) bool {
+	if _, err := fi.f.(io.Seeker).Seek(kf.offset, io.SeekStart); err != nil {
+		return false
+	}
+	kf.state.load()
+	fi.frames, fi.peekTag, fi.peekData, fi.roundSum = nil, "", nil, nil
+	fi.frame = kf.frame
+	return fi.readFrame()
+}
+
+// Moves playback of the current fight to the given frame. Earlier frames are
+// reached by going back to the last keyframe before them and playing forward
+// from there, later ones by playing forward without rendering. Keyframes are
+// only snapshotted once playback reaches them, so a seek forward takes as
+// long as playing the skipped frames does.
+func (fi *FileInput) seek(frame int32) bool {
+	if fi.f == nil || !fi.fight() {
+		return false
+	}
+	frame = Clamp(frame, 1, fi.index[fi.match].frames-1)
+	var kf *replayKeyframe
+	if frame < fi.position() {
+		for i := range fi.keyframes {
+			if fi.keyframes[i].frame <= frame &&
+				(kf == nil || fi.keyframes[i].frame > kf.frame) {
+				kf = &fi.keyframes[i]
 			}
-			*t = 0
 		}
+		if kf == nil {
+			return false
+		}
+	} else if frame == fi.position() {
+		return true
+	}
+	if !fi.seeking() {
+		fi.seekPause = sys.paused
+	}
+	fi.rewind, fi.seekFrame = kf, frame
+	if kf != nil && kf.frame == frame {
+		fi.seekFrame = -1
+		sys.paused = fi.seekPause
+	} else {
+		// The frames up to the target are played even if paused
+		sys.paused = false
+	}
+	return true
+}
+
+// Moves playback to the start of a round of the current fight
+func (fi *FileInput) seekRound(round int32) bool {
+	if !fi.fight() {
+		return false
+	}
+	rounds := fi.index[fi.match].rounds
+	if round < 1 || int(round) > len(rounds)+1 {
+		return false
+	}
+	if round == 1 {
+		return fi.seek(1)
+	}
+	return fi.seek(rounds[round-2])
+}
+
+// Compares the state recorded before the next frame with the one played back
+func (fi *FileInput) checkSyncState(data []byte) {
+	rec, err := decodeSyncState(data)
+	if err != nil || fi.desync >= 0 {
+		return
+	}
+	if cur := newSyncState(); cur.hash() != rec.hash() {
+		fi.desync = fi.frame
+		sys.errLog.Printf("Replay desynchronized at frame %v (recorded / played back):\n%v",
+			fi.frame, strings.Join(rec.diff(cur), "\n"))
+	}
+}
+
+// Compares the checksum recorded at the end of the round, if there is one
+func (fi *FileInput) checkRound() error {
+	if fi.f == nil {
+		return nil
+	}
+	data := fi.roundSum
+	if fi.roundSum = nil; data == nil {
+		if len(fi.frames) > 0 {
+			return nil
+		}
+		var tag string
+		var err error
+		tag, data, err = fi.peekChunk()
+		// The state before the next frame is stored after the frame, so it
+		// can come first
+		for err == nil && tag == rcSyncState {
+			fi.readChunk()
+			fi.checkSyncState(data)
+			tag, data, err = fi.peekChunk()
+		}
+		if err != nil || tag != rcChecksum {
+			return nil
+		}
+		fi.readChunk()
+	}
+	var round int32
+	var sum uint32
+	r := bytes.NewReader(data)
+	binary.Read(r, binary.LittleEndian, &round)
+	binary.Read(r, binary.LittleEndian, &sum)
+	if round != sys.round || sum != roundChecksum() {
+		return Error(fmt.Sprintf("Replay desynchronized in round %v", round))
+	}
+	return nil
+}
+
+// Draws the progress of the fight at the bottom of the screen, with a mark
+// at the end of each round
+func (fi *FileInput) drawTimeline() {
+	if !fi.timeline || fi.f == nil || !fi.fight() || sys.debugFont == nil {
+		return
+	}
+	mi := &fi.index[fi.match]
+	w, h := sys.scrrect[2], sys.scrrect[3]
+	bar := [4]int32{w / 20, h - h/16, w - w/10, Max(2, h/120)}
+	FillRect(bar, 0x404040, 192)
+	pos := ClampF(float32(fi.position())/float32(Max(1, mi.frames-1)), 0, 1)
+	FillRect([4]int32{bar[0], bar[1], int32(float32(bar[2]) * pos), bar[3]}, 0xffffff, 255)
+	for _, r := range mi.rounds {
+		x := bar[0] + int32(float32(bar[2])*float32(r)/float32(Max(1, mi.frames-1)))
+		FillRect([4]int32{x - 1, bar[1] - bar[3], 2, bar[3] * 3}, 0xffc000, 255)
+	}
+	txt := fmt.Sprintf("%v:%02v / %v:%02v  Round %v  x%v",
+		fi.position()/int32(FPS)/60, fi.position()/int32(FPS)%60,
+		mi.frames/int32(FPS)/60, mi.frames/int32(FPS)%60, sys.round, sys.accel)
+	if sys.paused {
+		txt += "  Paused"
+	}
+	x := (320-float32(sys.gameWidth))/2 + float32(bar[0])/sys.widthScale
+	y := 240 - float32(sys.gameHeight) + float32(bar[1])/sys.heightScale - 2
+	sys.debugFont.SetColor(255, 255, 255)
+	sys.debugFont.fnt.Print(txt, x, y, sys.debugFont.xscl/sys.widthScale,
+		sys.debugFont.yscl/sys.heightScale, 0, 1, &sys.scrrect,
+		sys.debugFont.palfx, sys.debugFont.frgba)
+}
+
+// Number of input recording slots of training mode
+const TrainingSlots = 5
+
+// Longest input recording, in frames
+const trainingMaxFrames = 3600
+
+type TrainingPlayback int32
+
+const (
+	TP_Once   TrainingPlayback = iota // Play the slot once
+	TP_Loop                           // Play the slot over and over
+	TP_Random                         // Play a random recorded slot each time
+)
+
+// Training mode input recording. The inputs of a player are recorded into a
+// slot, then played back by the dummy. Recordings are stored as if the player
+// faced right, and flipped when played back by a player facing left, so that
+// back and forward stay the same.
+type TrainingInput struct {
+	slots      [TrainingSlots][]InputBits
+	recPlayer  int // Player being recorded, or -1
+	recSlot    int
+	playPlayer int // Player playing recordings back, or -1
+	playMode   TrainingPlayback
+	playSlot   int // Slot chosen to play back
+	cur        int // Slot being played back
+	frame      int
+	seed       int32 // TP_Random draws, seeded from the match RNG
+}
+
+func (ti *TrainingInput) Record(pn, slot int) {
+	ti.Stop()
+	ti.recPlayer, ti.recSlot = pn, slot
+	ti.slots[slot] = nil
+}
+
+// Starts playing slot back as player pn. The slot is ignored by TP_Random.
+// Returns false if there is nothing recorded to play.
+func (ti *TrainingInput) Play(pn, slot int, mode TrainingPlayback) bool {
+	ti.Stop()
+	ti.playPlayer, ti.playSlot, ti.playMode = pn, slot, mode
+	// Taken without advancing the match RNG, which replays of training
+	// sessions would not advance the same way, as they play the recorded
+	// inputs back without the recordings
+	ti.seed = sys.randseed
+	if ti.cur = ti.pick(); ti.cur < 0 {
+		ti.playPlayer = -1
+		return false
+	}
+	ti.frame = 0
+	return true
+}
+
+func (ti *TrainingInput) Stop() {
+	ti.recPlayer, ti.playPlayer = -1, -1
+}
+
+func (ti *TrainingInput) Recording() bool {
+	return ti.recPlayer >= 0
+}
+
+func (ti *TrainingInput) Playing() bool {
+	return ti.playPlayer >= 0
+}
+
+// Returns the slot to play next, or -1 if none is recorded
+func (ti *TrainingInput) pick() int {
+	if ti.playMode != TP_Random {
+		if len(ti.slots[ti.playSlot]) == 0 {
+			return -1
+		}
+		return ti.playSlot
+	}
+	var recorded []int
+	for i, s := range ti.slots {
+		if len(s) > 0 {
+			recorded = append(recorded, i)
+		}
+	}
+	if len(recorded) == 0 {
+		return -1
+	}
+	return recorded[nextRandom(&ti.seed)/(IMax/int32(len(recorded))+1)]
+}
+
+// Feeds the recording being played back to player i
+func (ti *TrainingInput) Input(cb *CommandBuffer, i int, facing int32) bool {
+	if i < 0 {
+		i = ^i
+	}
+	if ti.playPlayer < 0 || i != ti.playPlayer {
 		return false
 	}
-	// Pick a random direction to press
-	if jam(&ai.dirt) {
-		ai.dir = Rand(0, 7)
-	}
-	chance, time = int32((-11.25*level+165)*7), 30
-	jam(&ai.at)
-	jam(&ai.bt)
-	jam(&ai.ct)
-	jam(&ai.xt)
-	jam(&ai.yt)
-	jam(&ai.zt)
-	jam(&ai.dt)
-	jam(&ai.wt)
-	chance = 3600 // Start is jammed less often
-	jam(&ai.st)
-	//jam(&ai.mt) // We really don't need the AI to jam the menu button
-}
-
-// 0 = U, 1 = UR, 2 = R, 3 = DR, 4 = D, 5 = DL, 6 = L, 7 = UL
-func (ai *AiInput) U() bool { return ai.dirt != 0 && (ai.dir == 7 || ai.dir == 0 || ai.dir == 1) }
-func (ai *AiInput) D() bool { return ai.dirt != 0 && (ai.dir == 3 || ai.dir == 4 || ai.dir == 5) }
-func (ai *AiInput) L() bool { return ai.dirt != 0 && (ai.dir == 5 || ai.dir == 6 || ai.dir == 7) }
-func (ai *AiInput) R() bool { return ai.dirt != 0 && (ai.dir == 1 || ai.dir == 2 || ai.dir == 3) }
-func (ai *AiInput) a() bool { return ai.at != 0 }
-func (ai *AiInput) b() bool { return ai.bt != 0 }
-func (ai *AiInput) c() bool { return ai.ct != 0 }
-func (ai *AiInput) x() bool { return ai.xt != 0 }
-func (ai *AiInput) y() bool { return ai.yt != 0 }
-func (ai *AiInput) z() bool { return ai.zt != 0 }
-func (ai *AiInput) s() bool { return ai.st != 0 }
-func (ai *AiInput) d() bool { return ai.dt != 0 }
-func (ai *AiInput) w() bool { return ai.wt != 0 }
-func (ai *AiInput) m() bool { return ai.mt != 0 }
+	ib := ti.slots[ti.cur][ti.frame]
+	if facing < 0 {
+		ib = ib&^(IB_PL|IB_PR) | (ib&IB_PL)<<1 | (ib&IB_PR)>>1
+	}
+	ib.BitsToKeys(cb, facing, sys.matchInputSettings[i].SOCDResolution)
+	return true
+}
+
+// Records the inputs of the frame and moves playback on to the next one
+func (ti *TrainingInput) update() {
+	if ti.recPlayer >= 0 && ti.recPlayer < len(sys.chars) &&
+		len(sys.chars[ti.recPlayer]) > 0 {
+		if cb := sys.chars[ti.recPlayer][0].cmd[0].Buffer; cb != nil &&
+			len(ti.slots[ti.recSlot]) < trainingMaxFrames {
+			ti.slots[ti.recSlot] = append(ti.slots[ti.recSlot], cb.bits(1))
+		}
+	}
+	if ti.playPlayer >= 0 {
+		if ti.frame++; ti.frame >= len(ti.slots[ti.cur]) {
+			ti.frame = 0
+			if ti.playMode == TP_Once {
+				ti.playPlayer = -1
+			} else {
+				ti.cur = ti.pick()
+			}
+		}
+	}
+}
+
+// Number of inputs listed by the input history display
+const inputHistoryLen = 16
+
+type inputHistoryEntry struct {
+	ib   InputBits // IB_PL and IB_PR stand for back and forward
+	socd InputBits // Directions before SOCD resolution, if they differ
+	time int32     // Frames held
+}
+
+// On-screen list of the latest inputs each player has registered, as the
+// commands see them: after SOCD resolution and button assist
+type InputHistory struct {
+	enabled bool
+	players [MaxSimul * 2][]inputHistoryEntry // Newest first
+}
+
+func (ih *InputHistory) Toggle() {
+	ih.enabled = !ih.enabled
+	ih.players = [len(ih.players)][]inputHistoryEntry{}
+}
+
+// Adds the inputs of the frame. A new entry starts whenever any direction or
+// button changes, which also resets its CommandBuffer timer, so the current
+// entry has been held for as long as the smallest timer.
+func (ih *InputHistory) update() {
+	if !ih.enabled {
+		return
+	}
+	for i := range ih.players {
+		if i >= len(sys.chars) || len(sys.chars[i]) == 0 || sys.chars[i][0].cmd == nil {
+			ih.players[i] = nil
+			continue
+		}
+		cb := sys.chars[i][0].cmd[0].Buffer
+		if cb == nil {
+			continue
+		}
+		var ib InputBits
+		ib.KeysToBits(cb.U > 0, cb.D > 0, cb.B > 0, cb.F > 0, cb.a > 0, cb.b > 0,
+			cb.c > 0, cb.x > 0, cb.y > 0, cb.z > 0, cb.s > 0, cb.d > 0, cb.w > 0, cb.m > 0)
+		var socd InputBits
+		if sys.netInput == nil && sys.fileInput == nil && cb.InputReader != nil {
+			in := cb.InputReader.SocdInput
+			socd.KeysToBits(in[0], in[1], in[2], in[3],
+				false, false, false, false, false, false, false, false, false, false)
+			if socd == ib&(IB_PU|IB_PD|IB_PL|IB_PR) {
+				socd = 0
+			}
+		}
+		held := IMax
+		for _, t := range [...]int32{cb.Bb, cb.Db, cb.Fb, cb.Ub, cb.Lb, cb.Rb,
+			cb.ab, cb.bb, cb.cb, cb.xb, cb.yb, cb.zb, cb.sb, cb.db, cb.wb, cb.mb} {
+			held = Min(held, Abs(t))
+		}
+		h := ih.players[i]
+		if len(h) == 0 || h[0].ib != ib || h[0].socd != socd {
+			if len(h) >= inputHistoryLen {
+				h = h[:inputHistoryLen-1]
+			}
+			h = append([]inputHistoryEntry{{ib: ib, socd: socd}}, h...)
+		}
+		h[0].time = held
+		ih.players[i] = h
+	}
+}
+
+// Numpad notation of the directions in ib, as seen by a player facing right
+func inputHistoryDir(ib InputBits) string {
+	n := 5
+	if ib&IB_PU != 0 {
+		n += 3
+	} else if ib&IB_PD != 0 {
+		n -= 3
+	}
+	if ib&IB_PL != 0 {
+		n--
+	} else if ib&IB_PR != 0 {
+		n++
+	}
+	return strconv.Itoa(n)
+}
+
+func (e *inputHistoryEntry) String() string {
+	txt := fmt.Sprintf("%3v %v", Min(e.time, 999), inputHistoryDir(e.ib))
+	for i, b := range "abcxyzsdwm" {
+		if e.ib&(IB_A<<uint(i)) != 0 {
+			txt += string(b)
+		}
+	}
+	if e.socd != 0 {
+		// Every direction held, before SOCD resolution picked among them
+		txt += " ("
+		for i, d := range "UDBF" {
+			if e.socd&(IB_PU<<uint(i)) != 0 {
+				txt += string(d)
+			}
+		}
+		txt += ")"
+	}
+	return txt
+}
+
+// Lists the inputs of team 1 on the left of the screen and team 2 on the
+// right, below the lifebars
+func (ih *InputHistory) draw() {
+	if !ih.enabled || sys.debugFont == nil {
+		return
+	}
+	xscl, yscl := sys.debugFont.xscl/sys.widthScale, sys.debugFont.yscl/sys.heightScale
+	lh := float32(sys.debugFont.fnt.Size[1]) * yscl
+	left := (320-float32(sys.gameWidth))/2 + 2
+	top := 240 - float32(sys.gameHeight) + 48
+	sys.debugFont.SetColor(255, 255, 255)
+	for i, h := range ih.players {
+		// Teammates get a column each, further from the edge of the screen
+		x, align := left+float32(i/2)*80, int32(1)
+		if i&1 != 0 {
+			x, align = left+float32(sys.gameWidth)-4-float32(i/2)*80, -1
+		}
+		for j := range h {
+			sys.debugFont.fnt.Print(h[j].String(), x, top+float32(j)*lh, xscl, yscl,
+				0, align, &sys.scrrect, sys.debugFont.palfx, sys.debugFont.frgba)
+		}
+	}
+}
 
 // cmdElem refers to each of the inputs required to complete a command
 type cmdElem struct {
@@ -1960,6 +3259,7 @@ type CommandList struct {
 	Commands          [][]Command
 	DefaultTime       int32
 	DefaultBufferTime int32
+	SimpleSpecials    *SimpleSpecials
 }
 
 func NewCommandList(cb *CommandBuffer) *CommandList {
@@ -1974,15 +3274,25 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 	}
 	step := cl.Buffer.Bb != 0
 	if i < 0 && ^i < len(sys.aiInput) {
-		sys.aiInput[^i].Update(aiLevel) // 乱数を使うので同期がずれないようここで / Here we use random numbers so we can not get out of sync
+		sys.aiInput[^i].Update(^i, aiLevel) // 乱数を使うので同期がずれないようここで / Here we use random numbers so we can not get out of sync
 	}
 	_else := i < 0
-	if _else {
+	if sys.fileInput != nil && sys.fileInput.local {
+		// Offline replays hold the inputs of AI players as well
+		sys.fileInput.Input(cl.Buffer, i, facing)
+		_else = false
+	} else if sys.netInput == nil && sys.fileInput == nil &&
+		sys.trainingInput.Input(cl.Buffer, i, facing) {
+		// Playing back a training mode recording, AI players included
+		_else = false
+	} else if _else {
 		// Do nothing
 	} else if sys.fileInput != nil {
 		sys.fileInput.Input(cl.Buffer, i, facing)
 	} else if sys.netInput != nil {
 		sys.netInput.Input(cl.Buffer, i, facing)
+	} else if sys.botInput != nil && sys.botInput.Input(cl.Buffer, i, facing) {
+		// Played by an external process
 	} else {
 		_else = true
 	}
@@ -1991,20 +3301,21 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 		if i < 0 {
 			i = ^i
 			if i < len(sys.aiInput) {
-				U = sys.aiInput[i].U() || ib&IB_PU != 0
-				D = sys.aiInput[i].D() || ib&IB_PD != 0
-				L = sys.aiInput[i].L() || ib&IB_PL != 0
-				R = sys.aiInput[i].R() || ib&IB_PR != 0
-				a = sys.aiInput[i].a() || ib&IB_A != 0
-				b = sys.aiInput[i].b() || ib&IB_B != 0
-				c = sys.aiInput[i].c() || ib&IB_C != 0
-				x = sys.aiInput[i].x() || ib&IB_X != 0
-				y = sys.aiInput[i].y() || ib&IB_Y != 0
-				z = sys.aiInput[i].z() || ib&IB_Z != 0
-				s = sys.aiInput[i].s() || ib&IB_S != 0
-				d = sys.aiInput[i].d() || ib&IB_D != 0
-				w = sys.aiInput[i].w() || ib&IB_W != 0
-				m = sys.aiInput[i].m() || ib&IB_M != 0
+				ai := sys.aiInput[i].ib | ib
+				U = ai&IB_PU != 0
+				D = ai&IB_PD != 0
+				L = ai&IB_PL != 0
+				R = ai&IB_PR != 0
+				a = ai&IB_A != 0
+				b = ai&IB_B != 0
+				c = ai&IB_C != 0
+				x = ai&IB_X != 0
+				y = ai&IB_Y != 0
+				z = ai&IB_Z != 0
+				s = ai&IB_S != 0
+				d = ai&IB_D != 0
+				w = ai&IB_W != 0
+				m = ai&IB_M != 0
 			}
 		} else if i < len(sys.inputRemap) {
 			U, D, L, R, a, b, c, x, y, z, s, d, w, m = cl.Buffer.InputReader.LocalInput(sys.inputRemap[i])
@@ -2016,7 +3327,8 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 			B, F = L, R
 		}
 		// Resolve SOCD conflicts
-		U, D, B, F = cl.Buffer.InputReader.SocdResolution(U, D, B, F)
+		U, D, B, F = cl.Buffer.InputReader.SocdResolution(U, D, B, F,
+			sys.matchInputSettings[i].SOCDResolution)
 
 		// Resolve L/R SOCD conflicts based on the final B/F resolution
 		if L && R {
@@ -2090,15 +3402,19 @@ func (cl *CommandList) Step(facing int32, ai, hitpause bool, buftime int32) {
 				cl.Commands[i][j].Step(cl.Buffer, ai, hitpause, buftime)
 			}
 		}
-		// Find completed commands and reset all duplicate instances
-		// This loop must be run separately from the previous one
-		// TODO: This could be controlled by a command parameter that decides if its buffer should be shared with other commands of same name
-		for i := range cl.Commands {
-			for j := range cl.Commands[i] {
-				if cl.Commands[i][j].completeflag {
-					cl.ClearName(cl.Commands[i][j].name)
-					cl.Commands[i][j].completeflag = false
-				}
+		cl.clearCompleted()
+	}
+}
+
+// Find completed commands and reset all duplicate instances
+// This must be run separately from the loop that steps the commands
+// TODO: This could be controlled by a command parameter that decides if its buffer should be shared with other commands of same name
+func (cl *CommandList) clearCompleted() {
+	for i := range cl.Commands {
+		for j := range cl.Commands[i] {
+			if cl.Commands[i][j].completeflag {
+				cl.ClearName(cl.Commands[i][j].name)
+				cl.Commands[i][j].completeflag = false
 			}
 		}
 	}
@@ -2126,6 +3442,207 @@ func (cl *CommandList) Add(c Command) {
 	cl.Names[c.name] = i
 }
 
+// SimpleSpecials lets players who turn on the mode in their input settings
+// do special moves with one button and a direction. It is read from the
+// [SimpleSpecials] section of a command file, where button is the button
+// to use (d if left out) and each of n, f, b, u, d, uf, ub, df and db gives
+// the name of the command the button does while that direction is held, n
+// being neutral:
+//
+//	[SimpleSpecials]
+//	button = d
+//	n  = "QCF_x"
+//	b  = "QCB_x"
+//	df = "DP_x"
+//
+// Directions without a command of their own use the neutral one. The
+// motions of the commands keep working as usual.
+type SimpleSpecials struct {
+	button CommandKey
+	names  map[string]string
+}
+
+var simpleSpecialsDirs = [...]string{"n", "f", "b", "u", "d", "uf", "ub", "df", "db"}
+
+func (cl *CommandList) readSimpleSpecials(is IniSection, ckr *CommandKeyRemap,
+	filename string) error {
+	ss := &SimpleSpecials{button: ckr.d, names: make(map[string]string)}
+	if btn, ok := is["button"]; ok {
+		switch strings.ToLower(btn) {
+		case "a":
+			ss.button = ckr.a
+		case "b":
+			ss.button = ckr.b
+		case "c":
+			ss.button = ckr.c
+		case "x":
+			ss.button = ckr.x
+		case "y":
+			ss.button = ckr.y
+		case "z":
+			ss.button = ckr.z
+		case "s":
+			ss.button = ckr.s
+		case "d":
+			ss.button = ckr.d
+		case "w":
+			ss.button = ckr.w
+		case "m":
+			ss.button = ckr.m
+		default:
+			return Error(filename + ":\n[SimpleSpecials]\nbutton = " + btn +
+				"\nInvalid button")
+		}
+	}
+	for _, dir := range simpleSpecialsDirs {
+		// Quotes are optional
+		name, ok, _ := is.getText(dir)
+		if !ok || name == "" {
+			continue
+		}
+		if _, ok := cl.Names[name]; !ok {
+			return Error(filename + ":\n[SimpleSpecials]\n" + dir + " = " + name +
+				"\nCommand not found")
+		}
+		ss.names[dir] = name
+	}
+	cl.SimpleSpecials = ss
+	return nil
+}
+
+// Asserts the command of the direction held if the simple specials button
+// was just pressed
+func (cl *CommandList) StepSimpleSpecials() {
+	ss := cl.SimpleSpecials
+	if ss == nil || cl.Buffer == nil || cl.Buffer.State(ss.button) != 1 {
+		return
+	}
+	var dir string
+	if cl.Buffer.Ub > 0 {
+		dir = "u"
+	} else if cl.Buffer.Db > 0 {
+		dir = "d"
+	}
+	if cl.Buffer.Fb > 0 {
+		dir += "f"
+	} else if cl.Buffer.Bb > 0 {
+		dir += "b"
+	}
+	name, ok := ss.names[dir]
+	if !ok {
+		if name, ok = ss.names["n"]; !ok {
+			return
+		}
+	}
+	if i, ok := cl.Names[name]; ok && i < len(cl.Commands) {
+		for j := range cl.Commands[i] {
+			c := &cl.Commands[i][j]
+			c.curbuftime = Max(c.curbuftime, c.buftime)
+		}
+	}
+}
+
+// Reads the remap, defaults, simple specials and command sections of the
+// text of a command file. check, if not nil, is called with each command and its definition
+// before it is added.
+func (cl *CommandList) ReadCommands(str, filename string, check func(cm *Command, cmdstr string)) error {
+	lines, i := SplitAndTrim(str, "\n"), 0
+	remap, defaults, ckr := true, true, NewCommandKeyRemap()
+	var cmds []IniSection
+	var simple IniSection
+	for i < len(lines) {
+		// Read ini sections of command file
+		is, name, _ := ReadIniSection(lines, &i)
+		switch name {
+		case "remap":
+			// Read controller remap
+			if remap {
+				remap = false
+				rm := func(name string, k, nk *CommandKey) {
+					switch strings.ToLower(is[name]) {
+					case "x":
+						*k, *nk = CK_x, CK_rx
+					case "y":
+						*k, *nk = CK_y, CK_ry
+					case "z":
+						*k, *nk = CK_z, CK_rz
+					case "a":
+						*k, *nk = CK_a, CK_ra
+					case "b":
+						*k, *nk = CK_b, CK_rb
+					case "c":
+						*k, *nk = CK_c, CK_rc
+					case "s":
+						*k, *nk = CK_s, CK_rs
+					case "d":
+						*k, *nk = CK_d, CK_rd
+					case "w":
+						*k, *nk = CK_w, CK_rw
+					case "m":
+						*k, *nk = CK_m, CK_rm
+					}
+				}
+				rm("x", &ckr.x, &ckr.nx)
+				rm("y", &ckr.y, &ckr.ny)
+				rm("z", &ckr.z, &ckr.nz)
+				rm("a", &ckr.a, &ckr.na)
+				rm("b", &ckr.b, &ckr.nb)
+				rm("c", &ckr.c, &ckr.nc)
+				rm("s", &ckr.s, &ckr.ns)
+				rm("d", &ckr.d, &ckr.nd)
+				rm("w", &ckr.w, &ckr.nw)
+				rm("m", &ckr.m, &ckr.nm)
+			}
+		case "defaults":
+			// Read default command time and buffer time
+			if defaults {
+				defaults = false
+				is.ReadI32("command.time", &cl.DefaultTime)
+				var i32 int32
+				if is.ReadI32("command.buffer.time", &i32) {
+					cl.DefaultBufferTime = Max(1, i32)
+				}
+			}
+		case "simplespecials":
+			if simple == nil {
+				simple = is
+			}
+		default:
+			// Read input commands
+			if len(name) >= 7 && name[:7] == "command" {
+				cmds = append(cmds, is)
+			}
+		}
+	}
+	// Parse input commands
+	for _, is := range cmds {
+		name, _, err := is.getText("name")
+		if err != nil {
+			return Error(fmt.Sprintf("%v:\nname: %v\n%v",
+				filename, name, err.Error()))
+		}
+		cm, err := ReadCommand(name, is["command"], ckr)
+		if err != nil {
+			return Error(filename + ":\nname = " + is["name"] +
+				"\ncommand = " + is["command"] + "\n" + err.Error())
+		}
+		cm.time, cm.buftime = cl.DefaultTime, cl.DefaultBufferTime
+		is.ReadI32("time", &cm.time)
+		var i32 int32
+		if is.ReadI32("buffer.time", &i32) {
+			cm.buftime = Max(1, i32)
+		}
+		if check != nil {
+			check(cm, is["command"])
+		}
+		cl.Add(*cm)
+	}
+	if simple != nil {
+		return cl.readSimpleSpecials(simple, ckr, filename)
+	}
+	return nil
+}
+
 // Used for command trigger
 func (cl *CommandList) At(i int) []Command {
 	if i < 0 || i >= len(cl.Commands) {
@@ -2157,6 +3674,7 @@ func (cl *CommandList) GetState(name string) bool {
 // For cases where one player's inputs are compared to another's commands
 func (cl *CommandList) CopyList(src CommandList) {
 	cl.Names = src.Names
+	cl.SimpleSpecials = src.SimpleSpecials
 	cl.Commands = make([][]Command, len(src.Commands))
 	for i, ca := range src.Commands {
 		cl.Commands[i] = make([]Command, len(ca))
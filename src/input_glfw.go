@@ -1,4 +1,4 @@
-//go:build !kinc
+//go:build !kinc && !headless
 
 package main
 
@@ -202,6 +202,13 @@ func (input *Input) GetJoystickName(joy int) string {
 	return input.joystick[joy].GetGamepadName()
 }
 
+func (input *Input) GetJoystickGUID(joy int) string {
+	if joy < 0 || joy >= len(input.joystick) {
+		return ""
+	}
+	return input.joystick[joy].GetGUID()
+}
+
 func (input *Input) GetJoystickAxes(joy int) []float32 {
 	if joy < 0 || joy >= len(input.joystick) {
 		return []float32{}
@@ -215,3 +222,7 @@ func (input *Input) GetJoystickButtons(joy int) []glfw.Action {
 	}
 	return input.joystick[joy].GetButtons()
 }
+
+func joystickCallback(joy glfw.Joystick, event glfw.PeripheralEvent) {
+	OnJoystickConnected(int(joy), event == glfw.Connected)
+}
@@ -1,4 +1,4 @@
-//go:build kinc
+//go:build kinc && !headless
 
 package main
 
@@ -40,6 +40,10 @@ type Joystick struct {
 
 type Input struct {
 	joysticks [MAX_JOYSTICK_COUNT]Joystick
+	// Gamepads present when last polled. Kinc has no callback for gamepads
+	// being plugged in or unplugged, so they are polled after every frame.
+	connected [MAX_JOYSTICK_COUNT]bool
+	polled    bool
 }
 
 type Key C.int
@@ -247,6 +251,21 @@ func newInput() *Input {
 	return &Input{}
 }
 
+// Reports the gamepads plugged in or unplugged since the last call, except
+// on the first one, which finds the gamepads present at startup
+func (input *Input) pollConnections() {
+	for joy := range input.connected {
+		connected := input.IsJoystickPresent(joy)
+		if connected != input.connected[joy] {
+			input.connected[joy] = connected
+			if input.polled {
+				OnJoystickConnected(joy, connected)
+			}
+		}
+	}
+	input.polled = true
+}
+
 func (input *Input) GetMaxJoystickCount() int {
 	return MAX_JOYSTICK_COUNT
 }
@@ -259,6 +278,11 @@ func (input *Input) GetJoystickName(joy int) string {
 	return C.GoString(C.kinc_gamepad_product_name(C.int(joy)))
 }
 
+// Kinc has no GUIDs, so devices are told apart by name
+func (input *Input) GetJoystickGUID(joy int) string {
+	return ""
+}
+
 func (input *Input) GetJoystickAxes(joy int) []float32 {
 	if joy >= 0 && joy < MAX_JOYSTICK_COUNT {
 		return input.joysticks[joy].axes[:]
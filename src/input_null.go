@@ -0,0 +1,93 @@
+//go:build headless
+
+package main
+
+// Input backend of headless builds, which has no keyboard or joysticks.
+// Key names are still known so that configs and hotkeys can be parsed.
+
+type Input struct{}
+
+type Key int
+type ModifierKey int
+
+const (
+	KeyUnknown Key = iota - 1
+	KeyEscape
+	KeyEnter
+	KeyInsert
+	KeyF12
+)
+
+const (
+	modControl ModifierKey = 1 << iota
+	modAlt
+	modShift
+)
+
+var KeyToStringLUT = map[Key]string{
+	KeyEnter:  "RETURN",
+	KeyEscape: "ESCAPE",
+	KeyInsert: "INSERT",
+	KeyF12:    "F12",
+}
+
+var StringToKeyLUT = map[string]Key{}
+
+func init() {
+	for k, v := range KeyToStringLUT {
+		StringToKeyLUT[v] = k
+	}
+}
+
+func StringToKey(s string) Key {
+	if key, ok := StringToKeyLUT[s]; ok {
+		return key
+	}
+	return KeyUnknown
+}
+
+func KeyToString(k Key) string {
+	if s, ok := KeyToStringLUT[k]; ok {
+		return s
+	}
+	return ""
+}
+
+func NewModifierKey(ctrl, alt, shift bool) (mod ModifierKey) {
+	if ctrl {
+		mod |= modControl
+	}
+	if alt {
+		mod |= modAlt
+	}
+	if shift {
+		mod |= modShift
+	}
+	return
+}
+
+var input = Input{}
+
+func (input *Input) GetMaxJoystickCount() int {
+	return 0
+}
+
+func (input *Input) IsJoystickPresent(joy int) bool {
+	return false
+}
+
+func (input *Input) GetJoystickName(joy int) string {
+	return ""
+}
+
+func (input *Input) GetJoystickGUID(joy int) string {
+	return ""
+}
+
+func (input *Input) GetJoystickAxes(joy int) []float32 {
+	return []float32{}
+}
+
+func (input *Input) GetJoystickButtons(joy int) []int32 {
+	return []int32{}
+}
@@ -4071,4 +4071,20 @@ func (l *Lifebar) draw(layerno int16) {
 			v.Draw()
 		}
 	}
+	// Replay timeline
+	if layerno == 2 && sys.fileInput != nil {
+		sys.fileInput.drawTimeline()
+	}
+	// Input history
+	if layerno == 2 {
+		sys.inputHistory.draw()
+	}
+	// Frame data of the last attacks in training mode
+	if layerno == 2 {
+		sys.frameData.draw()
+	}
+	// Profiler tables
+	if layerno == 2 && sys.profiler != nil {
+		sys.profiler.draw()
+	}
 }
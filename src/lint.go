@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The linter checks a whole character without starting the game:
+//
+//	ikemen lint [-json] <char.def>
+//
+// It compiles the commands and states of the character the way loading it
+// for a match does, but carries on after an error to report every one of
+// them, and then looks for
+//
+//   - ChangeAnim to actions missing from the .air file
+//   - PlaySnd of sounds missing from the .snd file
+//   - ChangeState, HitDef p1stateno and Helper stateno to undefined states
+//   - states that no state controller goes to
+//   - ZSS functions that are never called
+//   - var, fvar, sysvar and sysfvar indexes out of range
+//
+// Only numbers written as constants can be checked. Problems are printed one
+// per line as file:line: severity: message, or with -json as an array of
+// LintMessage. The exit code is 1 if there is any error.
+
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+type LintMessage struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"` // 0 for the file as a whole
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (lm LintMessage) String() string {
+	if lm.Line == 0 {
+		return fmt.Sprintf("%v: %v: %v", lm.File, lm.Severity, lm.Message)
+	}
+	return fmt.Sprintf("%v:%v: %v: %v", lm.File, lm.Line, lm.Severity, lm.Message)
+}
+
+// Where an animation, sound or state is used, to check it exists once the
+// whole character is read
+type lintRef struct {
+	file string
+	line int
+	no   [2]int32
+}
+
+type Linter struct {
+	def      string
+	messages []LintMessage
+	c        *Compiler
+	file     string // File being compiled
+	line     int    // Line of the state controller being compiled
+	common   bool   // Whether the file is one of the engine's common files
+	reported bool   // Whether the error that stopped a file is already added
+	anims    []lintRef
+	sounds   []lintRef
+	gotos    []lintRef // States that have to exist
+	reached  map[int32]bool
+	defined  map[int32]lintRef
+	funcs    map[string]lintRef
+}
+
+func newLinter(def string) *Linter {
+	return &Linter{def: def, messages: []LintMessage{}, reached: make(map[int32]bool),
+		defined: make(map[int32]lintRef), funcs: make(map[string]lintRef)}
+}
+
+func (l *Linter) add(file string, line int, severity, msg string) {
+	msg = strings.ReplaceAll(strings.TrimSpace(msg), "\n", " ")
+	l.messages = append(l.messages, LintMessage{file, line, severity, msg})
+}
+
+func (l *Linter) warn(r lintRef, format string, a ...interface{}) {
+	l.add(r.file, r.line, LintWarning, fmt.Sprintf(format, a...))
+}
+
+// Adds an error that stopped the compiler from reading a file
+func (l *Linter) fileError(err error) {
+	if l.reported {
+		l.reported = false
+		return
+	}
+	l.add(l.def, 0, LintError, err.Error())
+}
+
+// Has the compiler report the state controllers to the linter before
+// compiling them
+func (l *Linter) watch(c *Compiler) {
+	l.c, c.lint = c, l
+	for name, f := range c.scmap {
+		name, f := name, f
+		c.scmap[name] = func(is IniSection, sc *StateControllerBase,
+			ihp int8) (StateController, error) {
+			l.controller(name, is)
+			return f(is, sc, ihp)
+		}
+	}
+}
+
+// Value of an expression if it is a constant
+func (l *Linter) constInt(data string) (int32, bool) {
+	// Without reporting the vars in it twice
+	l.c.lint = nil
+	defer func() { l.c.lint = l }()
+	var be BytecodeExp
+	l.c.token = l.c.tokenizer(&data)
+	bv, err := l.c.expBoolOr(&be, &data)
+	if err != nil || bv.IsNone() || l.c.token != "" {
+		return 0, false
+	}
+	return bv.ToI(), true
+}
+
+func (l *Linter) controller(name string, is IniSection) {
+	ref := func(key string) (lintRef, bool) {
+		data, ok := is[key]
+		if !ok {
+			return lintRef{}, false
+		}
+		no, ok := l.constInt(data)
+		return lintRef{l.file, l.line, [2]int32{no}}, ok
+	}
+	// A state number in any parameter may be where the state is entered
+	for _, key := range [...]string{"stateno", "p1stateno", "p2stateno", "partnerstateno"} {
+		if r, ok := ref(key); ok {
+			l.reached[r.no[0]] = true
+		}
+	}
+	switch name {
+	case "changestate", "selfstate", "targetstate":
+		if r, ok := ref("value"); ok {
+			l.reached[r.no[0]] = true
+		}
+	}
+	if l.common {
+		return
+	}
+	switch name {
+	case "changestate":
+		if r, ok := ref("value"); ok {
+			l.gotos = append(l.gotos, r)
+		}
+	case "hitdef", "reversaldef":
+		if r, ok := ref("p1stateno"); ok {
+			l.gotos = append(l.gotos, r)
+		}
+	case "helper":
+		if r, ok := ref("stateno"); ok {
+			l.gotos = append(l.gotos, r)
+		}
+	case "changeanim":
+		if r, ok := ref("value"); ok {
+			l.anims = append(l.anims, r)
+		}
+	case "playsnd":
+		if r, ok := l.soundRef(is["value"]); ok {
+			l.sounds = append(l.sounds, r)
+		}
+	case "varset", "varadd":
+		if r, ok := ref("v"); ok {
+			l.checkVar(false, false, r.no[0])
+		}
+		if r, ok := ref("fv"); ok {
+			l.checkVar(false, true, r.no[0])
+		}
+	}
+}
+
+// Group and number of a sound of the character's own .snd file
+func (l *Linter) soundRef(data string) (lintRef, bool) {
+	data = strings.TrimSpace(data)
+	if data == "" || data[0] == 'f' || data[0] == 'F' {
+		// Missing, or in the common sounds of fight.def
+		return lintRef{}, false
+	}
+	if data[0] == 's' || data[0] == 'S' {
+		data = data[1:]
+	}
+	gn := strings.SplitN(data, ",", 2)
+	if len(gn) != 2 {
+		return lintRef{}, false
+	}
+	g, ok1 := l.constInt(gn[0])
+	n, ok2 := l.constInt(gn[1])
+	return lintRef{l.file, l.line, [2]int32{g, n}}, ok1 && ok2
+}
+
+func (l *Linter) checkVar(sysVar, f bool, i int32) {
+	name, n := "var", NumVar
+	switch [...]bool{sysVar, f} {
+	case [...]bool{false, true}:
+		name, n = "fvar", NumFvar
+	case [...]bool{true, false}:
+		name, n = "sysvar", NumSysVar
+	case [...]bool{true, true}:
+		name, n = "sysfvar", NumSysFvar
+	}
+	if i < 0 || i >= int32(n) {
+		l.add(l.file, l.c.i+1, LintWarning, fmt.Sprintf("%v(%v) is out of range (0 to %v)",
+			name, i, n-1))
+	}
+}
+
+func (l *Linter) statedef(no int32, line int) {
+	if !l.common {
+		if _, ok := l.defined[no]; !ok {
+			l.defined[no] = lintRef{l.file, line, [2]int32{no}}
+		}
+	}
+}
+
+func (l *Linter) function(name string, line int) {
+	if !l.common {
+		l.funcs[name] = lintRef{file: l.file, line: line}
+	}
+}
+
+// The [Files] section of the .def file
+func (l *Linter) files() IniSection {
+	str, err := LoadText(l.def)
+	if err != nil {
+		return NewIniSection()
+	}
+	lines, i := SplitAndTrim(str, "\n"), 0
+	for i < len(lines) {
+		is, name, _ := ReadIniSection(lines, &i)
+		if name == "files" {
+			return is
+		}
+	}
+	return NewIniSection()
+}
+
+// The constants the states are compiled with, as Char.load reads them
+func (l *Linter) constants() map[string]float32 {
+	constants, err := commonConstants(l.def)
+	if err != nil {
+		l.add(l.def, 0, LintError, err.Error())
+		constants = make(map[string]float32)
+	}
+	if cns := l.files()["cns"]; cns != "" {
+		// Errors in the cns file are reported when its states are compiled
+		LoadFile(&cns, []string{l.def, "", sys.motifDir, "data/"}, func(filename string) error {
+			str, err := LoadText(filename)
+			if err != nil {
+				return err
+			}
+			lines, i := SplitAndTrim(str, "\n"), 0
+			for i < len(lines) {
+				is, name, _ := ReadIniSection(lines, &i)
+				if name == "constants" {
+					for key, value := range is {
+						constants[key] = float32(Atof(value))
+					}
+					break
+				}
+			}
+			return nil
+		})
+	}
+	return constants
+}
+
+// Reads the actions of the .air file and the sounds of the .snd file of the
+// character, nil for those it has none of
+func (l *Linter) resources() (actions map[int32]bool, sounds map[[2]int32]bool) {
+	files := l.files()
+	anim, sound := files["anim"], files["sound"]
+	if anim != "" {
+		str := ""
+		if err := LoadFile(&anim, []string{l.def, "", sys.motifDir, "data/"}, func(filename string) error {
+			var err error
+			str, err = LoadText(filename)
+			return err
+		}); err != nil {
+			l.add(l.def, 0, LintError, err.Error())
+		} else {
+			for _, s := range sys.commonAir {
+				LoadFile(&s, []string{l.def, sys.motifDir, sys.lifebar.def, "", "data/"}, func(filename string) error {
+					txt, err := LoadText(filename)
+					str += "\n" + txt
+					return err
+				})
+			}
+			actions = make(map[int32]bool)
+			for _, line := range SplitAndTrim(str, "\n") {
+				name, subname := SectionName(line)
+				f := strings.Fields(subname)
+				if name == "begin " && len(f) == 2 && strings.ToLower(f[0]) == "action" {
+					actions[Atoi(f[1])] = true
+				}
+			}
+		}
+	}
+	if sound != "" {
+		sounds = make(map[[2]int32]bool)
+		if err := LoadFile(&sound, []string{l.def, "", sys.motifDir, "data/"}, func(filename string) error {
+			// Only the index of the file is read
+			_, err := LoadSndFiltered(filename, func(gn [2]int32) bool {
+				sounds[gn] = true
+				return false
+			}, 0)
+			return err
+		}); err != nil {
+			l.add(l.def, 0, LintError, err.Error())
+			sounds = nil
+		}
+	}
+	return
+}
+
+// Checks what can only be checked once the whole character is compiled
+func (l *Linter) finish(states map[int32]StateBytecode) {
+	actions, sounds := l.resources()
+	if actions != nil {
+		for _, r := range l.anims {
+			if !actions[r.no[0]] {
+				l.warn(r, "ChangeAnim to action %v, which is not in the .air file", r.no[0])
+			}
+		}
+	}
+	if sounds != nil {
+		for _, r := range l.sounds {
+			if !sounds[r.no] {
+				l.warn(r, "PlaySnd of sound %v,%v, which is not in the .snd file",
+					r.no[0], r.no[1])
+			}
+		}
+	}
+	if states != nil {
+		for _, r := range l.gotos {
+			if _, ok := states[r.no[0]]; !ok {
+				l.warn(r, "State %v is not defined", r.no[0])
+			}
+		}
+	}
+	for no, r := range l.defined {
+		// The engine enters the common states and those below 200 itself
+		if no >= 200 && (no < 5000 || no >= 6000) && !l.reached[no] {
+			l.warn(r, "State %v is never entered by a state controller with a constant state number", no)
+		}
+	}
+	for name, r := range l.funcs {
+		if !l.c.funcUsed[name] {
+			l.warn(r, "Function %v is never called", name)
+		}
+	}
+	sort.SliceStable(l.messages, func(i, j int) bool {
+		a, b := l.messages[i], l.messages[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+}
+
+// Compiles the character of def and returns the problems found
+func lintChar(def string) []LintMessage {
+	l := newLinter(def)
+	defer func(oime bool, chars []*Char) {
+		sys.ignoreMostErrors, sys.chars[0] = oime, chars
+	}(sys.ignoreMostErrors, sys.chars[0])
+	sys.ignoreMostErrors = false
+	// The compiler keeps the commands in the player's char
+	sys.chars[0] = []*Char{{}}
+	l.watch(newCompiler())
+	states, err := l.c.Compile(0, def, l.constants())
+	if err != nil {
+		l.fileError(err)
+	}
+	l.finish(states)
+	return l.messages
+}
+
+// Runs the linter from the command line and returns the exit code
+func runLint(args []string) int {
+	asJSON, def := false, ""
+	for _, a := range args {
+		if a == "-json" {
+			asJSON = true
+		} else {
+			def = a
+		}
+	}
+	if def == "" {
+		fmt.Fprintln(os.Stderr, "Usage: ikemen lint [-json] <char.def>")
+		return 2
+	}
+	messages := lintChar(def)
+	if asJSON {
+		b, err := json.MarshalIndent(messages, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, m := range messages {
+			fmt.Println(m)
+		}
+	}
+	for _, m := range messages {
+		if m.Severity == LintError {
+			return 1
+		}
+	}
+	return 0
+}
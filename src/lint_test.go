@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A character without problems, compiled with the common states, constants
+// and commands of the default config
+func TestLintClean(t *testing.T) {
+	for _, m := range lintChar("src/testdata/match/test/test.def") {
+		t.Error(m)
+	}
+}
+
+// Errors in a zss file are reported at their line, and the file by its path
+// like the other files of the character
+func TestLintZss(t *testing.T) {
+	dir := t.TempDir()
+	src := "src/testdata/match/test"
+	for _, name := range []string{"test.air", "test.cmd", "test.cns"} {
+		b, err := os.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"test.def": "[Files]\ncmd = test.cmd\ncns = test.cns\nst = test.zss\nanim = test.air\n",
+		"test.zss": "[StateDef 300;]\nChangeState{value: 0}\n\n[StateDef 301;]\nfoo bar;\n",
+	}
+	for name, str := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(str), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var errors []LintMessage
+	for _, m := range lintChar(filepath.Join(dir, "test.def")) {
+		if m.Severity == LintError {
+			errors = append(errors, m)
+		}
+	}
+	zss := filepath.Join(dir, "test.zss")
+	if len(errors) != 1 || errors[0].File != zss || errors[0].Line != 5 {
+		t.Errorf("got %v, want a single error at %v:5", errors, zss)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -54,6 +55,12 @@ func main() {
 
 	processCommandLine()
 
+	// Headless mode needs the null backends, which only headless builds have
+	if _, ok := sys.cmdFlags["-headless"]; ok && !headlessBackend {
+		fmt.Fprintln(os.Stderr, "-headless is only supported by builds made with -tags headless")
+		os.Exit(1)
+	}
+
 	// Try reading stats
 	if _, err := os.ReadFile("save/stats.json"); err != nil {
 		// If there was an error reading, write an empty json file
@@ -66,6 +73,16 @@ func main() {
 	// Setup config values, and get a reference to the config object for the main script and window size
 	tmp := setupConfig()
 
+	// Check a character without starting the game
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(runLint(os.Args[2:]))
+	}
+
+	// Test the commands of a .cmd file without starting the game
+	if cmdfile, ok := sys.cmdFlags["-cmdtest"]; ok {
+		os.Exit(runCommandTest(cmdfile, sys.cmdFlags["-cmdinput"]))
+	}
+
 	//os.Mkdir("debug", os.ModeSticky|0755)
 
 	// Check if the main lua file exists.
@@ -85,6 +102,29 @@ func main() {
 	sys.luaLState = sys.init(tmp.GameWidth, tmp.GameHeight)
 	defer sys.shutdown()
 
+	// Put the players back on their joysticks, wherever they are now
+	sys.joystickSlots.load()
+
+	// Connect to the external processes playing as any of the players
+	bi, err := NewBotInput()
+	if err != nil {
+		ShowErrorDialog(err.Error())
+		panic(err)
+	}
+	sys.botInput = bi
+	if port, ok := sys.cmdFlags["-debugger"]; ok {
+		d, err := NewDebugger(port)
+		if err != nil {
+			ShowErrorDialog(err.Error())
+			panic(err)
+		}
+		sys.debugger = d
+	}
+	if out, ok := sys.cmdFlags["-profile"]; ok {
+		sys.profiler = newProfiler(out)
+	}
+	sys.frameData.batch = newFrameDataBatch()
+
 	// Begin processing game using its lua scripts
 	if err := sys.luaLState.DoFile(tmp.System); err != nil {
 		// Display error logs.
@@ -121,6 +161,7 @@ func processCommandLine() {
 				text := `Options (case sensitive):
 -h -?                   Help
 -log <logfile>          Records match data to <logfile>
+-record <file>          Records offline matches to replay <file>
 -r <path>               Loads motif <path>. eg. -r motifdir or -r motifdir/system.def
 -lifebar <path>         Loads lifebar <path>. eg. -lifebar data/fight.def
 -storyboard <path>      Loads storyboard <path>. eg. -storyboard chars/kfm/intro.def
@@ -133,6 +174,8 @@ Quick VS Options:
 -p<n>.color <col>       Sets player n's color to <col>
 -p<n>.power <power>     Sets player n's power to <power>
 -p<n>.life <life>       Sets player n's life to <life>
+-p<n>.bot <address>     Player n is played by the bot listening at <address>
+                        (host:port or unix:<path>), see src/bot.go
 -tmode1 <tmode>         Sets p1 team mode to <tmode>
 -tmode2 <tmode>         Sets p2 team mode to <tmode>
 -time <num>             Round time (-1 to disable)
@@ -149,7 +192,39 @@ Debug Options:
 -ailevel <level>        Changes game difficulty setting to <level> (1-8)
 -speed <speed>          Changes game speed setting to <speed> (10%%-200%%)
 -stresstest <frameskip> Stability test (AI matches at speed increased by <frameskip>)
--speedtest              Speed test (match speed x100)`
+-speedtest              Speed test (match speed x100)
+-headless               Runs matches without rendering, audio or input as fast
+                        as possible and prints each result as JSON (needs a
+                        build made with -tags headless, which always runs so)
+-netlatency <ms>        Delays outgoing netplay inputs by <ms> milliseconds
+-netloss <percent>      Drops <percent>%% of outgoing netplay packets (UDP only)
+-botlockstep            Waits for the bots' inputs on every frame instead of
+                        running in real time
+-spectate <address>     Watches the netplay session hosted at <address>, which
+                        is host:port unless NetplaySpectatorPort is set
+-framedata <playername> Measures every attack of <playername> against P2 (or
+                        itself) and writes the frame data to a file
+-framedataout <file>    File written by -framedata, CSV if it ends in .csv
+                        (default framedata.json)
+-cmdtest <file>         Checks the commands of the .cmd <file> and, with
+                        -cmdinput, prints the frames on which they complete
+-cmdinput <file>        Input script for -cmdtest, see src/cmdtest.go
+-nostatecache           Compiles the states of every character again instead
+                        of loading them from save/cache
+-bytecodedump <file>    Writes the bytecode of every character that the
+                        optimizer changes to <file>, before and after, when
+                        OptimizeBytecode is set in the config
+-debugger [port]        Turns on the state controller debugger, taking
+                        commands from the console and from 127.0.0.1:[port],
+                        see src/debugger.go. The lines and triggers of ZSS
+                        controllers are not shown
+-profile [file]         Measures the time taken by each state, state
+                        controller, character and opcode, and writes it to
+                        [file] at the end of each match (default profile.json)
+
+Tools:
+lint [-json] <char.def> Checks the states of a character and prints every
+                        problem found, see src/lint.go`
 				//ShowInfoDialog(text, "I.K.E.M.E.N Command line options")
 				fmt.Printf("I.K.E.M.E.N Command line options\n\n" + text + "\nPress ENTER to exit")
 				var s string
@@ -177,6 +252,7 @@ Debug Options:
 }
 
 type configSettings struct {
+	AIController               string
 	AIRamping                  bool
 	AIRandomColor              bool
 	AISurvivalColor            bool
@@ -219,6 +295,9 @@ type configSettings struct {
 	GameFramerate              float32
 	InputButtonAssist          bool
 	InputSOCDResolution        int32
+	InputSimpleSpecials        bool
+	InputAllowMacros           bool
+	InputTurboInterval         int32
 	IP                         map[string]string
 	KeepAspect                 bool
 	LifeMul                    float32
@@ -234,9 +313,17 @@ type configSettings struct {
 	Modules                    []string
 	Motif                      string
 	MSAA                       bool
+	NetplayInputDelay          int32
+	NetplayLocalPlayers        int32
+	NetplayPeers               int32
+	NetplayRollbackFrames      int32
+	NetplaySpectatorDelay      int32
+	NetplaySpectatorPort       string
+	NetplayTransport           string
 	NumSimul                   [2]int
 	NumTag                     [2]int
 	NumTurns                   [2]int
+	OptimizeBytecode           bool
 	PanningRange               float32
 	PauseMasterVolume          int
 	Players                    int
@@ -247,12 +334,14 @@ type configSettings struct {
 	RatioLife                  [4]float32
 	RatioRecoveryBase          float32
 	RatioRecoveryBonus         float32
+	RecordReplays              bool
 	RoundsNumSimul             int32
 	RoundsNumSingle            int32
 	RoundsNumTag               int32
 	RoundTime                  int32
 	ScreenshotFolder           string
 	StartStage                 string
+	StateCache                 bool
 	StereoEffects              bool
 	System                     string
 	Team1VS2Life               float32
@@ -277,11 +366,28 @@ type configSettings struct {
 	KeyConfig                  []struct {
 		Joystick int
 		Buttons  []interface{}
+		// Input settings of the player, the global ones if left out
+		SOCDResolution   *int32
+		ButtonAssist     *bool
+		StickSensitivity *float32
+		SimpleSpecials   *bool
+		configMacros
 	}
 	JoystickConfig []struct {
 		Joystick int
 		Buttons  []interface{}
+		configMacros
+	}
+}
+
+// Macro and turbo buttons of a KeyConfig or JoystickConfig entry. Buttons
+// and Turbo are button letters, such as "xyz".
+type configMacros struct {
+	Macros []struct {
+		Key     string
+		Buttons string
 	}
+	Turbo string
 }
 
 //go:embed resources/defaultConfig.json
@@ -322,6 +428,7 @@ func setupConfig() configSettings {
 	tmp.PanningRange = ClampF(tmp.PanningRange, 0, 100)
 	tmp.Players = int(Clamp(int32(tmp.Players), 1, int32(MaxSimul)*2))
 	tmp.WavChannels = Clamp(tmp.WavChannels, 1, 256)
+	tmp.AIController = aiControllerByName(strings.ToLower(tmp.AIController)).String()
 	// Save config file, indent with two spaces to match calls to json.encode() in the Lua code
 	cfg, _ := json.MarshalIndent(tmp, "", "  ")
 	chk(os.WriteFile(cfgPath, cfg, 0644))
@@ -338,6 +445,7 @@ func setupConfig() configSettings {
 
 	// Set each config property to the system object
 	sys.afterImageMax = tmp.MaxAfterImage
+	sys.aiController = aiControllerByName(tmp.AIController)
 	sys.allowDebugKeys = tmp.DebugKeys
 	sys.allowDebugMode = tmp.DebugMode
 	sys.audioDucking = tmp.AudioDucking
@@ -359,7 +467,6 @@ func setupConfig() configSettings {
 	sys.clipboardRows = tmp.DebugClipboardRows
 	sys.clsnDarken = tmp.DebugClsnDarken
 	sys.consoleRows = tmp.DebugConsoleRows
-	sys.controllerStickSensitivity = tmp.ControllerStickSensitivity
 	sys.explodMax = tmp.MaxExplod
 	sys.externalShaderList = tmp.ExternalShaders
 	sys.fontShaderVer = tmp.FontShaderVer
@@ -374,8 +481,11 @@ func setupConfig() configSettings {
 	sys.gameSpeed = tmp.GameFramerate / float32(tmp.Framerate)
 	sys.keepAspect = tmp.KeepAspect
 	sys.helperMax = tmp.MaxHelper
-	sys.inputButtonAssist = tmp.InputButtonAssist
-	sys.inputSOCDresolution = Clamp(tmp.InputSOCDResolution, 0, 4)
+	sys.inputDefaults = InputSettings{SOCDResolution: Clamp(tmp.InputSOCDResolution, 0, 4),
+		ButtonAssist: tmp.InputButtonAssist, StickSensitivity: tmp.ControllerStickSensitivity,
+		SimpleSpecials: tmp.InputSimpleSpecials}
+	sys.allowMacros = tmp.InputAllowMacros
+	sys.turboInterval = Max(1, tmp.InputTurboInterval)
 	sys.lifeMul = tmp.LifeMul / 100
 	sys.lifeShare = [...]bool{tmp.TeamLifeShare, tmp.TeamLifeShare}
 	sys.listenPort = tmp.ListenPort
@@ -383,12 +493,27 @@ func setupConfig() configSettings {
 	sys.loseTag = tmp.LoseTag
 	sys.masterVolume = tmp.VolumeMaster
 	sys.multisampleAntialiasing = tmp.MSAA
+	sys.netplayInputDelay = Clamp(tmp.NetplayInputDelay, 0, 8)
+	sys.netplayLocalPlayers = Clamp(tmp.NetplayLocalPlayers, 1, MaxSimul*2)
+	sys.netplayPeers = Clamp(tmp.NetplayPeers, 2, MaxSimul*2)
+	sys.netplayRollbackFrames = Clamp(tmp.NetplayRollbackFrames, 0, 16)
+	sys.netplaySpectatorDelay = Max(0, tmp.NetplaySpectatorDelay)
+	sys.netplaySpectatorPort = tmp.NetplaySpectatorPort
+	sys.netplayTransport = strings.ToLower(tmp.NetplayTransport)
 	sys.pauseMasterVolume = tmp.PauseMasterVolume
 	sys.panningRange = tmp.PanningRange
 	sys.playerProjectileMax = tmp.MaxPlayerProjectile
 	sys.postProcessingShader = tmp.PostProcessingShader
+	sys.optimizeBytecode = tmp.OptimizeBytecode
+	sys.bytecodeDump = sys.cmdFlags["-bytecodedump"]
 	sys.pngFilter = tmp.PngSpriteFilter
 	sys.powerShare = [...]bool{tmp.TeamPowerShare, tmp.TeamPowerShare}
+	sys.headless = headlessBackend
+	if f := sys.cmdFlags["-record"]; f != "" {
+		sys.recordFile = f
+	} else if tmp.RecordReplays {
+		sys.recordFile = "save/replays/" + time.Now().Format("2006-01-02 03-04PM-05s") + ".replay"
+	}
 	tmp.ScreenshotFolder = strings.TrimSpace(tmp.ScreenshotFolder)
 	if tmp.ScreenshotFolder != "" {
 		tmp.ScreenshotFolder = strings.Replace(tmp.ScreenshotFolder, "\\", "/", -1)
@@ -397,6 +522,8 @@ func setupConfig() configSettings {
 	} else {
 		sys.screenshotFolder = tmp.ScreenshotFolder
 	}
+	_, nocache := sys.cmdFlags["-nostatecache"]
+	sys.stateCache = tmp.StateCache && !nocache
 	sys.stereoEffects = tmp.StereoEffects
 	sys.team1VS2Life = tmp.Team1VS2Life / 100
 	sys.vRetrace = tmp.VRetrace
@@ -415,7 +542,30 @@ func setupConfig() configSettings {
 		}
 		return 999
 	}
-	for _, kc := range tmp.KeyConfig {
+	macros := func(i int, joystick bool, key func(string) int, cm configMacros) {
+		for len(sys.inputMacros) <= i {
+			sys.inputMacros = append(sys.inputMacros, InputMacros{})
+		}
+		for _, mc := range cm.Macros {
+			sys.inputMacros[i].add(joystick, key(mc.Key), mc.Buttons)
+		}
+		sys.inputMacros[i].turbo |= buttonBits(cm.Turbo)
+	}
+	for i, kc := range tmp.KeyConfig {
+		is := sys.inputDefaults
+		if kc.SOCDResolution != nil {
+			is.SOCDResolution = Clamp(*kc.SOCDResolution, 0, 4)
+		}
+		if kc.ButtonAssist != nil {
+			is.ButtonAssist = *kc.ButtonAssist
+		}
+		if kc.StickSensitivity != nil {
+			is.StickSensitivity = *kc.StickSensitivity
+		}
+		if kc.SimpleSpecials != nil {
+			is.SimpleSpecials = *kc.SimpleSpecials
+		}
+		sys.inputSettings = append(sys.inputSettings, is)
 		b := kc.Buttons
 		sys.keyConfig = append(sys.keyConfig, KeyConfig{kc.Joystick,
 			stoki(b[0].(string)), stoki(b[1].(string)), stoki(b[2].(string)),
@@ -423,9 +573,10 @@ func setupConfig() configSettings {
 			stoki(b[6].(string)), stoki(b[7].(string)), stoki(b[8].(string)),
 			stoki(b[9].(string)), stoki(b[10].(string)), stoki(b[11].(string)),
 			stoki(b[12].(string)), stoki(b[13].(string))})
+		macros(i, false, stoki, kc.configMacros)
 	}
 	if _, ok := sys.cmdFlags["-nojoy"]; !ok {
-		for _, jc := range tmp.JoystickConfig {
+		for i, jc := range tmp.JoystickConfig {
 			b := jc.Buttons
 			sys.joystickConfig = append(sys.joystickConfig, KeyConfig{jc.Joystick,
 				Atoi(b[0].(string)), Atoi(b[1].(string)), Atoi(b[2].(string)),
@@ -433,7 +584,16 @@ func setupConfig() configSettings {
 				Atoi(b[6].(string)), Atoi(b[7].(string)), Atoi(b[8].(string)),
 				Atoi(b[9].(string)), Atoi(b[10].(string)), Atoi(b[11].(string)),
 				Atoi(b[12].(string)), Atoi(b[13].(string))})
+			macros(i, true, Atoi, jc.configMacros)
+		}
+	}
+	// Recorded so that replays and netplay opponents can tell who uses them,
+	// players with only a JoystickConfig entry get the default settings
+	for i, im := range sys.inputMacros {
+		for len(sys.inputSettings) <= i {
+			sys.inputSettings = append(sys.inputSettings, sys.inputDefaults)
 		}
+		sys.inputSettings[i].Macros = len(im.macros) > 0 || im.turbo != 0
 	}
 
 	return tmp
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs the tests from the root of the repository, where the engine finds the
+// data and font directories, with the default config and no state cache
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	dir, err := os.MkdirTemp("", "ikemen-test")
+	if err != nil {
+		panic(err)
+	}
+	sys.cmdFlags = map[string]string{"-config": filepath.Join(dir, "config.json")}
+	setupConfig()
+	sys.stateCache = false
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
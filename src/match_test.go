@@ -0,0 +1,78 @@
+//go:build headless
+
+package main
+
+import (
+	"sync"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	testChar    = "src/testdata/match/test/test.def"
+	testStage   = "src/testdata/match/stage.def"
+	testLifebar = "src/testdata/match/fight.def"
+)
+
+var testEngine sync.Once
+
+// Starts the headless engine and loads the test lifebar, character and stage
+// the first time it is called
+func initTestEngine(t *testing.T) {
+	testEngine.Do(func() {
+		sys.luaLState = sys.init(320, 240)
+		lb, err := loadLifebar(testLifebar)
+		if err != nil {
+			panic(err)
+		}
+		sys.lifebar = *lb
+		sys.sel.addChar(testChar)
+		if err := sys.sel.AddStage(testStage); err != nil {
+			panic(err)
+		}
+	})
+	if sys.sel.charlist[0].def == "" {
+		t.Fatalf("test character %v could not be added", testChar)
+	}
+}
+
+// Plays a single match of two AI controlled test characters, with rounds of
+// roundTime frames. frame, if not nil, is called after every frame of the
+// fight; the match ends when it returns false.
+func runTestMatch(t *testing.T, roundTime int32, frame func() bool) {
+	initTestEngine(t)
+	selectTestMatch(roundTime)
+	playTestMatch(t, frame)
+}
+
+// Selects the test characters and stage the way the menus do
+func selectTestMatch(roundTime int32) {
+	sys.sel.ClearSelected()
+	sys.sel.SelectStage(1)
+	for tn := 0; tn < 2; tn++ {
+		sys.tmode[tn], sys.numSimul[tn], sys.numTurns[tn] = TM_Single, 1, 1
+		sys.sel.AddSelectedChar(tn, 0, tn+1)
+		sys.com[tn] = 8
+	}
+	sys.roundTime = roundTime
+}
+
+// Loads and plays the selected match, calling frame like runTestMatch does
+func playTestMatch(t *testing.T, frame func() bool) {
+	sys.commonLua = nil
+	if frame != nil {
+		sys.luaLState.SetGlobal("testFrame", sys.luaLState.NewFunction(func(*lua.LState) int {
+			if !frame() {
+				sys.endMatch = true
+			}
+			return 0
+		}))
+		sys.commonLua = []string{"testFrame()"}
+	}
+	sys.loadStart()
+	if err := sys.luaLState.DoString("game()"); err != nil {
+		t.Fatal(err)
+	}
+	sys.commonLua = nil
+}
@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// The optimizer rewrites the expressions of a character's states once they
+// are compiled, so that less bytecode is run on every frame:
+//
+//   - operations on constants are folded into a single constant
+//   - conditional jumps on a constant are made unconditional or removed, and
+//     the code they make unreachable is removed
+//   - jumps to a jump testing the same value go straight to where it leads,
+//     which flattens chains of && and || and of triggerall and triggerN
+//   - no-op instructions, such as a constant that is popped or floor(floor(x)),
+//     are removed
+//   - state controllers whose trigger is always false are removed, and
+//     triggers that are always true are dropped
+//
+// Triggers, ZSS statements and loop expressions are optimized once the states
+// are compiled. The parameters of state controllers are optimized as they are
+// compiled, since once added to a controller they can not be told apart from
+// those that hold text. const() and the like are not constants here, as they
+// read the char running the state, which may be a helper or another player,
+// so cond(1, const(size.ground.front), 0) * 2 becomes
+// const(size.ground.front) * 2 and no further.
+//
+// With -bytecodedump <file>, the expressions that changed are written to the
+// file before and after optimizing, the parameters first in the order they
+// are compiled. The optimizer is off unless OptimizeBytecode is set to true
+// in the config.
+
+// An instruction of a decoded BytecodeExp
+type bcInstr struct {
+	op  OpCode
+	arg []OpCode // Operands other than the jump offset
+	// Expression run by OC_run and OC_nordrun
+	sub BytecodeExp
+	// Instruction jumped to, len of the instructions for the end of the
+	// expression, or -1 if the instruction does not jump
+	target int
+}
+
+func isRedirectOp(op OpCode) bool {
+	switch op {
+	case OC_player, OC_parent, OC_root, OC_helper, OC_target, OC_partner,
+		OC_enemy, OC_enemynear, OC_playerid, OC_playerindex, OC_p2,
+		OC_stateowner, OC_helperindex:
+		return true
+	}
+	return false
+}
+
+// Number of bytes after the opcode at be[i] that belong to it, other than
+// jump offsets and the expressions of OC_run and OC_nordrun
+func bcOperands(be BytecodeExp, i int) (int, bool) {
+	switch be[i] {
+	case OC_int8, OC_movetype, OC_statetype, OC_teammode, OC_localvar:
+		return 1, true
+	case OC_int, OC_float, OC_command, OC_hitdefattr:
+		return 4, true
+	case OC_int64:
+		return 8, true
+	case OC_st_, OC_const_, OC_ex_, OC_ex2_:
+		if i+1 >= len(be) {
+			return 0, false
+		}
+		switch [...]OpCode{be[i], be[i+1]} {
+		case [...]OpCode{OC_st_, OC_st_map},
+			[...]OpCode{OC_const_, OC_const_authorname},
+			[...]OpCode{OC_const_, OC_const_displayname},
+			[...]OpCode{OC_const_, OC_const_name},
+			[...]OpCode{OC_const_, OC_const_p2name},
+			[...]OpCode{OC_const_, OC_const_p3name},
+			[...]OpCode{OC_const_, OC_const_p4name},
+			[...]OpCode{OC_const_, OC_const_p5name},
+			[...]OpCode{OC_const_, OC_const_p6name},
+			[...]OpCode{OC_const_, OC_const_p7name},
+			[...]OpCode{OC_const_, OC_const_p8name},
+			[...]OpCode{OC_const_, OC_const_stagevar_info_name},
+			[...]OpCode{OC_const_, OC_const_stagevar_info_displayname},
+			[...]OpCode{OC_const_, OC_const_stagevar_info_author},
+			[...]OpCode{OC_const_, OC_const_constants},
+			[...]OpCode{OC_const_, OC_const_stage_constants},
+			[...]OpCode{OC_ex_, OC_ex_fightscreenvar_info_author},
+			[...]OpCode{OC_ex_, OC_ex_fightscreenvar_info_name},
+			[...]OpCode{OC_ex_, OC_ex_gamemode},
+			[...]OpCode{OC_ex_, OC_ex_helpername},
+			[...]OpCode{OC_ex_, OC_ex_isassertedglobal},
+			[...]OpCode{OC_ex_, OC_ex_maparray},
+			[...]OpCode{OC_ex_, OC_ex_reversaldefattr},
+			[...]OpCode{OC_ex_, OC_ex_selfcommand},
+			[...]OpCode{OC_ex2_, OC_ex2_bgmvar_filename},
+			[...]OpCode{OC_ex2_, OC_ex2_debugtrigger}:
+			return 5, true
+		case [...]OpCode{OC_ex_, OC_ex_isassertedchar}:
+			return 9, true
+		case [...]OpCode{OC_ex_, OC_ex_physics},
+			[...]OpCode{OC_ex_, OC_ex_prevmovetype},
+			[...]OpCode{OC_ex_, OC_ex_prevstatetype}:
+			return 2, true
+		}
+		return 1, true
+	}
+	return 0, be[i] < OC_ex2_
+}
+
+// Splits an expression into instructions, or returns false if it can not be
+// read, in which case it is left as it is
+func decodeBytecode(be BytecodeExp) ([]bcInstr, bool) {
+	var ins []bcInstr
+	var pos, dest []int
+	for i := 0; i < len(be); {
+		in, p, d := bcInstr{op: be[i], target: -1}, i, -1
+		i++
+		switch {
+		case in.op == OC_jsf8 || in.op == OC_jmp8 || in.op == OC_jz8 || in.op == OC_jnz8:
+			if i >= len(be) {
+				return nil, false
+			}
+			off := int(uint8(be[i]))
+			if i++; off == 0 {
+				d = len(be)
+			} else {
+				d = i + off
+			}
+			// The width of jumps is chosen again when encoding
+			switch in.op {
+			case OC_jmp8:
+				in.op = OC_jmp
+			case OC_jz8:
+				in.op = OC_jz
+			case OC_jnz8:
+				in.op = OC_jnz
+			}
+		case in.op == OC_jmp || in.op == OC_jz || in.op == OC_jnz ||
+			in.op == OC_run || in.op == OC_nordrun || isRedirectOp(in.op):
+			if i+4 > len(be) {
+				return nil, false
+			}
+			off := int(*(*int32)(unsafe.Pointer(&be[i])))
+			i += 4
+			if in.op == OC_run || in.op == OC_nordrun {
+				if off < 0 || i+off > len(be) {
+					return nil, false
+				}
+				in.sub, i = be[i:i+off], i+off
+			} else {
+				d = i + off
+			}
+		default:
+			n, ok := bcOperands(be, p)
+			if !ok || i+n > len(be) {
+				return nil, false
+			}
+			in.arg, i = be[i:i+n], i+n
+		}
+		if d >= 0 {
+			if d <= p {
+				return nil, false
+			}
+			// Jumping past the end ends the expression too
+			if d > len(be) {
+				d = len(be)
+			}
+		}
+		ins, pos, dest = append(ins, in), append(pos, p), append(dest, d)
+	}
+	index := make(map[int]int, len(pos)+1)
+	for k, p := range pos {
+		index[p] = k
+	}
+	index[len(be)] = len(ins)
+	for k, d := range dest {
+		if d >= 0 {
+			t, ok := index[d]
+			if !ok {
+				return nil, false
+			}
+			ins[k].target = t
+		}
+	}
+	return ins, true
+}
+
+func isShortJump(op OpCode) bool {
+	return op == OC_jmp || op == OC_jz || op == OC_jnz || op == OC_jsf8
+}
+
+// Encodes instructions back into an expression, using 8-bit jumps where the
+// offset fits
+func encodeBytecode(ins []bcInstr) (BytecodeExp, bool) {
+	short := make([]bool, len(ins))
+	for k, in := range ins {
+		short[k] = isShortJump(in.op)
+	}
+	pos := make([]int, len(ins)+1)
+	for {
+		for k, in := range ins {
+			size := 1 + len(in.arg)
+			if in.op == OC_run || in.op == OC_nordrun {
+				size += 4 + len(in.sub)
+			} else if short[k] {
+				size++
+			} else if in.target >= 0 {
+				size += 4
+			}
+			pos[k+1] = pos[k] + size
+		}
+		grown := false
+		for k, in := range ins {
+			if !short[k] || in.target == len(ins) {
+				continue
+			}
+			if off := pos[in.target] - pos[k+1]; off < 1 || off > math.MaxUint8 {
+				if in.op == OC_jsf8 {
+					return nil, false
+				}
+				short[k], grown = false, true
+			}
+		}
+		if !grown {
+			break
+		}
+	}
+	be := make(BytecodeExp, 0, pos[len(ins)])
+	for k, in := range ins {
+		switch {
+		case in.op == OC_run || in.op == OC_nordrun:
+			be.appendI32Op(in.op, int32(len(in.sub)))
+			be.append(in.sub...)
+		case short[k]:
+			op := in.op
+			switch op {
+			case OC_jmp:
+				op = OC_jmp8
+			case OC_jz:
+				op = OC_jz8
+			case OC_jnz:
+				op = OC_jnz8
+			}
+			off := 0
+			if in.target < len(ins) {
+				off = pos[in.target] - pos[k+1]
+			}
+			be.append(op, OpCode(off))
+		case in.target >= 0:
+			be.appendI32Op(in.op, int32(pos[in.target]-pos[k+1]))
+		default:
+			be.append(in.op)
+			be.append(in.arg...)
+		}
+	}
+	return be, true
+}
+
+// Value pushed by the instruction if it is a constant
+func (in *bcInstr) constant() (BytecodeValue, bool) {
+	switch in.op {
+	case OC_int8:
+		return BytecodeInt(int32(int8(in.arg[0]))), true
+	case OC_int:
+		return BytecodeInt(*(*int32)(unsafe.Pointer(&in.arg[0]))), true
+	case OC_int64:
+		return BytecodeInt64(*(*int64)(unsafe.Pointer(&in.arg[0]))), true
+	case OC_float:
+		return BytecodeFloat(*(*float32)(unsafe.Pointer(&in.arg[0]))), true
+	}
+	return bvNone(), false
+}
+
+// Value pushed by the instructions from k if they are a constant, and the
+// number of instructions it takes. There is no bool constant, so bools are
+// an int8 of 0 or 1 followed by a blnot, which turns them into a bool.
+func constantAt(ins []bcInstr, targeted []bool, k int) (BytecodeValue, int) {
+	v, ok := ins[k].constant()
+	if !ok {
+		return v, 0
+	}
+	if ins[k].op == OC_int8 && (v.v == 0 || v.v == 1) && k+1 < len(ins) &&
+		ins[k+1].op == OC_blnot && !targeted[k+1] {
+		return BytecodeBool(v.v == 0), 2
+	}
+	return v, 1
+}
+
+// Instructions pushing the constant, read back by constantAt
+func constInstrs(bv BytecodeValue) []bcInstr {
+	var be BytecodeExp
+	if bv.t == VT_Bool {
+		be.appendValue(BytecodeInt(1 - int32(bv.v)))
+		return []bcInstr{{op: be[0], arg: be[1:], target: -1},
+			{op: OC_blnot, target: -1}}
+	}
+	be.appendValue(bv)
+	return []bcInstr{{op: be[0], arg: be[1:], target: -1}}
+}
+
+// Number of values taken by an operation that can be folded, 0 for the others
+func foldArity(op OpCode) int {
+	switch op {
+	case OC_neg, OC_not, OC_blnot, OC_abs, OC_exp, OC_ln, OC_cos, OC_sin,
+		OC_tan, OC_acos, OC_asin, OC_atan, OC_floor, OC_ceil:
+		return 1
+	case OC_mul, OC_div, OC_mod, OC_add, OC_sub, OC_gt, OC_ge, OC_lt, OC_le,
+		OC_eq, OC_ne, OC_and, OC_xor, OC_or, OC_bland, OC_blxor, OC_blor,
+		OC_log:
+		return 2
+	case OC_ifelse:
+		return 3
+	}
+	return 0
+}
+
+// Runs an operation on constants the way BytecodeExp.run does. Results that
+// are SFalse are not folded, as a constant can not hold them.
+func foldOp(op OpCode, v []BytecodeValue) (BytecodeValue, bool) {
+	var be BytecodeExp
+	r := v[0]
+	switch op {
+	case OC_neg:
+		be.neg(&r)
+	case OC_not:
+		be.not(&r)
+	case OC_blnot:
+		be.blnot(&r)
+	case OC_abs:
+		be.abs(&r)
+	case OC_exp:
+		be.exp(&r)
+	case OC_ln:
+		be.ln(&r)
+	case OC_cos:
+		be.cos(&r)
+	case OC_sin:
+		be.sin(&r)
+	case OC_tan:
+		be.tan(&r)
+	case OC_acos:
+		be.acos(&r)
+	case OC_asin:
+		be.asin(&r)
+	case OC_atan:
+		be.atan(&r)
+	case OC_floor:
+		be.floor(&r)
+	case OC_ceil:
+		be.ceil(&r)
+	case OC_mul:
+		be.mul(&r, v[1])
+	case OC_div:
+		be.div(&r, v[1])
+	case OC_mod:
+		be.mod(&r, v[1])
+	case OC_add:
+		be.add(&r, v[1])
+	case OC_sub:
+		be.sub(&r, v[1])
+	case OC_gt:
+		be.gt(&r, v[1])
+	case OC_ge:
+		be.ge(&r, v[1])
+	case OC_lt:
+		be.lt(&r, v[1])
+	case OC_le:
+		be.le(&r, v[1])
+	case OC_eq:
+		be.eq(&r, v[1])
+	case OC_ne:
+		be.ne(&r, v[1])
+	case OC_and:
+		be.and(&r, v[1])
+	case OC_xor:
+		be.xor(&r, v[1])
+	case OC_or:
+		be.or(&r, v[1])
+	case OC_bland:
+		be.bland(&r, v[1])
+	case OC_blxor:
+		be.blxor(&r, v[1])
+	case OC_blor:
+		be.blor(&r, v[1])
+	case OC_log:
+		be.log(&r, v[1])
+	case OC_ifelse:
+		if r.ToB() {
+			r = v[1]
+		} else {
+			r = v[2]
+		}
+	default:
+		return r, false
+	}
+	return r, !r.IsSF()
+}
+
+// Whether the operation always pushes a bool
+func isBoolOp(op OpCode) bool {
+	switch op {
+	case OC_gt, OC_ge, OC_lt, OC_le, OC_eq, OC_ne, OC_bland, OC_blxor,
+		OC_blor, OC_blnot:
+		return true
+	}
+	return false
+}
+
+// Replaces the instructions from a to b with those of with, moving the jumps
+// after a. Nothing may jump between a and b.
+func spliceInstrs(ins []bcInstr, a, b int, with ...bcInstr) []bcInstr {
+	d := len(with) - (b - a)
+	out := make([]bcInstr, 0, len(ins)+d)
+	out = append(append(append(out, ins[:a]...), with...), ins[b:]...)
+	for k := range out {
+		if out[k].target > a {
+			out[k].target += d
+		}
+	}
+	return out
+}
+
+// Applies one rewrite to the instructions, returning false once there is
+// nothing left to rewrite
+func simplifyBytecode(ins []bcInstr) ([]bcInstr, bool) {
+	n := len(ins)
+	targeted := make([]bool, n+1)
+	for _, in := range ins {
+		if in.target >= 0 {
+			targeted[in.target] = true
+		}
+	}
+	// Instructions run by a redirection stay right after it. OC_nordrun
+	// keeps the redirection for the instruction after it.
+	pinned := func(k int) bool {
+		for ; k > 0; k-- {
+			if op := ins[k-1].op; isRedirectOp(op) {
+				return true
+			} else if op != OC_nordrun {
+				break
+			}
+		}
+		return false
+	}
+	// Whether the instructions from k to k+m can be rewritten together
+	free := func(k, m int) bool {
+		if pinned(k) || k+m > n {
+			return false
+		}
+		for j := k + 1; j < k+m; j++ {
+			if targeted[j] {
+				return false
+			}
+		}
+		return true
+	}
+	for k := range ins {
+		in := &ins[k]
+		// Jump threading. The value tested is left on the stack, so a
+		// jump to another test of it knows where that one goes.
+		if t := in.target; t >= 0 && t < n &&
+			(in.op == OC_jmp || in.op == OC_jz || in.op == OC_jnz) {
+			next := t
+			switch {
+			case ins[t].op == OC_jmp:
+				next = ins[t].target
+			case in.op == OC_jmp:
+				// Nothing is known about the value there
+			case ins[t].op == in.op:
+				next = ins[t].target
+			case ins[t].op == OC_jz || ins[t].op == OC_jnz:
+				next = t + 1
+			}
+			if next != t {
+				in.target = next
+				return ins, true
+			}
+		}
+		if isShortJump(in.op) && in.target == k+1 && !pinned(k) {
+			return spliceInstrs(ins, k, k+1), true
+		}
+		if in.op == OC_rdreset && !pinned(k) {
+			return spliceInstrs(ins, k, k+1), true
+		}
+		v, w := constantAt(ins, targeted, k)
+		if w > 0 && k+w < n && !targeted[k+w] {
+			switch next := &ins[k+w]; next.op {
+			case OC_jsf8:
+				return spliceInstrs(ins, k+w, k+w+1), true
+			case OC_jz, OC_jnz:
+				if v.ToB() == (next.op == OC_jnz) {
+					next.op = OC_jmp
+					return ins, true
+				}
+				return spliceInstrs(ins, k+w, k+w+1), true
+			}
+		}
+		if w > 0 && free(k, w+1) && ins[k+w].op == OC_pop {
+			return spliceInstrs(ins, k, k+w+1), true
+		}
+		if k+1 < n && free(k, 2) {
+			switch [...]OpCode{in.op, ins[k+1].op} {
+			case [...]OpCode{OC_dup, OC_pop}, [...]OpCode{OC_swap, OC_swap}:
+				return spliceInstrs(ins, k, k+2), true
+			case [...]OpCode{OC_floor, OC_floor}, [...]OpCode{OC_floor, OC_ceil},
+				[...]OpCode{OC_ceil, OC_ceil}, [...]OpCode{OC_ceil, OC_floor},
+				[...]OpCode{OC_abs, OC_abs}:
+				// The first one already makes the value an int or positive
+				return spliceInstrs(ins, k+1, k+2), true
+			}
+		}
+		if isBoolOp(in.op) && free(k, 3) && ins[k+1].op == OC_blnot &&
+			ins[k+2].op == OC_blnot {
+			return spliceInstrs(ins, k+1, k+3), true
+		}
+		// Constant folding, of an operation on the constants starting from k
+		// up to j
+		var consts []int
+		j := k
+		for j < n {
+			_, w := constantAt(ins, targeted, j)
+			if w == 0 {
+				break
+			}
+			consts, j = append(consts, j), j+w
+		}
+		if len(consts) == 0 || j == n {
+			continue
+		}
+		if m := foldArity(ins[j].op); m > 0 && m <= len(consts) {
+			a := consts[len(consts)-m]
+			if !free(a, j+1-a) {
+				continue
+			}
+			vals := make([]BytecodeValue, m)
+			for i := range vals {
+				vals[i], _ = constantAt(ins, targeted, consts[len(consts)-m+i])
+			}
+			if r, ok := foldOp(ins[j].op, vals); ok {
+				return spliceInstrs(ins, a, j+1, constInstrs(r)...), true
+			}
+		}
+	}
+	// Code that can not be reached
+	reached := make([]bool, n+1)
+	var visit func(k int)
+	visit = func(k int) {
+		for ; k < n && !reached[k]; k++ {
+			reached[k] = true
+			if ins[k].target >= 0 {
+				visit(ins[k].target)
+				if ins[k].op == OC_jmp {
+					return
+				}
+			}
+		}
+	}
+	visit(0)
+	for k := n - 1; k >= 0; k-- {
+		if !reached[k] {
+			end := k + 1
+			for k > 0 && !reached[k-1] {
+				k--
+			}
+			return spliceInstrs(ins, k, end), true
+		}
+	}
+	return ins, false
+}
+
+// Returns the optimized expression, or be itself if it can not be improved
+func optimizeBytecode(be BytecodeExp) BytecodeExp {
+	ins, ok := decodeBytecode(be)
+	if !ok {
+		return be
+	}
+	// Encoding the instructions again may change the width of jumps only
+	rewritten := false
+	for k := range ins {
+		if ins[k].op == OC_run || ins[k].op == OC_nordrun {
+			sub := optimizeBytecode(ins[k].sub)
+			rewritten = rewritten || !sameBytecode(sub, ins[k].sub)
+			ins[k].sub = sub
+		}
+	}
+	for ok = true; ok; {
+		ins, ok = simplifyBytecode(ins)
+		rewritten = rewritten || ok
+	}
+	if !rewritten {
+		return be
+	}
+	out, ok := encodeBytecode(ins)
+	if !ok || len(out) > len(be) {
+		return be
+	}
+	return out
+}
+
+func sameBytecode(a, b BytecodeExp) bool {
+	return bytes.Equal(*(*[]byte)(unsafe.Pointer(&a)), *(*[]byte)(unsafe.Pointer(&b)))
+}
+
+// Value of the expression if it is a constant
+func (be BytecodeExp) constant() (BytecodeValue, bool) {
+	if ins, ok := decodeBytecode(be); ok && len(ins) > 0 {
+		if v, w := constantAt(ins, make([]bool, len(ins)+1), 0); w == len(ins) {
+			return v, true
+		}
+	}
+	return bvNone(), false
+}
+
+var bcOpNames = map[OpCode]string{
+	OC_var: "var", OC_sysvar: "sysvar", OC_fvar: "fvar", OC_sysfvar: "sysfvar",
+	OC_localvar: "localvar", OC_pop: "pop", OC_dup: "dup", OC_swap: "swap",
+	OC_run: "run", OC_nordrun: "nordrun", OC_jsf8: "jsf", OC_jmp: "jmp",
+	OC_jz: "jz", OC_jnz: "jnz", OC_eq: "eq", OC_ne: "ne", OC_gt: "gt",
+	OC_le: "le", OC_lt: "lt", OC_ge: "ge", OC_neg: "neg", OC_blnot: "blnot",
+	OC_bland: "bland", OC_blxor: "blxor", OC_blor: "blor", OC_not: "not",
+	OC_and: "and", OC_xor: "xor", OC_or: "or", OC_add: "add", OC_sub: "sub",
+	OC_mul: "mul", OC_div: "div", OC_mod: "mod", OC_pow: "pow", OC_abs: "abs",
+	OC_exp: "exp", OC_ln: "ln", OC_log: "log", OC_cos: "cos", OC_sin: "sin",
+	OC_tan: "tan", OC_acos: "acos", OC_asin: "asin", OC_atan: "atan",
+	OC_floor: "floor", OC_ceil: "ceil", OC_ifelse: "ifelse", OC_time: "time",
+	OC_command: "command", OC_stateno: "stateno", OC_rdreset: "rdreset",
+	OC_st_: "st_", OC_const_: "const_", OC_ex_: "ex_", OC_ex2_: "ex2_",
+}
+
+// Readable listing of an expression, for -bytecodedump. Jumps give the
+// number of the instruction they go to, starting at 0.
+func (be BytecodeExp) disassemble() string {
+	if len(be) == 0 {
+		return "(empty)"
+	}
+	ins, ok := decodeBytecode(be)
+	if !ok {
+		return fmt.Sprintf("(undecodable) % x", *(*[]byte)(unsafe.Pointer(&be)))
+	}
+	parts := make([]string, len(ins))
+	for k, in := range ins {
+		name, ok := bcOpNames[in.op]
+		if !ok {
+			name = fmt.Sprintf("op%v", in.op)
+		}
+		if v, ok := in.constant(); ok {
+			if name = fmt.Sprint(v.v); v.t == VT_Float {
+				if name = fmt.Sprint(float32(v.v)); v.v == math.Trunc(v.v) {
+					name += ".0"
+				}
+			}
+		} else if in.op == OC_run || in.op == OC_nordrun {
+			name += " {" + in.sub.disassemble() + "}"
+		} else if in.target == len(ins) {
+			name += " end"
+		} else if in.target >= 0 {
+			name += fmt.Sprintf(" @%v", in.target)
+		} else if len(in.arg) > 0 {
+			name += fmt.Sprintf(" % x", *(*[]byte)(unsafe.Pointer(&in.arg)))
+		}
+		parts[k] = fmt.Sprintf("%v:%v", k, name)
+	}
+	return strings.Join(parts, "; ")
+}
+
+type stateOptimizer struct {
+	dump    *strings.Builder
+	state   int32
+	ctrl    string // Controller whose parameters are being compiled, if any
+	param   string // Name of the parameter being compiled, if known
+	changed int    // Expressions changed
+	removed int    // State controllers removed
+	before  int    // Bytes of bytecode before and after
+	after   int
+	funcs   map[*StateController][]StateController
+}
+
+func newStateOptimizer(dump *strings.Builder) *stateOptimizer {
+	return &stateOptimizer{dump: dump, funcs: make(map[*StateController][]StateController)}
+}
+
+func (o *stateOptimizer) exp(be BytecodeExp, where string) BytecodeExp {
+	out := optimizeBytecode(be)
+	o.before += len(be)
+	o.after += len(out)
+	if !sameBytecode(out, be) {
+		o.changed++
+		if o.dump != nil {
+			fmt.Fprintf(o.dump, "State %v, %v\n  before: %v\n  after:  %v\n", o.state, where,
+				be.disassemble(), out.disassemble())
+		}
+	}
+	return out
+}
+
+// Optimizes a list of state controllers, path being where it is in the state
+// as the numbers of the controllers containing it
+func (o *stateOptimizer) ctrls(ctrls []StateController, path string) []StateController {
+	// A new slice, as those of ZSS functions are shared by every call
+	out := make([]StateController, 0, len(ctrls))
+	for i, sc := range ctrls {
+		p := fmt.Sprint(i + 1)
+		if path != "" {
+			p = path + "." + p
+		}
+		where := "controller " + p
+		switch sc := sc.(type) {
+		case StateBlock:
+			o.block(&sc, p)
+			if !sc.loopBlock && len(sc.trigger) > 0 {
+				if v, ok := sc.trigger.constant(); !ok {
+				} else if v.ToB() {
+					sc.trigger, sc.elseBlock = nil, nil
+				} else if sc.elseBlock == nil {
+					if o.dump != nil {
+						fmt.Fprintf(o.dump, "State %v, %v removed as its trigger is always false\n",
+							o.state, where)
+					}
+					o.removed++
+					continue
+				}
+			}
+			out = append(out, sc)
+		case StateExpr:
+			out = append(out, StateExpr(o.exp(BytecodeExp(sc), where)))
+		case varAssign:
+			sc.be = o.exp(sc.be, where)
+			out = append(out, sc)
+		case callFunction:
+			sc.arg = o.exp(sc.arg, where+" arguments")
+			if len(sc.ctrls) > 0 {
+				key := &sc.ctrls[0]
+				if fc, ok := o.funcs[key]; ok {
+					sc.ctrls = fc
+				} else {
+					sc.ctrls = o.ctrls(sc.ctrls, p+" function")
+					o.funcs[key] = sc.ctrls
+				}
+			}
+			out = append(out, sc)
+		default:
+			out = append(out, sc)
+		}
+	}
+	return out
+}
+
+func (o *stateOptimizer) block(b *StateBlock, path string) {
+	where := "controller " + path
+	if path == "" {
+		where = "statedef"
+	}
+	b.trigger = o.exp(b.trigger, where+" trigger")
+	b.forCtrlVar.be = o.exp(b.forCtrlVar.be, where+" loop variable")
+	for i := range b.forExpression {
+		b.forExpression[i] = o.exp(b.forExpression[i],
+			fmt.Sprintf("%v loop expression %v", where, i+1))
+	}
+	b.ctrls = o.ctrls(b.ctrls, path)
+	if b.elseBlock != nil {
+		eb := *b.elseBlock
+		o.block(&eb, path+" else")
+		b.elseBlock = &eb
+	}
+}
+
+// Optimizes the expression of a parameter of o.ctrl in state, as it is
+// compiled
+func (o *stateOptimizer) paramExp(be BytecodeExp, state int32) BytecodeExp {
+	o.state = state
+	where := o.ctrl
+	if o.param != "" {
+		where += " " + o.param
+	}
+	return o.exp(be, where)
+}
+
+// Optimizes the expressions of every state, writing those that changed to
+// o.dump if it is not nil
+func (o *stateOptimizer) states(states map[int32]StateBytecode) {
+	nos := make([]int32, 0, len(states))
+	for no := range states {
+		nos = append(nos, no)
+	}
+	sort.Slice(nos, func(i, j int) bool { return nos[i] < nos[j] })
+	for _, no := range nos {
+		sb := states[no]
+		o.state = no
+		o.block(&sb.block, "")
+		states[no] = sb
+	}
+	if o.dump != nil {
+		fmt.Fprintf(o.dump, "%v expressions changed, %v state controllers removed, "+
+			"%v bytes of bytecode down to %v\n", o.changed, o.removed, o.before, o.after)
+	}
+}
+
+var bytecodeDump struct {
+	sync.Mutex
+	started bool
+}
+
+// Adds the changes of the optimizer to a character to the -bytecodedump file,
+// which is started again in each session
+func writeBytecodeDump(def, text string) {
+	bytecodeDump.Lock()
+	defer bytecodeDump.Unlock()
+	flag := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if !bytecodeDump.started {
+		flag |= os.O_TRUNC
+		bytecodeDump.started = true
+	}
+	f, err := os.OpenFile(sys.bytecodeDump, flag, 0644)
+	if err != nil {
+		sys.errLog.Printf("Failed to write the bytecode dump: %v\n", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "; %v\n%v\n", def, text)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "write the golden files of the tests")
+
+// Instructions the tests build expressions from. Jumps go to the number of
+// an instruction, or to the number after the last one for the end.
+func testConst(bv BytecodeValue) bcInstr {
+	var be BytecodeExp
+	be.appendValue(bv)
+	return bcInstr{op: be[0], arg: be[1:], target: -1}
+}
+
+func testOp(op OpCode) bcInstr { return bcInstr{op: op, target: -1} }
+
+func testJump(op OpCode, target int) bcInstr { return bcInstr{op: op, target: target} }
+
+func testExp(t *testing.T, ins ...bcInstr) BytecodeExp {
+	be, ok := encodeBytecode(ins)
+	if !ok {
+		t.Fatal("the test expression can not be encoded")
+	}
+	return be
+}
+
+// Runs both expressions with each value of the vars and fails if they push
+// a different value or type
+func testSameResult(t *testing.T, be, out BytecodeExp) {
+	c := &Char{}
+	for _, vars := range [][3]int32{{0, 0, 0}, {1, 0, 1}, {0, 1, 0}, {3, 5, 7}} {
+		copy(c.ivar[:], vars[:])
+		want, got := be.run(c), out.run(c)
+		if got.t != want.t || (got.v != want.v && !(math.IsNaN(got.v) && math.IsNaN(want.v))) {
+			t.Errorf("with vars %v the optimized expression pushes %v of type %v, want %v of type %v",
+				vars, got.v, got.t, want.v, want.t)
+		}
+	}
+}
+
+func TestOptimizeBytecode(t *testing.T) {
+	i, f := BytecodeInt, BytecodeFloat
+	tests := []struct {
+		name string
+		ins  []bcInstr
+		want string // Disassembly of the optimized expression
+	}{
+		// Constant folding
+		{"int", []bcInstr{testConst(i(2)), testConst(i(3)), testOp(OC_add)}, "0:5"},
+		{"float", []bcInstr{testConst(f(1.5)), testConst(i(2)), testOp(OC_mul)}, "0:3.0"},
+		{"bool", []bcInstr{testConst(i(1)), testConst(i(2)), testOp(OC_lt)}, "0:0; 1:blnot"},
+		{"not", []bcInstr{testConst(i(5)), testOp(OC_blnot)}, "0:1; 1:blnot"},
+		{"bool operand", []bcInstr{testConst(i(1)), testConst(i(2)), testOp(OC_lt),
+			testConst(i(1)), testOp(OC_add)}, "0:2"},
+		{"ifelse", []bcInstr{testConst(i(1)), testConst(f(7)), testConst(i(8)),
+			testOp(OC_ifelse)}, "0:7.0"},
+		{"nested", []bcInstr{testConst(i(2)), testConst(i(3)), testOp(OC_mul),
+			testConst(i(1)), testOp(OC_add), testConst(i(7)), testOp(OC_eq)}, "0:0; 1:blnot"},
+		{"var", []bcInstr{testConst(i(0)), testOp(OC_var), testConst(i(1)), testOp(OC_add)},
+			"0:0; 1:var; 2:1; 3:add"},
+		{"division by zero", []bcInstr{testConst(i(1)), testConst(i(0)), testOp(OC_div)},
+			"0:1; 1:0; 2:div"},
+		{"floor of floor", []bcInstr{testConst(i(0)), testOp(OC_fvar), testOp(OC_floor),
+			testOp(OC_floor)}, "0:0; 1:fvar; 2:floor"},
+		{"not of not", []bcInstr{testConst(i(0)), testOp(OC_var), testConst(i(1)),
+			testOp(OC_gt), testOp(OC_blnot), testOp(OC_blnot)}, "0:0; 1:var; 2:1; 3:gt"},
+		// Jump threading, of var(0) && var(1) && var(2) and of
+		// (var(0) && var(1)) || var(2)
+		{"and chain", []bcInstr{testConst(i(0)), testOp(OC_var), testJump(OC_jz, 6),
+			testOp(OC_pop), testConst(i(1)), testOp(OC_var), testJump(OC_jz, 10),
+			testOp(OC_pop), testConst(i(2)), testOp(OC_var)},
+			"0:0; 1:var; 2:jz end; 3:pop; 4:1; 5:var; 6:jz end; 7:pop; 8:2; 9:var"},
+		{"and or", []bcInstr{testConst(i(0)), testOp(OC_var), testJump(OC_jz, 6),
+			testOp(OC_pop), testConst(i(1)), testOp(OC_var), testJump(OC_jnz, 10),
+			testOp(OC_pop), testConst(i(2)), testOp(OC_var)},
+			"0:0; 1:var; 2:jz @7; 3:pop; 4:1; 5:var; 6:jnz end; 7:pop; 8:2; 9:var"},
+		{"jump to jump", []bcInstr{testConst(i(0)), testOp(OC_var), testJump(OC_jz, 5),
+			testConst(i(1)), testOp(OC_add), testJump(OC_jmp, 7), testConst(i(2)),
+			testConst(i(3)), testOp(OC_mul)},
+			"0:0; 1:var; 2:jz @5; 3:1; 4:add; 5:3; 6:mul"},
+		// Dead branch removal, of 1 || var(0) and of ifelse written with jumps
+		{"or true", []bcInstr{testConst(i(1)), testJump(OC_jnz, 5), testOp(OC_pop),
+			testConst(i(0)), testOp(OC_var)}, "0:1"},
+		{"and false", []bcInstr{testConst(i(2)), testConst(i(1)), testOp(OC_lt),
+			testJump(OC_jz, 7), testOp(OC_pop), testConst(i(0)), testOp(OC_var)},
+			"0:1; 1:blnot"},
+		{"branches", []bcInstr{testConst(i(0)), testJump(OC_jz, 5), testOp(OC_pop),
+			testConst(i(7)), testJump(OC_jmp, 7), testOp(OC_pop), testConst(i(8))}, "0:8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			be := testExp(t, tt.ins...)
+			out := optimizeBytecode(be)
+			if got := out.disassemble(); got != tt.want {
+				t.Errorf("optimized to %v, want %v", got, tt.want)
+			}
+			testSameResult(t, be, out)
+		})
+	}
+}
+
+// Blocks whose trigger is always false are removed, and the trigger of
+// those where it is always true dropped
+func TestOptimizeStateBlocks(t *testing.T) {
+	i := BytecodeInt
+	never := testExp(t, testConst(i(2)), testConst(i(1)), testOp(OC_lt))
+	always := testExp(t, testConst(i(1)), testConst(i(2)), testOp(OC_lt))
+	vars := testExp(t, testConst(i(0)), testOp(OC_var))
+	if never.run(&Char{}).ToB() || !always.run(&Char{}).ToB() {
+		t.Fatal("the test triggers do not give the values the test expects")
+	}
+	ctrls := []StateController{
+		StateBlock{trigger: never},
+		StateBlock{trigger: always},
+		StateBlock{trigger: vars},
+		StateBlock{trigger: never, elseBlock: &StateBlock{}},
+	}
+	o := newStateOptimizer(nil)
+	out := o.ctrls(ctrls, "")
+	if len(out) != 3 || o.removed != 1 {
+		t.Fatalf("%v controllers left and %v removed, want 3 and 1", len(out), o.removed)
+	}
+	if sb := out[0].(StateBlock); sb.trigger != nil {
+		t.Errorf("the always true trigger is left as %v", sb.trigger.disassemble())
+	}
+	if sb := out[1].(StateBlock); sb.trigger.disassemble() != vars.disassemble() {
+		t.Errorf("the trigger on a var is changed to %v", sb.trigger.disassemble())
+	}
+	if sb := out[2].(StateBlock); sb.elseBlock == nil {
+		t.Error("the else block is removed")
+	}
+}
+
+// The changes to the states of src/testdata/optimizer, as -bytecodedump
+// writes them. Run the test with -update to write the golden file again.
+func TestBytecodeDump(t *testing.T) {
+	var dump strings.Builder
+	for _, file := range []string{"optimizer.cns", "optimizer.zss"} {
+		dump.WriteString("; " + file + "\n")
+		c, states := newCompiler(), make(map[int32]StateBytecode)
+		c.optimizer = newStateOptimizer(&dump)
+		if err := c.stateCompile(states, "src/testdata/optimizer/"+file,
+			[]string{""}, false, make(map[string]float32)); err != nil {
+			t.Fatal(err)
+		}
+		c.optimizer.states(states)
+	}
+	golden := "src/testdata/optimizer/optimizer.golden"
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(dump.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.String() != string(want) {
+		t.Errorf("the dump differs from %v:\n%v", golden, dump.String())
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// The profiler measures where the time of the state machine goes, to find
+// what makes a character slow. It is turned on with -profile [file], and
+// counts the runs and the time taken of
+//
+//   - each statedef, including the states it changes to in the same frame
+//   - each type of state controller, including its expressions, those in
+//     blocks included while the blocks themselves and their triggers are not
+//   - each character and helper, adding up the statedefs it runs
+//   - each expression, and each opcode as the total of the expressions it
+//     appears in
+//
+// toggleProfiler() (Ctrl+P) shows the tables one at a time in the fight
+// screen and profilerSort() (Ctrl+Shift+P) changes the column they are sorted
+// by. At the end of each match the tables are appended to the file as JSON
+// (default profile.json), and the counts start again from zero.
+//
+// Nothing is measured while the profiler is off, the run loops only check
+// whether sys.profiler is set.
+
+const (
+	profilePageStates = iota + 1
+	profilePageCtrls
+	profilePageChars
+	profilePageOpcodes
+	profilePages = profilePageOpcodes
+)
+
+const (
+	profileSortTime = iota
+	profileSortCalls
+	profileSortPerCall
+	profileSorts
+)
+
+// Number of rows shown in the overlay and of expressions written to the file
+const (
+	profileOverlayRows = 20
+	profileDumpExps    = 100
+)
+
+type profileEntry struct {
+	name  string
+	calls int64
+	time  time.Duration
+}
+
+// Entries of a table by what they measure
+type profileTable map[interface{}]*profileEntry
+
+type profileStateKey struct {
+	pn int
+	no int32
+}
+
+type profileCharKey struct {
+	pn       int
+	helperId int32
+	helper   bool
+}
+
+// An expression, with the opcodes it is made of
+type profileExp struct {
+	profileEntry
+	be  BytecodeExp
+	ops []string
+}
+
+type Profiler struct {
+	out      string
+	written  bool // Whether out was truncated this session
+	frames   int32
+	states   profileTable
+	ctrls    profileTable // By reflect.Type
+	chars    profileTable
+	exps     map[*OpCode]*profileExp
+	depth    int  // Statedefs being run
+	inExp    bool // Whether an expression is being timed
+	page     int  // 0 when the overlay is hidden
+	sortBy   int
+	overlayT time.Time // Time the overlay rows were last sorted
+	rows     []profileEntry
+}
+
+func newProfiler(out string) *Profiler {
+	if out == "" {
+		out = "profile.json"
+	}
+	p := &Profiler{out: out}
+	p.reset()
+	return p
+}
+
+func (p *Profiler) reset() {
+	p.frames = 0
+	p.states = make(profileTable)
+	p.ctrls = make(profileTable)
+	p.chars = make(profileTable)
+	p.exps = make(map[*OpCode]*profileExp)
+	p.depth, p.inExp = 0, false
+	p.rows = nil
+}
+
+func (e *profileEntry) add(d time.Duration) {
+	e.calls++
+	e.time += d
+}
+
+// Called by StateBytecode.run before running a statedef
+func (p *Profiler) begin() time.Time {
+	p.depth++
+	return time.Now()
+}
+
+// Called by StateBytecode.run once sb has been run by c
+func (p *Profiler) state(c *Char, sb *StateBytecode, start time.Time) {
+	d := time.Since(start)
+	p.depth--
+	sk := profileStateKey{sb.playerNo, sb.no}
+	e := p.states[sk]
+	if e == nil {
+		name := fmt.Sprintf("state %v", sb.no)
+		if sb.playerNo < len(sys.cgi) && sys.cgi[sb.playerNo].displayname != "" {
+			name = fmt.Sprintf("%v %v", sys.cgi[sb.playerNo].displayname, name)
+		}
+		e = &profileEntry{name: name}
+		p.states[sk] = e
+	}
+	e.add(d)
+	if p.depth > 0 {
+		return
+	}
+	ck := profileCharKey{c.playerNo, c.helperId, c.helperIndex != 0}
+	if e = p.chars[ck]; e == nil {
+		e = &profileEntry{name: charName(c)}
+		p.chars[ck] = e
+	}
+	e.add(d)
+}
+
+// Runs a state controller, timing it under its type. Blocks are run without
+// it, as the controllers in them are timed on their own.
+func (p *Profiler) ctrl(sc StateController, c *Char, ps []int32) bool {
+	start := time.Now()
+	changeState := sc.Run(c, ps)
+	d := time.Since(start)
+	t := reflect.TypeOf(sc)
+	e := p.ctrls[t]
+	if e == nil {
+		e = &profileEntry{name: ctrlTypeName(sc)}
+		p.ctrls[t] = e
+	}
+	e.add(d)
+	return changeState
+}
+
+// Runs an expression, timing it. Expressions run by OC_run and by state
+// controllers while it runs count as part of it.
+func (p *Profiler) exp(be BytecodeExp, c *Char) BytecodeValue {
+	p.inExp = true
+	start := time.Now()
+	v := be.run(c)
+	d := time.Since(start)
+	p.inExp = false
+	if len(be) == 0 {
+		return v
+	}
+	e := p.exps[&be[0]]
+	if e == nil {
+		e = &profileExp{be: be, ops: profileOps(be, nil)}
+		if sys.workingState != nil {
+			e.name = fmt.Sprintf("state %v", sys.workingState.no)
+			if pn := sys.workingState.playerNo; pn < len(sys.cgi) {
+				e.name = fmt.Sprintf("%v %v", sys.cgi[pn].displayname, e.name)
+			}
+		}
+		p.exps[&be[0]] = e
+	}
+	e.add(d)
+	return v
+}
+
+// Names of the opcodes in be, once each, those of the sub-expressions included
+func profileOps(be BytecodeExp, ops []string) []string {
+	ins, ok := decodeBytecode(be)
+	if !ok {
+		return ops
+	}
+	for _, in := range ins {
+		if in.sub != nil {
+			ops = profileOps(in.sub, ops)
+		}
+		if _, ok := in.constant(); ok {
+			continue
+		}
+		switch in.op {
+		case OC_jmp, OC_jz, OC_jnz, OC_jsf8, OC_pop, OC_dup, OC_swap,
+			OC_run, OC_nordrun, OC_rdreset:
+			continue
+		}
+		name, ok := bcOpNames[in.op]
+		if !ok {
+			name = fmt.Sprintf("op%v", in.op)
+		}
+		// The sub-opcode tells what trigger it is
+		if len(in.arg) > 0 && in.op >= OC_st_ && in.op <= OC_ex2_ {
+			name += fmt.Sprintf(" %v", in.arg[0])
+		}
+		found := false
+		for _, o := range ops {
+			if o == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ops = append(ops, name)
+		}
+	}
+	return ops
+}
+
+func (p *Profiler) opcodes() profileTable {
+	m := make(profileTable)
+	for _, e := range p.exps {
+		for _, o := range e.ops {
+			if m[o] == nil {
+				m[o] = &profileEntry{name: o}
+			}
+			m[o].calls += e.calls
+			m[o].time += e.time
+		}
+	}
+	return m
+}
+
+func (t profileTable) sorted(by int) []profileEntry {
+	rows := make([]profileEntry, 0, len(t))
+	for _, e := range t {
+		rows = append(rows, *e)
+	}
+	key := func(e *profileEntry) float64 {
+		switch by {
+		case profileSortCalls:
+			return float64(e.calls)
+		case profileSortPerCall:
+			if e.calls == 0 {
+				return 0
+			}
+			return float64(e.time) / float64(e.calls)
+		}
+		return float64(e.time)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if ki, kj := key(&rows[i]), key(&rows[j]); ki != kj {
+			return ki > kj
+		}
+		return rows[i].name < rows[j].name
+	})
+	return rows
+}
+
+// Shows the current page at the top of the screen
+func (p *Profiler) draw() {
+	if p.page == 0 || sys.debugFont == nil {
+		return
+	}
+	// Sorting every frame would make the numbers hard to read
+	if now := time.Now(); p.rows == nil || now.Sub(p.overlayT) >= time.Second/2 {
+		p.rows, p.overlayT = p.pageRows(), now
+	}
+	xscl, yscl := sys.debugFont.xscl/sys.widthScale, sys.debugFont.yscl/sys.heightScale
+	lh := float32(sys.debugFont.fnt.Size[1]) * yscl
+	x := (320-float32(sys.gameWidth))/2 + 2
+	y := 48 + 240 - float32(sys.gameHeight)
+	put := func(s string) {
+		sys.debugFont.fnt.Print(s, x, y, xscl, yscl, 0, 1, &sys.scrrect,
+			sys.debugFont.palfx, sys.debugFont.frgba)
+		y += lh
+	}
+	title := [...]string{"", "Statedefs", "State controllers", "Characters", "Opcodes"}[p.page]
+	sortName := [...]string{"time", "calls", "time per call"}[p.sortBy]
+	sys.debugFont.SetColor(255, 255, 127)
+	put(fmt.Sprintf("Profiler: %v by %v, %v frames", title, sortName, p.frames))
+	put(fmt.Sprintf("%-32v %10v %10v %10v", "", "calls", "us/call", "us/frame"))
+	sys.debugFont.SetColor(255, 255, 255)
+	frames := float64(Max(p.frames, 1))
+	for i, e := range p.rows {
+		if i >= profileOverlayRows {
+			break
+		}
+		name := e.name
+		if len(name) > 32 {
+			name = name[:31] + "~"
+		}
+		var perCall float64
+		if e.calls > 0 {
+			perCall = profileMicros(e.time) / float64(e.calls)
+		}
+		put(fmt.Sprintf("%-32v %10v %10.2f %10.2f", name, e.calls, perCall,
+			profileMicros(e.time)/frames))
+	}
+}
+
+func (p *Profiler) pageRows() []profileEntry {
+	switch p.page {
+	case profilePageStates:
+		return p.states.sorted(p.sortBy)
+	case profilePageCtrls:
+		return p.ctrls.sorted(p.sortBy)
+	case profilePageChars:
+		return p.chars.sorted(p.sortBy)
+	case profilePageOpcodes:
+		return p.opcodes().sorted(p.sortBy)
+	}
+	return nil
+}
+
+// Shows the next page, or hides the overlay after the last one
+func (p *Profiler) nextPage() {
+	p.page = (p.page + 1) % (profilePages + 1)
+	p.rows = nil
+}
+
+func (p *Profiler) nextSort() {
+	p.sortBy = (p.sortBy + 1) % profileSorts
+	p.rows = nil
+}
+
+func profileMicros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+type profileRow struct {
+	Name       string   `json:"name"`
+	Calls      int64    `json:"calls"`
+	TotalMs    float64  `json:"totalMs"`
+	PerCallUs  float64  `json:"perCallUs"`
+	PerFrameUs float64  `json:"perFrameUs"`
+	Code       string   `json:"code,omitempty"`
+	Opcodes    []string `json:"opcodes,omitempty"`
+}
+
+type profileReport struct {
+	Frames      int32        `json:"frames"`
+	Chars       []profileRow `json:"chars"`
+	States      []profileRow `json:"states"`
+	Controllers []profileRow `json:"controllers"`
+	Opcodes     []profileRow `json:"opcodes"`
+	Expressions []profileRow `json:"expressions"`
+}
+
+func (p *Profiler) row(e profileEntry) profileRow {
+	r := profileRow{Name: e.name, Calls: e.calls,
+		TotalMs: float64(e.time) / float64(time.Millisecond)}
+	if e.calls > 0 {
+		r.PerCallUs = profileMicros(e.time) / float64(e.calls)
+	}
+	r.PerFrameUs = profileMicros(e.time) / float64(Max(p.frames, 1))
+	return r
+}
+
+func (p *Profiler) table(rows []profileEntry) []profileRow {
+	out := make([]profileRow, len(rows))
+	for i, e := range rows {
+		out[i] = p.row(e)
+	}
+	return out
+}
+
+// Appends the tables of the match to the file and starts counting again
+func (p *Profiler) finish() {
+	if p.frames > 0 {
+		if err := p.write(); err != nil {
+			sys.errLog.Printf("Failed to write the profile to %v: %v\n", p.out, err)
+		} else {
+			fmt.Printf("Profile of %v frames written to %v\n", p.frames, p.out)
+		}
+	}
+	p.reset()
+}
+
+func (p *Profiler) write() error {
+	r := profileReport{Frames: p.frames,
+		Chars:       p.table(p.chars.sorted(profileSortTime)),
+		States:      p.table(p.states.sorted(profileSortTime)),
+		Controllers: p.table(p.ctrls.sorted(profileSortTime)),
+		Opcodes:     p.table(p.opcodes().sorted(profileSortTime))}
+	exps := make([]*profileExp, 0, len(p.exps))
+	for _, e := range p.exps {
+		exps = append(exps, e)
+	}
+	sort.Slice(exps, func(i, j int) bool { return exps[i].time > exps[j].time })
+	for i, e := range exps {
+		if i >= profileDumpExps {
+			break
+		}
+		row := p.row(e.profileEntry)
+		row.Code, row.Opcodes = e.be.disassemble(), e.ops
+		r.Expressions = append(r.Expressions, row)
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !p.written {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p.out, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.written = true
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
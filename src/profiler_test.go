@@ -0,0 +1,41 @@
+//go:build headless
+
+package main
+
+import (
+	"testing"
+)
+
+// The controllers in blocks are counted once, under their own type, and the
+// blocks not at all
+func TestProfilerCtrls(t *testing.T) {
+	initTestEngine(t)
+	states := make(map[int32]StateBytecode)
+	if err := newCompiler().stateCompile(states, "src/testdata/debugger/debugger.cns",
+		[]string{""}, false, make(map[string]float32)); err != nil {
+		t.Fatal(err)
+	}
+	c := &Char{}
+	p := newProfiler("")
+	defer func(chars []*Char) {
+		sys.profiler, sys.chars[0] = nil, chars
+	}(sys.chars[0])
+	sys.profiler, sys.chars[0] = p, []*Char{c}
+	c.ivar[2], c.ivar[3] = 2, 3
+	sb := states[0]
+	sb.run(c)
+	if c.ivar[10] != 1 || c.ivar[12] != 1 {
+		t.Fatal("the controllers are not run")
+	}
+	if len(p.ctrls) != 1 {
+		for _, e := range p.ctrls {
+			t.Errorf("%v: %v calls", e.name, e.calls)
+		}
+		t.Fatalf("%v controller types are timed, want 1", len(p.ctrls))
+	}
+	for _, e := range p.ctrls {
+		if e.name != "varSet" || e.calls != 2 {
+			t.Errorf("%v is run %v times, want varSet run 2 times", e.name, e.calls)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//go:build headless
+
+package main
+
+// The null renderer used by headless builds. Textures keep their size so that
+// code reading it keeps working, but nothing is uploaded or drawn.
+
+// ------------------------------------------------------------------
+// Texture
+
+type Texture struct {
+	width  int32
+	height int32
+	depth  int32
+	filter bool
+}
+
+func newTexture(width, height, depth int32, filter bool) (t *Texture) {
+	return &Texture{width, height, depth, filter}
+}
+
+func newDataTexture(width, height int32) (t *Texture) {
+	return &Texture{width, height, 32, false}
+}
+
+func (t *Texture) SetData(data []byte) {
+}
+
+func (t *Texture) SetDataG(data []byte, mag, min, ws, wt int32) {
+}
+
+func (t *Texture) SetPixelData(data []float32) {
+}
+
+func (t *Texture) IsValid() bool {
+	return true
+}
+
+// ------------------------------------------------------------------
+// Renderer
+
+type Renderer struct{}
+
+func (r *Renderer) Init() {
+	sys.errLog.Printf("Using null renderer")
+}
+
+func (r *Renderer) Close() {
+}
+
+func (r *Renderer) BeginFrame(clearColor bool) {
+	sys.absTickCountF++
+}
+
+func (r *Renderer) EndFrame() {
+}
+
+func (r *Renderer) SetPipeline(eq BlendEquation, src, dst BlendFunc) {
+}
+
+func (r *Renderer) ReleasePipeline() {
+}
+
+func (r *Renderer) SetModelPipeline(eq BlendEquation, src, dst BlendFunc, depthTest, depthMask, doubleSided, invertFrontFace, useUV, useVertColor, useJoint0, useJoint1 bool, numVertices, vertAttrOffset uint32) {
+}
+
+func (r *Renderer) ReleaseModelPipeline() {
+}
+
+func (r *Renderer) SetModelMorphTarget(offsets [8]uint32, weights [8]float32, positionTargetCount, uvTargetCount int) {
+}
+
+func (r *Renderer) ReadPixels(data []uint8, width, height int) {
+}
+
+func (r *Renderer) Scissor(x, y, width, height int32) {
+}
+
+func (r *Renderer) DisableScissor() {
+}
+
+func (r *Renderer) SetUniformI(name string, val int) {
+}
+
+func (r *Renderer) SetUniformF(name string, values ...float32) {
+}
+
+func (r *Renderer) SetUniformFv(name string, values []float32) {
+}
+
+func (r *Renderer) SetUniformMatrix(name string, value []float32) {
+}
+
+func (r *Renderer) SetTexture(name string, t *Texture) {
+}
+
+func (r *Renderer) SetModelUniformI(name string, val int) {
+}
+
+func (r *Renderer) SetModelUniformF(name string, values ...float32) {
+}
+
+func (r *Renderer) SetModelUniformFv(name string, values []float32) {
+}
+
+func (r *Renderer) SetModelUniformMatrix(name string, value []float32) {
+}
+
+func (r *Renderer) SetModelTexture(name string, t *Texture) {
+}
+
+func (r *Renderer) SetVertexData(values ...float32) {
+}
+
+func (r *Renderer) SetStageVertexData(values []byte) {
+}
+
+func (r *Renderer) SetStageIndexData(values ...uint32) {
+}
+
+func (r *Renderer) RenderQuad() {
+}
+
+func (r *Renderer) RenderElements(mode PrimitiveMode, count, offset int) {
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A replay file starts with ReplayMagic and the format version, followed by
+// chunks. Each chunk is a four letter tag and the length of its data, so
+// readers can skip chunks they do not know about.
+//
+//	HEAD  engine version, framerate, game speed and select.def roster
+//	MTCH  seed, preFightTime, AI controller, input settings and macro rule of
+//	      a synchronization, plus the loaded match, the selected teams and
+//	      the round settings
+//	INPT  a run of input frames, one InputBits per input slot for netplay or
+//	      per player for offline matches
+//	CSUM  checksum of the results of a round (optional)
+//	KEYF  frame number of the input that follows (optional), marking where
+//	      playback can take a snapshot to seek back to. The snapshot is not
+//	      stored in the file, so seeking forward always plays the frames up
+//	      to the target.
+//	SYNC  SyncState before the input that follows (optional), compared during
+//	      playback to find the first frame that plays back differently
+//
+// Netplay replays hold every synchronization, menus included, and are played
+// back through the same menus. Offline recordings start at each fight and
+// hold no select screen or menu inputs, so playback selects the teams and
+// stage of each fight from its MTCH chunk instead.
+const (
+	ReplayMagic   = "IKRP"
+	ReplayVersion = 1
+)
+
+const (
+	rcHeader    = "HEAD"
+	rcMatch     = "MTCH"
+	rcInput     = "INPT"
+	rcChecksum  = "CSUM"
+	rcKeyframe  = "KEYF"
+	rcSyncState = "SYNC"
+)
+
+const (
+	// Number of frames buffered before an input chunk is written
+	replayChunkFrames = 60
+	// Number of frames between keyframes
+	replayKeyframeInterval = 300
+)
+
+type ReplayHeader struct {
+	version   uint16
+	engine    string
+	framerate int32
+	gameSpeed float32
+	roster    uint32
+}
+
+func newReplayHeader() ReplayHeader {
+	h := crc32.NewIEEE()
+	for _, c := range sys.sel.charlist {
+		io.WriteString(h, c.def+"\n")
+	}
+	for _, s := range sys.sel.stagelist {
+		io.WriteString(h, s.def+"\n")
+	}
+	return ReplayHeader{version: ReplayVersion, engine: Version,
+		framerate: int32(FPS), gameSpeed: sys.gameSpeed, roster: h.Sum32()}
+}
+
+func (rh *ReplayHeader) encode() []byte {
+	var b bytes.Buffer
+	putReplayStr(&b, rh.engine)
+	binary.Write(&b, binary.LittleEndian, rh.framerate)
+	binary.Write(&b, binary.LittleEndian, rh.gameSpeed)
+	binary.Write(&b, binary.LittleEndian, rh.roster)
+	return b.Bytes()
+}
+
+func (rh *ReplayHeader) decode(data []byte) error {
+	d := replayDecoder{r: bytes.NewReader(data)}
+	rh.engine = d.str()
+	d.read(&rh.framerate)
+	d.read(&rh.gameSpeed)
+	d.read(&rh.roster)
+	return d.err
+}
+
+// Returns an error describing why a replay with this header can not be
+// played back by the running engine
+func (rh *ReplayHeader) validate() error {
+	cur := newReplayHeader()
+	switch {
+	case rh.engine != cur.engine:
+		return Error(fmt.Sprintf("Replay was recorded with engine version %v (running %v)",
+			rh.engine, cur.engine))
+	case rh.framerate != cur.framerate || rh.gameSpeed != cur.gameSpeed:
+		return Error(fmt.Sprintf("Replay was recorded at %v FPS and game speed %v%% (current settings: %v FPS, %v%%)",
+			rh.framerate, rh.gameSpeed*100, cur.framerate, cur.gameSpeed*100))
+	case rh.roster != cur.roster:
+		return Error("Replay was recorded with a different character and stage roster (select.def)")
+	}
+	return nil
+}
+
+type replayChar struct {
+	slot  int32
+	def   string
+	palno int32
+}
+
+// Content of a match chunk
+type ReplayMatch struct {
+	seed, pfTime       int32
+	tmode              [2]int32
+	numSimul, numTurns [2]int32
+	chars              []replayChar
+	stage              string
+	// Offline matches record the inputs of every player, AI included
+	local         bool
+	com           [MaxSimul*2 + MaxAttachedChar]float32
+	aiController  int32
+	inputSettings [MaxSimul*2 + MaxAttachedChar]InputSettings
+	allowMacros   bool
+	// Selected characters of each side, by member number, and the round
+	// settings the fight was started with
+	teams                   [2][]replayChar
+	roundTime               int32
+	matchWins, maxDrawGames [2]int32
+}
+
+func newReplayMatch(seed, pfTime int32) *ReplayMatch {
+	m := &ReplayMatch{seed: seed, pfTime: pfTime, numSimul: sys.numSimul,
+		numTurns: sys.numTurns, com: sys.com,
+		aiController: int32(currentAIController()), inputSettings: currentInputSettings(),
+		allowMacros: currentAllowMacros(), roundTime: sys.roundTime,
+		matchWins: sys.lifebar.ro.match_wins, maxDrawGames: sys.lifebar.ro.match_maxdrawgames}
+	for i, tm := range sys.tmode {
+		m.tmode[i] = int32(tm)
+	}
+	for tn, sel := range sys.sel.selected {
+		for mn, sc := range sel {
+			def := sys.sel.cdefOverwrite[mn*2+tn]
+			if def == "" && sc[0] >= 0 && sc[0] < len(sys.sel.charlist) {
+				def = sys.sel.charlist[sc[0]].def
+			}
+			m.teams[tn] = append(m.teams[tn], replayChar{int32(mn), def, int32(sc[1])})
+		}
+	}
+	for i, p := range sys.chars {
+		if len(p) > 0 {
+			m.chars = append(m.chars, replayChar{int32(i), sys.cgi[i].def, sys.cgi[i].palno})
+		}
+	}
+	// Synchronizations outside of a fight have no match loaded
+	if len(m.chars) > 0 && sys.stage != nil {
+		m.stage = sys.stage.def
+	}
+	return m
+}
+
+func (rm *ReplayMatch) encode() []byte {
+	var b bytes.Buffer
+	for _, v := range [...]interface{}{rm.seed, rm.pfTime, rm.tmode, rm.numSimul,
+		rm.numTurns, int32(len(rm.chars))} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	for _, c := range rm.chars {
+		binary.Write(&b, binary.LittleEndian, c.slot)
+		putReplayStr(&b, c.def)
+		binary.Write(&b, binary.LittleEndian, c.palno)
+	}
+	putReplayStr(&b, rm.stage)
+	b.WriteByte(byte(Btoi(rm.local)))
+	if rm.local {
+		binary.Write(&b, binary.LittleEndian, rm.com)
+	}
+	binary.Write(&b, binary.LittleEndian, rm.aiController)
+	for _, is := range rm.inputSettings {
+		binary.Write(&b, binary.LittleEndian, is.pack())
+	}
+	b.WriteByte(byte(Btoi(rm.allowMacros)))
+	for _, team := range rm.teams {
+		binary.Write(&b, binary.LittleEndian, int32(len(team)))
+		for _, c := range team {
+			putReplayStr(&b, c.def)
+			binary.Write(&b, binary.LittleEndian, c.palno)
+		}
+	}
+	for _, v := range [...]interface{}{rm.roundTime, rm.matchWins, rm.maxDrawGames} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+func (rm *ReplayMatch) decode(data []byte) error {
+	d := replayDecoder{r: bytes.NewReader(data)}
+	var n int32
+	for _, v := range [...]interface{}{&rm.seed, &rm.pfTime, &rm.tmode, &rm.numSimul,
+		&rm.numTurns, &n} {
+		d.read(v)
+	}
+	for i := int32(0); i < n && d.err == nil; i++ {
+		var c replayChar
+		d.read(&c.slot)
+		c.def = d.str()
+		d.read(&c.palno)
+		rm.chars = append(rm.chars, c)
+	}
+	rm.stage = d.str()
+	if d.err == nil && d.r.Len() > 0 {
+		var local byte
+		d.read(&local)
+		if rm.local = local != 0; rm.local {
+			d.read(&rm.com)
+		}
+	}
+	// Replays without the AI controller predate the heuristic one, so their
+	// AI players were random
+	if d.err == nil && d.r.Len() > 0 {
+		d.read(&rm.aiController)
+	}
+	// Older replays were played with absolute priority SOCD resolution for
+	// everyone
+	for i := range rm.inputSettings {
+		v := [...]int32{2, 0}
+		if d.err == nil && d.r.Len() > 0 {
+			d.read(&v)
+		}
+		rm.inputSettings[i] = unpackInputSettings(v)
+	}
+	// Macros came later still
+	if d.err == nil && d.r.Len() > 0 {
+		var allow byte
+		d.read(&allow)
+		rm.allowMacros = allow != 0
+	}
+	// And the teams and round settings, which offline playback selects
+	if d.err == nil && d.r.Len() > 0 {
+		for tn := range rm.teams {
+			var n int32
+			d.read(&n)
+			for i := int32(0); i < n && d.err == nil; i++ {
+				c := replayChar{slot: i, def: d.str()}
+				d.read(&c.palno)
+				rm.teams[tn] = append(rm.teams[tn], c)
+			}
+		}
+		for _, v := range [...]interface{}{&rm.roundTime, &rm.matchWins, &rm.maxDrawGames} {
+			d.read(v)
+		}
+	}
+	return d.err
+}
+
+// Compares a recorded match with the one loaded for playback
+func (rm *ReplayMatch) validate(cur *ReplayMatch) error {
+	if rm.tmode != cur.tmode || rm.numSimul != cur.numSimul || rm.numTurns != cur.numTurns {
+		return Error("Replay desynchronized: team modes differ from the recording")
+	}
+	if len(rm.chars) != len(cur.chars) {
+		return Error(fmt.Sprintf("Replay desynchronized: %v characters recorded, %v loaded",
+			len(rm.chars), len(cur.chars)))
+	}
+	for i, c := range rm.chars {
+		if c != cur.chars[i] {
+			return Error(fmt.Sprintf("Replay desynchronized: P%v was %v (palette %v), loaded %v (palette %v)",
+				c.slot+1, c.def, c.palno+1, cur.chars[i].def, cur.chars[i].palno+1))
+		}
+	}
+	if rm.stage != cur.stage {
+		return Error(fmt.Sprintf("Replay desynchronized: stage was %v, loaded %v",
+			rm.stage, cur.stage))
+	}
+	return nil
+}
+
+// Selects the recorded teams, stage and round settings, so that the fight
+// loaded next is the one the match was recorded in
+func (rm *ReplayMatch) selectFight() error {
+	if len(rm.teams[0]) == 0 || len(rm.teams[1]) == 0 || rm.stage == "" {
+		return Error("Replay does not hold the characters and stage of its fights")
+	}
+	if len(sys.sel.stagelist) == 0 {
+		return Error("Replay stage " + rm.stage + " can not be selected without a stage list")
+	}
+	stage := 1
+	for i, ss := range sys.sel.stagelist {
+		if ss.def == rm.stage {
+			stage = i + 1
+			break
+		}
+	}
+	sys.sel.ClearSelected()
+	sys.sel.SelectStage(stage)
+	sys.sel.sdefOverwrite = rm.stage
+	for tn, team := range rm.teams {
+		sys.tmode[tn] = TeamMode(rm.tmode[tn])
+		sys.numSimul[tn], sys.numTurns[tn] = rm.numSimul[tn], rm.numTurns[tn]
+		for _, c := range team {
+			sys.sel.addSelectedDef(tn, c.def, int(c.palno))
+		}
+		sys.lifebar.ro.match_wins[tn] = rm.matchWins[tn]
+		sys.lifebar.ro.match_maxdrawgames[tn] = rm.maxDrawGames[tn]
+	}
+	sys.roundTime = rm.roundTime
+	sys.com = rm.com
+	return nil
+}
+
+// Checksum of the state at the end of a round, used to detect replays that
+// play back differently from how they were recorded
+func roundChecksum() uint32 {
+	h := crc32.NewIEEE()
+	binary.Write(h, binary.LittleEndian, sys.round)
+	binary.Write(h, binary.LittleEndian, sys.wins)
+	binary.Write(h, binary.LittleEndian, sys.draws)
+	for _, p := range sys.chars {
+		if len(p) > 0 {
+			binary.Write(h, binary.LittleEndian, p[0].life)
+			binary.Write(h, binary.LittleEndian, p[0].power)
+			binary.Write(h, binary.LittleEndian, p[0].pos)
+		}
+	}
+	return h.Sum32()
+}
+
+type ReplayWriter struct {
+	f           io.WriteCloser
+	frames      bytes.Buffer
+	count       int32
+	width       int32
+	chunkFrames int32 // Number of frames buffered before they are written
+	frame       int32 // Frames written since the last match chunk
+	// Inputs of each player resolved during the current offline frame
+	captured [MaxSimul*2 + MaxAttachedChar]InputBits
+	fighting bool // Between an offline match chunk and the end of its fight
+}
+
+func NewReplayWriter(filename string) (*ReplayWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newReplayWriter(f, replayChunkFrames), nil
+}
+
+func newReplayWriter(w io.WriteCloser, chunkFrames int32) *ReplayWriter {
+	rw := &ReplayWriter{f: w, chunkFrames: chunkFrames}
+	hdr := newReplayHeader()
+	var b bytes.Buffer
+	b.WriteString(ReplayMagic)
+	binary.Write(&b, binary.LittleEndian, hdr.version)
+	w.Write(b.Bytes())
+	rw.writeChunk(rcHeader, hdr.encode())
+	return rw
+}
+
+func (rw *ReplayWriter) writeChunk(tag string, data []byte) {
+	// Chunks are written in one piece, as spectators receive each write as
+	// it is made
+	var b bytes.Buffer
+	b.WriteString(tag)
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	rw.f.Write(b.Bytes())
+}
+
+func (rw *ReplayWriter) writeMatch(m *ReplayMatch) {
+	rw.flush()
+	rw.writeChunk(rcMatch, m.encode())
+	rw.frame = 0
+	rw.captured = [len(rw.captured)]InputBits{}
+	rw.fighting = m.local
+}
+
+func (rw *ReplayWriter) writeFrame(ib []InputBits) {
+	// Frame 0 is read while the match is being loaded, so keyframes start
+	// from the first frame of the fight
+	if rw.frame%replayKeyframeInterval == 1 {
+		rw.flush()
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, rw.frame)
+		rw.writeChunk(rcKeyframe, b.Bytes())
+	}
+	rw.frame++
+	binary.Write(&rw.frames, binary.LittleEndian, ib)
+	rw.width = int32(len(ib))
+	rw.count++
+	if rw.count >= rw.chunkFrames {
+		rw.flush()
+	}
+}
+
+// Stores the input of player pn for the frame being simulated
+func (rw *ReplayWriter) capture(pn int, ib InputBits) {
+	if pn >= 0 && pn < len(rw.captured) {
+		rw.captured[pn] = ib
+	}
+}
+
+// Writes the inputs captured since the last call as one frame. Playback
+// reads a frame on every update that advanced the game, so one is written
+// for each, even when no character read its inputs.
+func (rw *ReplayWriter) writeCaptured() {
+	if !rw.fighting {
+		return
+	}
+	rw.writeFrame(rw.captured[:])
+	rw.captured = [len(rw.captured)]InputBits{}
+	// The frame has been simulated, so the match is now in the state before
+	// the next one
+	if rw.frame%stateHashInterval == 0 {
+		rw.writeSyncState(newSyncState())
+	}
+}
+
+func (rw *ReplayWriter) writeSyncState(ss *SyncState) {
+	rw.flush()
+	rw.writeChunk(rcSyncState, ss.encode())
+}
+
+func (rw *ReplayWriter) writeChecksum(round int32, sum uint32) {
+	rw.flush()
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, round)
+	binary.Write(&b, binary.LittleEndian, sum)
+	rw.writeChunk(rcChecksum, b.Bytes())
+}
+
+// Writes the buffered input frames as one chunk
+func (rw *ReplayWriter) flush() {
+	if rw.count == 0 {
+		return
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, rw.count)
+	binary.Write(&b, binary.LittleEndian, rw.width)
+	b.Write(rw.frames.Bytes())
+	rw.writeChunk(rcInput, b.Bytes())
+	rw.frames.Reset()
+	rw.count = 0
+}
+
+func (rw *ReplayWriter) Close() {
+	if rw.f != nil {
+		rw.flush()
+		rw.f.Close()
+		rw.f = nil
+	}
+}
+
+// Reads the replay magic and header, returning an error if the file is not a
+// replay that the running engine can play back
+func readReplayHeader(r io.Reader) (hdr ReplayHeader, err error) {
+	magic := make([]byte, len(ReplayMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != ReplayMagic {
+		return hdr, Error("Not a replay file, or a replay from an older engine version")
+	}
+	if err = binary.Read(r, binary.LittleEndian, &hdr.version); err != nil {
+		return
+	}
+	if hdr.version > ReplayVersion {
+		return hdr, Error(fmt.Sprintf("Replay format version %v is newer than supported (%v)",
+			hdr.version, ReplayVersion))
+	}
+	var tag string
+	var data []byte
+	if tag, data, err = readReplayChunk(r); err != nil {
+		return
+	}
+	if tag != rcHeader {
+		return hdr, Error("Replay header is missing")
+	}
+	if err = hdr.decode(data); err != nil {
+		return
+	}
+	return hdr, hdr.validate()
+}
+
+type replayMatchIndex struct {
+	fight  bool    // Whether the synchronization loaded a match
+	local  bool    // Whether the match was recorded offline
+	frames int32   // Number of recorded frames
+	rounds []int32 // Frame count at the end of each round
+}
+
+// Reads the remaining chunks of a replay to find the length of each match,
+// leaving r where it was
+func indexReplay(r io.ReadSeeker) (index []replayMatchIndex, err error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Seek(pos, io.SeekStart)
+	for {
+		tag, data, err := readReplayChunk(r)
+		if err != nil {
+			break
+		}
+		switch tag {
+		case rcMatch:
+			var m ReplayMatch
+			if err := m.decode(data); err != nil {
+				return nil, err
+			}
+			index = append(index, replayMatchIndex{fight: len(m.chars) > 0, local: m.local})
+		case rcInput, rcChecksum:
+			if len(index) == 0 {
+				return nil, Error("Replay " + tag + " chunk found before the first match")
+			}
+			mi := &index[len(index)-1]
+			if tag == rcChecksum {
+				mi.rounds = append(mi.rounds, mi.frames)
+			} else if len(data) >= 4 {
+				mi.frames += int32(binary.LittleEndian.Uint32(data))
+			}
+		}
+	}
+	return index, nil
+}
+
+func readReplayChunk(r io.Reader) (tag string, data []byte, err error) {
+	var t [4]byte
+	if _, err = io.ReadFull(r, t[:]); err != nil {
+		return
+	}
+	var size uint32
+	if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return
+	}
+	data = make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return
+	}
+	return string(t[:]), data, nil
+}
+
+func putReplayStr(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.LittleEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+type replayDecoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *replayDecoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, v)
+	}
+}
+
+func (d *replayDecoder) str() string {
+	var n uint16
+	d.read(&n)
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = err
+	}
+	return string(b)
+}
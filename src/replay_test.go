@@ -0,0 +1,60 @@
+//go:build headless
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Records an offline match and plays the replay back from the file alone,
+// which selects the characters and stage from the match chunk
+func TestReplayRoundTrip(t *testing.T) {
+	initTestEngine(t)
+	file := filepath.Join(t.TempDir(), "test.replay")
+	var recorded []uint32
+	sys.recordFile = file
+	runTestMatch(t, 300, func() bool {
+		recorded = append(recorded, newSyncState().hash())
+		return !sys.postMatchFlg
+	})
+	sys.recorder.Close()
+	sys.recorder, sys.recordFile = nil, ""
+	if len(recorded) == 0 {
+		t.Fatal("no frames were recorded")
+	}
+
+	fi, err := OpenFileInput(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		fi.Close()
+		sys.fileInput = nil
+	}()
+	sys.fileInput = fi
+	// Played back with nothing selected, as from the replay menu
+	sys.sel.ClearSelected()
+	if !fi.selectFight() {
+		t.Fatal("the replay has no fight to select")
+	}
+	var played []uint32
+	playTestMatch(t, func() bool {
+		played = append(played, newSyncState().hash())
+		return !sys.postMatchFlg
+	})
+	if fi.desync >= 0 {
+		t.Fatalf("replay desynchronized at frame %v", fi.desync)
+	}
+	if len(played) != len(recorded) {
+		t.Fatalf("%v frames played back, %v recorded", len(played), len(recorded))
+	}
+	for i := range recorded {
+		if played[i] != recorded[i] {
+			t.Fatalf("frame %v played back differently", i+1)
+		}
+	}
+	if fi.selectFight() {
+		t.Error("the replay holds more than the recorded fight")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+// Rollback lets netplay run ahead of the remote player on predicted inputs.
+// The match state is saved every frame, and when a confirmed remote input
+// differs from the one that was predicted, the match is rewound to that frame
+// and simulated again up to the present.
+type Rollback struct {
+	states [32]*GameState
+	sync   [32]*SyncState // Saved with the states of hashed frames
+	checkT int32          // First frame whose prediction has not been verified yet
+	repT   int32          // Next frame to write to the replay file
+}
+
+// Switches to rollback mode once the match has been set up
+func (ni *NetInput) startRollback() {
+	if ni.rollback <= 0 || ni.st != NS_Playing {
+		return
+	}
+	ni.rb = &Rollback{checkT: ni.time, repT: ni.time}
+	// The frame about to be simulated was confirmed in lockstep
+	for _, s := range ni.remoteSlots() {
+		rem := &ni.buf[s]
+		rem.pred[rem.curT&31] = rem.buf[rem.curT&31]
+		rem.predict = true
+	}
+}
+
+func (ni *NetInput) stopRollback() {
+	ni.rb = nil
+	for i := range ni.buf {
+		ni.buf[i].predict = false
+	}
+}
+
+// Slots whose inputs come from other machines
+func (ni *NetInput) remoteSlots() (s []int) {
+	for _, p := range ni.peers {
+		s = append(s, p.recv...)
+	}
+	return
+}
+
+func (ni *NetInput) rollbackUpdate() {
+	loc := &ni.buf[ni.local[0]]
+	for {
+		for loc.frames() <= ni.time+ni.inputDelay && loc.frames()-ni.sentT() < 32 {
+			ni.localUpdate()
+		}
+		// Wait if another machine is further behind than we can roll back
+		if loc.frames() > ni.time && ni.time-ni.received() < ni.rollback {
+			break
+		}
+		if sys.esc || !sys.await(FPS) || ni.st != NS_Playing {
+			return
+		}
+	}
+	ni.rollbackCorrect(ni.time)
+	// Round transitions are not rolled back, so the end of a round is played
+	// on confirmed inputs only
+	if sys.intro < 0 {
+		for ni.received() <= ni.time {
+			if sys.esc || !sys.await(FPS) || ni.st != NS_Playing {
+				return
+			}
+		}
+		ni.rollbackCorrect(ni.time)
+	}
+	ni.rb.save(ni.time)
+	conf := ni.received()
+	ni.setFrame(ni.time)
+	// A frame prepared with received inputs predicts nothing, so it is
+	// confirmed right away. Otherwise the last frame of a match never would be.
+	if ni.rb.checkT == ni.time && ni.time < conf {
+		ni.rb.checkT++
+	}
+	ni.time++
+	for ; ni.rb.repT < ni.rb.checkT; ni.rb.repT++ {
+		ni.confirmFrame(ni.rb.repT, ni.rb.sync[ni.rb.repT&31])
+	}
+}
+
+// Points the buffers at frame t, predicting the remote inputs that have not
+// arrived yet
+func (ni *NetInput) setFrame(t int32) {
+	ni.setCurT(t)
+	for _, s := range ni.remoteSlots() {
+		rem := &ni.buf[s]
+		if conf := rem.frames(); t < conf {
+			rem.pred[t&31] = rem.buf[t&31]
+		} else {
+			// Assume the remote player keeps holding their last input
+			rem.pred[t&31] = rem.buf[(conf-1)&31]
+		}
+	}
+}
+
+// Verifies the predictions of the frames simulated so far, which end before
+// frame end, and resimulates from the first one that was wrong
+func (ni *NetInput) rollbackCorrect(end int32) {
+	slots := ni.remoteSlots()
+	last := Min(ni.received(), end)
+	for t := ni.rb.checkT; t < last; t++ {
+		wrong := false
+		for _, s := range slots {
+			wrong = wrong || ni.buf[s].buf[t&31] != ni.buf[s].pred[t&31]
+		}
+		if !wrong {
+			continue
+		}
+		ni.rb.states[t&31].load()
+		sys.resimulating = true
+		for f := t; f < end; f++ {
+			if f > t {
+				ni.rb.save(f)
+			}
+			ni.setFrame(f)
+			sys.resimulate()
+		}
+		sys.resimulating = false
+		break
+	}
+	ni.rb.checkT = Max(ni.rb.checkT, last)
+}
+
+// Saves the state before frame t
+func (rb *Rollback) save(t int32) {
+	if rb.states[t&31] == nil {
+		rb.states[t&31] = &GameState{}
+	}
+	rb.states[t&31].save()
+	rb.sync[t&31] = nil
+	if t%stateHashInterval == 0 {
+		rb.sync[t&31] = newSyncState()
+	}
+}
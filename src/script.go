@@ -52,6 +52,15 @@ func userDataError(l *lua.LState, argi int, udtype interface{}) {
 	l.RaiseError("\nArgument %v is not a userdata of type: %T\n", argi, udtype)
 }
 
+// Returns the index of the training input slot numbered by argument argi
+func trainingSlotArg(l *lua.LState, argi int) int {
+	slot := int(numArg(l, argi))
+	if slot < 1 || slot > TrainingSlots {
+		l.RaiseError("\nInvalid input slot: %v\n", slot)
+	}
+	return slot - 1
+}
+
 // -------------------------------------------------------------------------------------------------
 // Register external functions to be called from Lua scripts
 func systemScriptInit(l *lua.LState) {
@@ -706,6 +715,31 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(newUserData(l, NewCommandList(NewCommandBuffer())))
 		return 1
 	})
+	luaRegister(l, "commandTest", func(l *lua.LState) int {
+		cl, warnings, err := loadCommandTest(strArg(l, 1))
+		if err != nil {
+			l.RaiseError(err.Error())
+		}
+		inputs, err := ParseInputScript(strArg(l, 2))
+		if err != nil {
+			l.RaiseError(err.Error())
+		}
+		tbl := l.NewTable()
+		for _, h := range cl.Test(inputs) {
+			t := l.NewTable()
+			t.RawSetString("frame", lua.LNumber(h.Frame))
+			t.RawSetString("name", lua.LString(h.Name))
+			t.RawSetString("def", lua.LNumber(h.Def))
+			tbl.Append(t)
+		}
+		wtbl := l.NewTable()
+		for _, w := range warnings {
+			wtbl.Append(lua.LString(w))
+		}
+		l.Push(tbl)
+		l.Push(wtbl)
+		return 2
+	})
 	luaRegister(l, "commonLuaInsert", func(l *lua.LState) int {
 		sys.commonLua = append(sys.commonLua, strArg(l, 1))
 		return 0
@@ -743,6 +777,12 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.netInput.IsConnected()))
 		return 1
 	})
+	luaRegister(l, "debugger", func(*lua.LState) int {
+		if sys.debugger != nil {
+			sys.debugger.exec(strArg(l, 1), consoleWriter{})
+		}
+		return 0
+	})
 	luaRegister(l, "dialogueReset", func(*lua.LState) int {
 		for _, p := range sys.chars {
 			if len(p) > 0 {
@@ -774,12 +814,36 @@ func systemScriptInit(l *lua.LState) {
 		return 0
 	})
 	luaRegister(l, "enterReplay", func(*lua.LState) int {
+		fi, err := OpenFileInput(strArg(l, 1))
+		if err != nil {
+			sys.errLog.Println(err.Error())
+			l.Push(lua.LBool(false))
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
 		if sys.vRetrace >= 0 {
 			sys.window.SetSwapInterval(1) // broken frame skipping when set to 0
 		}
 		sys.chars = [len(sys.chars)][]*Char{}
-		sys.fileInput = OpenFileInput(strArg(l, 1))
-		return 0
+		sys.fileInput = fi
+		l.Push(lua.LBool(true))
+		return 1
+	})
+	luaRegister(l, "enterSpectate", func(*lua.LState) int {
+		if sys.netInput != nil || sys.fileInput != nil {
+			l.RaiseError("\nConnection already established.\n")
+		}
+		fi, err := ConnectSpectator(strArg(l, 1))
+		if err != nil {
+			sys.errLog.Println(err.Error())
+			l.Push(lua.LBool(false))
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		sys.chars = [len(sys.chars)][]*Char{}
+		sys.fileInput = fi
+		l.Push(lua.LBool(true))
+		return 1
 	})
 	luaRegister(l, "esc", func(l *lua.LState) int {
 		if l.GetTop() >= 1 {
@@ -1127,6 +1191,12 @@ func systemScriptInit(l *lua.LState) {
 				tbl.RawSetString("p2tmode", lua.LNumber(sys.tmode[1]))
 				tbl.RawSetString("p1score", lua.LNumber(sc[0]))
 				tbl.RawSetString("p2score", lua.LNumber(sc[1]))
+				if sys.headless {
+					sys.printHeadlessResult(winp)
+				}
+				if sys.profiler != nil {
+					sys.profiler.finish()
+				}
 				sys.timerStart = 0
 				sys.timerRounds = []int32{}
 				sys.scoreStart = [2]float32{}
@@ -1389,6 +1459,21 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LNumber(sys.frameCounter))
 		return 1
 	})
+	luaRegister(l, "getInputSettings", func(*lua.LState) int {
+		is := localInputSettings(int(numArg(l, 1)) - 1)
+		tbl := l.NewTable()
+		tbl.RawSetString("SOCDResolution", lua.LNumber(is.SOCDResolution))
+		tbl.RawSetString("ButtonAssist", lua.LBool(is.ButtonAssist))
+		tbl.RawSetString("StickSensitivity", lua.LNumber(is.StickSensitivity))
+		tbl.RawSetString("SimpleSpecials", lua.LBool(is.SimpleSpecials))
+		tbl.RawSetString("Macros", lua.LBool(is.Macros))
+		l.Push(tbl)
+		return 1
+	})
+	luaRegister(l, "getJoystickGUID", func(*lua.LState) int {
+		l.Push(lua.LString(input.GetJoystickGUID(int(numArg(l, 1)))))
+		return 1
+	})
 	luaRegister(l, "getJoystickName", func(*lua.LState) int {
 		l.Push(lua.LString(input.GetJoystickName(int(numArg(l, 1)))))
 		return 1
@@ -1585,6 +1670,14 @@ func systemScriptInit(l *lua.LState) {
 		sys.loadStart()
 		return 0
 	})
+	luaRegister(l, "loadState", func(*lua.LState) int {
+		slot := int32(0)
+		if l.GetTop() >= 1 {
+			slot = int32(numArg(l, 1))
+		}
+		l.Push(lua.LBool(sys.loadState(slot)))
+		return 1
+	})
 	luaRegister(l, "numberToRune", func(l *lua.LState) int {
 		l.Push(lua.LString(fmt.Sprint('A' - 1 + int(numArg(l, 1)))))
 		return 1
@@ -1704,6 +1797,12 @@ func systemScriptInit(l *lua.LState) {
 		fmt.Println(strArg(l, 1))
 		return 0
 	})
+	luaRegister(l, "profilerSort", func(*lua.LState) int {
+		if sys.profiler != nil {
+			sys.profiler.nextSort()
+		}
+		return 0
+	})
 	luaRegister(l, "puts", func(*lua.LState) int {
 		fmt.Println(strArg(l, 1))
 		return 0
@@ -1737,12 +1836,44 @@ func systemScriptInit(l *lua.LState) {
 		sys.debugWC.unsetSCF(SCF_dizzy)
 		return 0
 	})
+	luaRegister(l, "replayInfo", func(*lua.LState) int {
+		fi := sys.fileInput
+		if fi == nil || fi.f == nil || !fi.fight() {
+			l.Push(lua.LNil)
+			return 1
+		}
+		tbl := l.NewTable()
+		tbl.RawSetString("frame", lua.LNumber(fi.position()))
+		tbl.RawSetString("frames", lua.LNumber(fi.index[fi.match].frames))
+		tbl.RawSetString("fps", lua.LNumber(FPS))
+		tbl.RawSetString("round", lua.LNumber(sys.round))
+		tbl.RawSetString("rounds", lua.LNumber(len(fi.index[fi.match].rounds)))
+		tbl.RawSetString("speed", lua.LNumber(sys.accel))
+		tbl.RawSetString("seeking", lua.LBool(fi.seeking()))
+		l.Push(tbl)
+		return 1
+	})
+	luaRegister(l, "replayNextFight", func(*lua.LState) int {
+		l.Push(lua.LBool(sys.fileInput != nil && sys.fileInput.selectFight()))
+		return 1
+	})
 	luaRegister(l, "replayRecord", func(*lua.LState) int {
 		if sys.netInput != nil {
-			sys.netInput.rep, _ = os.Create(strArg(l, 1))
+			var err error
+			if sys.netInput.rep, err = NewReplayWriter(strArg(l, 1)); err != nil {
+				sys.errLog.Println(err.Error())
+			}
 		}
 		return 0
 	})
+	luaRegister(l, "replaySeek", func(*lua.LState) int {
+		l.Push(lua.LBool(sys.fileInput != nil && sys.fileInput.seek(int32(numArg(l, 1)))))
+		return 1
+	})
+	luaRegister(l, "replaySeekRound", func(*lua.LState) int {
+		l.Push(lua.LBool(sys.fileInput != nil && sys.fileInput.seekRound(int32(numArg(l, 1)))))
+		return 1
+	})
 	luaRegister(l, "replayStop", func(*lua.LState) int {
 		if sys.netInput != nil && sys.netInput.rep != nil {
 			sys.netInput.rep.Close()
@@ -1789,6 +1920,14 @@ func systemScriptInit(l *lua.LState) {
 		sys.roundResetFlg = true
 		return 0
 	})
+	luaRegister(l, "saveState", func(*lua.LState) int {
+		slot := int32(0)
+		if l.GetTop() >= 1 {
+			slot = int32(numArg(l, 1))
+		}
+		sys.saveState(slot)
+		return 0
+	})
 	luaRegister(l, "screenshot", func(*lua.LState) int {
 		captureScreen()
 		return 0
@@ -1990,6 +2129,44 @@ func systemScriptInit(l *lua.LState) {
 		sys.home = tn - 1
 		return 0
 	})
+	// Takes a table with the same keys as the KeyConfig entries of config.json,
+	// any of which can be left out. The settings are also stored in the
+	// player's KeyConfig entry of the config table, which options.f_saveCfg
+	// writes to config.json.
+	luaRegister(l, "setInputSettings", func(*lua.LState) int {
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > len(sys.inputSettings) {
+			l.RaiseError("\nInvalid player number: %v\n", pn)
+		}
+		var kc *lua.LTable
+		if cfg, ok := l.GetGlobal("config").(*lua.LTable); ok {
+			if kcs, ok := cfg.RawGetString("KeyConfig").(*lua.LTable); ok {
+				kc, _ = kcs.RawGetInt(pn).(*lua.LTable)
+			}
+		}
+		is := &sys.inputSettings[pn-1]
+		tableArg(l, 2).ForEach(func(key, value lua.LValue) {
+			var v lua.LValue
+			switch lua.LVAsString(key) {
+			case "SOCDResolution":
+				is.SOCDResolution = Clamp(int32(lua.LVAsNumber(value)), 0, 4)
+				v = lua.LNumber(is.SOCDResolution)
+			case "ButtonAssist":
+				is.ButtonAssist = lua.LVAsBool(value)
+				v = lua.LBool(is.ButtonAssist)
+			case "StickSensitivity":
+				is.StickSensitivity = float32(lua.LVAsNumber(value))
+				v = lua.LNumber(lua.LVAsNumber(value))
+			case "SimpleSpecials":
+				is.SimpleSpecials = lua.LVAsBool(value)
+				v = lua.LBool(is.SimpleSpecials)
+			}
+			if v != nil && kc != nil {
+				kc.RawSetString(lua.LVAsString(key), v)
+			}
+		})
+		return 0
+	})
 	luaRegister(l, "setKeyConfig", func(l *lua.LState) int {
 		pn := int(numArg(l, 1))
 		joy := int(numArg(l, 2))
@@ -2601,6 +2778,18 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "toggleFrameData", func(*lua.LState) int {
+		if l.GetTop() < 1 || boolArg(l, 1) != sys.frameData.enabled {
+			sys.frameData.Toggle()
+		}
+		return 0
+	})
+	luaRegister(l, "toggleInputHistory", func(*lua.LState) int {
+		if l.GetTop() < 1 || boolArg(l, 1) != sys.inputHistory.enabled {
+			sys.inputHistory.Toggle()
+		}
+		return 0
+	})
 	luaRegister(l, "toggleMaxPowerMode", func(*lua.LState) int {
 		if l.GetTop() >= 1 {
 			sys.maxPowerMode = boolArg(l, 1)
@@ -2654,6 +2843,27 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "toggleProfiler", func(*lua.LState) int {
+		if sys.profiler == nil {
+			return 0
+		}
+		if l.GetTop() >= 1 && !boolArg(l, 1) {
+			sys.profiler.page = 0
+		} else {
+			sys.profiler.nextPage()
+		}
+		return 0
+	})
+	luaRegister(l, "toggleReplayTimeline", func(*lua.LState) int {
+		if sys.fileInput != nil {
+			if l.GetTop() >= 1 {
+				sys.fileInput.timeline = boolArg(l, 1)
+			} else {
+				sys.fileInput.timeline = !sys.fileInput.timeline
+			}
+		}
+		return 0
+	})
 	luaRegister(l, "toggleStatusDraw", func(*lua.LState) int {
 		if l.GetTop() >= 1 {
 			sys.statusDraw = boolArg(l, 1)
@@ -2673,6 +2883,52 @@ func systemScriptInit(l *lua.LState) {
 		sys.window.SetSwapInterval(sys.vRetrace)
 		return 0
 	})
+	luaRegister(l, "trainingInputLength", func(*lua.LState) int {
+		slot := trainingSlotArg(l, 1)
+		l.Push(lua.LNumber(len(sys.trainingInput.slots[slot])))
+		return 1
+	})
+	luaRegister(l, "trainingInputPlay", func(*lua.LState) int {
+		pn, slot := int(numArg(l, 1)), trainingSlotArg(l, 2)
+		var mode TrainingPlayback
+		if l.GetTop() >= 3 {
+			switch strArg(l, 3) {
+			case "once":
+				mode = TP_Once
+			case "loop":
+				mode = TP_Loop
+			case "random":
+				mode = TP_Random
+			default:
+				l.RaiseError("\nInvalid playback mode: %v\n", strArg(l, 3))
+			}
+		}
+		l.Push(lua.LBool(pn >= 1 && pn <= len(sys.chars) &&
+			sys.trainingInput.Play(pn-1, slot, mode)))
+		return 1
+	})
+	luaRegister(l, "trainingInputRecord", func(*lua.LState) int {
+		pn, slot := int(numArg(l, 1)), trainingSlotArg(l, 2)
+		if pn >= 1 && pn <= len(sys.chars) {
+			sys.trainingInput.Record(pn-1, slot)
+		}
+		return 0
+	})
+	luaRegister(l, "trainingInputState", func(*lua.LState) int {
+		switch {
+		case sys.trainingInput.Recording():
+			l.Push(lua.LString("record"))
+		case sys.trainingInput.Playing():
+			l.Push(lua.LString("play"))
+		default:
+			l.Push(lua.LString(""))
+		}
+		return 1
+	})
+	luaRegister(l, "trainingInputStop", func(*lua.LState) int {
+		sys.trainingInput.Stop()
+		return 0
+	})
 	luaRegister(l, "updateVolume", func(l *lua.LState) int {
 		if l.GetTop() >= 1 {
 			sys.bgm.bgmVolume = int(Min(int32(numArg(l, 1)), int32(sys.maxBgmVolume)))
@@ -12,7 +12,6 @@ import (
 
 	"github.com/ikemen-engine/beep/midi"
 	"github.com/ikemen-engine/beep/mp3"
-	"github.com/ikemen-engine/beep/speaker"
 	"github.com/ikemen-engine/beep/vorbis"
 	"github.com/ikemen-engine/beep/wav"
 )
@@ -178,12 +177,12 @@ func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd,
 	bgm.freqmul = freqmul
 	// Starve the current music streamer
 	if bgm.ctrl != nil {
-		speaker.Lock()
+		speakerLock()
 		bgm.ctrl.Streamer = nil
-		speaker.Unlock()
+		speakerUnlock()
 	}
 	// Special value "" is used to stop music
-	if filename == "" {
+	if filename == "" || sys.headless {
 		return
 	}
 
@@ -236,7 +235,7 @@ func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd,
 	bgm.ctrl = &beep.Ctrl{Streamer: resampler}
 	bgm.UpdateVolume()
 	bgm.streamer.Seek(startPosition)
-	speaker.Play(bgm.ctrl)
+	speakerPlay(bgm.ctrl)
 }
 
 func loadSoundFont(filename string) (*midi.SoundFont, error) {
@@ -256,9 +255,9 @@ func (bgm *Bgm) SetPaused(pause bool) {
 	if bgm.ctrl == nil || bgm.ctrl.Paused == pause {
 		return
 	}
-	speaker.Lock()
+	speakerLock()
 	bgm.ctrl.Paused = pause
-	speaker.Unlock()
+	speakerUnlock()
 }
 
 func (bgm *Bgm) UpdateVolume() {
@@ -272,10 +271,10 @@ func (bgm *Bgm) UpdateVolume() {
 	}
 	volume := -5 + float64(sys.bgmVolume)*0.06*(float64(sys.masterVolume)/100)*(float64(bgm.bgmVolume)/100)
 	silent := volume <= -5
-	speaker.Lock()
+	speakerLock()
 	bgm.volctrl.Volume = volume
 	bgm.volctrl.Silent = silent
-	speaker.Unlock()
+	speakerUnlock()
 }
 
 func (bgm *Bgm) SetFreqMul(freqmul float32) {
@@ -284,10 +283,10 @@ func (bgm *Bgm) SetFreqMul(freqmul float32) {
 			srcRate := bgm.sampleRate
 			dstRate := beep.SampleRate(audioFrequency / freqmul)
 			if resampler, ok := bgm.ctrl.Streamer.(*beep.Resampler); ok {
-				speaker.Lock()
+				speakerLock()
 				resampler.SetRatio(float64(srcRate) / float64(dstRate))
 				bgm.freqmul = freqmul
-				speaker.Unlock()
+				speakerUnlock()
 			}
 		}
 	}
@@ -297,33 +296,33 @@ func (bgm *Bgm) SetLoopPoints(bgmLoopStart int, bgmLoopEnd int) {
 	// Set both at once, why not
 	if sl, ok := bgm.volctrl.Streamer.(*StreamLooper); ok {
 		if sl.loopstart != bgmLoopStart && sl.loopend != bgmLoopEnd {
-			speaker.Lock()
+			speakerLock()
 			sl.loopstart = bgmLoopStart
 			sl.loopend = bgmLoopEnd
-			speaker.Unlock()
+			speakerUnlock()
 			// Set one at a time
 		} else {
 			if sl.loopstart != bgmLoopStart {
-				speaker.Lock()
+				speakerLock()
 				sl.loopstart = bgmLoopStart
-				speaker.Unlock()
+				speakerUnlock()
 			} else if sl.loopend != bgmLoopEnd {
-				speaker.Lock()
+				speakerLock()
 				sl.loopend = bgmLoopEnd
-				speaker.Unlock()
+				speakerUnlock()
 			}
 		}
 	}
 }
 
 func (bgm *Bgm) Seek(positionSample int) {
-	speaker.Lock()
+	speakerLock()
 	// Reset to 0 if out of range
 	if positionSample < 0 || positionSample > bgm.streamer.Len() {
 		positionSample = 0
 	}
 	bgm.streamer.Seek(positionSample)
-	speaker.Unlock()
+	speakerUnlock()
 }
 
 // ------------------------------------------------------------------
@@ -466,6 +465,9 @@ func (s *Snd) Get(gn [2]int32) *Sound {
 	return s.table[gn]
 }
 func (s *Snd) play(gn [2]int32, volumescale int32, pan float32, loopstart, loopend, startposition int) bool {
+	if sys.resimulating {
+		return false
+	}
 	sound := s.Get(gn)
 	return sys.soundChannels.Play(sound, volumescale, pan, loopstart, loopend, startposition)
 }
@@ -542,7 +544,7 @@ type SoundChannel struct {
 }
 
 func (s *SoundChannel) Play(sound *Sound, loop int32, freqmul float32, loopStart, loopEnd, startPosition int) {
-	if sound == nil {
+	if sound == nil || sys.headless {
 		return
 	}
 	s.sound = sound
@@ -569,15 +571,15 @@ func (s *SoundChannel) SetPaused(pause bool) {
 	if s.ctrl == nil || s.ctrl.Paused == pause {
 		return
 	}
-	speaker.Lock()
+	speakerLock()
 	s.ctrl.Paused = pause
-	speaker.Unlock()
+	speakerUnlock()
 }
 func (s *SoundChannel) Stop() {
 	if s.ctrl != nil {
-		speaker.Lock()
+		speakerLock()
 		s.ctrl.Streamer = nil
-		speaker.Unlock()
+		speakerUnlock()
 	}
 	s.sound = nil
 }
@@ -609,10 +611,10 @@ func (s *SoundChannel) SetFreqMul(freqmul float32) {
 			srcRate := s.sound.format.SampleRate
 			dstRate := beep.SampleRate(audioFrequency / freqmul)
 			if resampler, ok := s.ctrl.Streamer.(*beep.Resampler); ok {
-				speaker.Lock()
+				speakerLock()
 				resampler.SetRatio(float64(srcRate) / float64(dstRate))
 				s.sfx.freqmul = freqmul
-				speaker.Unlock()
+				speakerUnlock()
 			}
 		}
 	}
@@ -621,20 +623,20 @@ func (s *SoundChannel) SetLoopPoints(loopstart, loopend int) {
 	// Set both at once, why not
 	if sl, ok := s.sfx.streamer.(*StreamLooper); ok {
 		if sl.loopstart != loopstart && sl.loopend != loopend {
-			speaker.Lock()
+			speakerLock()
 			sl.loopstart = loopstart
 			sl.loopend = loopend
-			speaker.Unlock()
+			speakerUnlock()
 			// Set one at a time
 		} else {
 			if sl.loopstart != loopstart {
-				speaker.Lock()
+				speakerLock()
 				sl.loopstart = loopstart
-				speaker.Unlock()
+				speakerUnlock()
 			} else if sl.loopend != loopend {
-				speaker.Lock()
+				speakerLock()
 				sl.loopend = loopend
-				speaker.Unlock()
+				speakerUnlock()
 			}
 		}
 	}
@@ -0,0 +1,25 @@
+//go:build headless
+
+package main
+
+import (
+	"github.com/ikemen-engine/beep"
+)
+
+// Headless builds play no sound, so that they do not need the audio libraries
+// of the system. Nothing reads the streamers, so there is nothing to lock.
+
+func speakerInit(s beep.Streamer) {
+}
+
+func speakerPlay(s beep.Streamer) {
+}
+
+func speakerLock() {
+}
+
+func speakerUnlock() {
+}
+
+func speakerClose() {
+}
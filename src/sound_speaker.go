@@ -0,0 +1,32 @@
+//go:build !headless
+
+package main
+
+import (
+	"github.com/ikemen-engine/beep"
+	"github.com/ikemen-engine/beep/speaker"
+)
+
+// The sound output, through the audio device of the system
+
+func speakerInit(s beep.Streamer) {
+	speaker.Init(audioFrequency, audioOutLen)
+	speaker.Play(s)
+}
+
+func speakerPlay(s beep.Streamer) {
+	speaker.Play(s)
+}
+
+// Locks the streamers being played against the audio thread
+func speakerLock() {
+	speaker.Lock()
+}
+
+func speakerUnlock() {
+	speaker.Unlock()
+}
+
+func speakerClose() {
+	speaker.Close()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Spectators watch a netplay session from the host's machine. The host sends
+// them the same chunks it would write to a replay file, one input frame per
+// chunk, starting with everything sent since the session began so that they
+// can join at any time. They play the stream back with FileInput, a number of
+// frames behind the host so that network hiccups do not stall playback.
+//
+// Playback follows the host through the menus from the start of the session,
+// so there is no later point to join from. Once the stream outgrows
+// spectatorHistory it is no longer kept, and spectators that join after that
+// are turned away.
+
+const (
+	// Data queued for a spectator beyond which they are dropped
+	spectatorQueue = 1024
+	// Time allowed to connect to the host and receive the replay header
+	spectatorTimeout = 5 * time.Second
+	// Size of the stream kept for spectators that join late, which holds a
+	// few hours of a session
+	spectatorHistory = 32 << 20
+)
+
+// SpectatorServer accepts spectators on the host and sends them the stream
+type SpectatorServer struct {
+	ln      *net.TCPListener
+	mu      sync.Mutex
+	history bytes.Buffer
+	full    bool // The history outgrew spectatorHistory and was dropped
+	clients []*spectatorClient
+}
+
+type spectatorClient struct {
+	conn *net.TCPConn
+	out  chan []byte
+}
+
+func NewSpectatorServer(port string) (*SpectatorServer, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	ss := &SpectatorServer{ln: ln.(*net.TCPListener)}
+	go ss.accept()
+	return ss, nil
+}
+
+func (ss *SpectatorServer) accept() {
+	for {
+		conn, err := ss.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		ss.mu.Lock()
+		if ss.full {
+			ss.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		c := &spectatorClient{conn: conn, out: make(chan []byte, spectatorQueue)}
+		c.out <- append([]byte(nil), ss.history.Bytes()...)
+		ss.clients = append(ss.clients, c)
+		ss.mu.Unlock()
+		go c.send()
+	}
+}
+
+func (c *spectatorClient) send() {
+	for b := range c.out {
+		if _, err := c.conn.Write(b); err != nil {
+			break
+		}
+	}
+	c.conn.Close()
+}
+
+// Sends p to every spectator, dropping the ones that can not keep up
+func (ss *SpectatorServer) Write(p []byte) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.full {
+		if ss.history.Len()+len(p) > spectatorHistory {
+			sys.errLog.Println("Spectator stream too long to keep, no more spectators can join")
+			ss.history, ss.full = bytes.Buffer{}, true
+		} else {
+			ss.history.Write(p)
+		}
+	}
+	b := append([]byte(nil), p...)
+	clients := ss.clients[:0]
+	for _, c := range ss.clients {
+		select {
+		case c.out <- b:
+			clients = append(clients, c)
+		default:
+			close(c.out)
+		}
+	}
+	ss.clients = clients
+	return len(p), nil
+}
+
+// Stops accepting spectators. The connected ones are closed once they have
+// been sent everything written so far.
+func (ss *SpectatorServer) Close() error {
+	err := ss.ln.Close()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, c := range ss.clients {
+		close(c.out)
+	}
+	ss.clients = nil
+	return err
+}
+
+type replayChunk struct {
+	tag  string
+	data []byte
+}
+
+// Chunks received from the host, buffered until playback reaches them
+type spectatorStream struct {
+	r         io.Reader
+	mu        sync.Mutex
+	chunks    []replayChunk
+	frames    int32 // Number of input frames in chunks
+	err       error
+	delay     int32 // Frames to buffer before playback starts or resumes
+	buffering bool
+	catchUp   bool
+}
+
+// Connects to a host as a spectator. The address is the host, optionally
+// followed by the port.
+func ConnectSpectator(addr string) (*FileInput, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if sys.netplaySpectatorPort == "" {
+			return nil, Error("Spectator address " + addr + " needs a port, as NetplaySpectatorPort is not set")
+		}
+		addr = net.JoinHostPort(addr, sys.netplaySpectatorPort)
+	}
+	conn, err := net.DialTimeout("tcp", addr, spectatorTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(spectatorTimeout))
+	if _, err := readReplayHeader(r); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	ls := &spectatorStream{r: r, delay: sys.netplaySpectatorDelay, buffering: true}
+	go ls.receive()
+	return &FileInput{f: conn, live: ls, match: -1, seekFrame: -1, desync: -1}, nil
+}
+
+func (ls *spectatorStream) receive() {
+	for {
+		tag, data, err := readReplayChunk(ls.r)
+		ls.mu.Lock()
+		if err != nil {
+			ls.err = err
+			ls.mu.Unlock()
+			return
+		}
+		ls.chunks = append(ls.chunks, replayChunk{tag, data})
+		ls.frames += chunkFrameCount(tag, data)
+		ls.mu.Unlock()
+	}
+}
+
+func chunkFrameCount(tag string, data []byte) int32 {
+	if tag != rcInput || len(data) < 4 {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(data))
+}
+
+// Returns the next chunk. When the buffer runs out, playback waits until the
+// host is delay frames ahead again.
+func (ls *spectatorStream) next() (tag string, data []byte, err error) {
+	for {
+		ls.mu.Lock()
+		if len(ls.chunks) == 0 {
+			ls.buffering = true
+		} else if !ls.buffering || ls.frames > ls.delay || ls.err != nil {
+			c := ls.chunks[0]
+			ls.chunks = ls.chunks[1:]
+			ls.frames -= chunkFrameCount(c.tag, c.data)
+			ls.buffering = false
+			ls.mu.Unlock()
+			return c.tag, c.data, nil
+		}
+		err = ls.err
+		ls.mu.Unlock()
+		if err != nil {
+			return "", nil, err
+		}
+		if sys.esc || !sys.await(FPS) {
+			return "", nil, io.EOF
+		}
+	}
+}
+
+// Whether playback has fallen behind the host, after joining late or a
+// stall, and should skip rendering until it is back to the configured delay
+func (ls *spectatorStream) catchingUp() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.frames > ls.delay+int32(FPS) {
+		ls.catchUp = true
+	} else if ls.frames <= ls.delay {
+		ls.catchUp = false
+	}
+	return ls.catchUp
+}
@@ -0,0 +1,707 @@
+package main
+
+import lua "github.com/yuin/gopher-lua"
+
+// GameState is a snapshot of everything the match simulation reads and
+// writes. Loading a state writes the saved values back into the same objects
+// they were taken from, so pointers shared between chars, helpers,
+// projectiles and explods stay valid and a state can be loaded more than once.
+type GameState struct {
+	// System variables
+	randseed           int32
+	gameTime           int32
+	round              int32
+	intro              int32
+	time               int32
+	lastHitter         [2]int
+	winTeam            int
+	winType            [2]WinType
+	winTrigger         [2]WinType
+	wins               [2]int32
+	roundsExisted      [2]int32
+	draws              int32
+	firstAttack        [3]int
+	teamLeader         [2]int
+	introSkipped       bool
+	specialFlag        GlobalSpecialFlag
+	envShake           EnvShake
+	pause              int32
+	pausetime          int32
+	pausebg            bool
+	pauseendcmdbuftime int32
+	pauseplayer        int
+	super              int32
+	supertime          int32
+	superpausebg       bool
+	superendcmdbuftime int32
+	superplayer        int
+	superdarken        bool
+	superanim          *Animation
+	superpmap          PalFX
+	superpos           [2]float32
+	superfacing        float32
+	superp2defmul      float32
+	envcol             [3]int32
+	envcol_time        int32
+	envcol_under       bool
+	brightness         int32
+	allPalFX, bgPalFX  PalFX
+	nextCharId         int32
+	tickCount          int
+	oldTickCount       int
+	tickCountF         float32
+	lastTick           float32
+	nextAddTime        float32
+	oldNextAddTime     float32
+	turbo              float32
+	accel              float32
+	screenleft         float32
+	screenright        float32
+	xmin, xmax         float32
+	winskipped         bool
+	drawScale          float32
+	zoomlag            float32
+	zoomScale          float32
+	zoomPosXLag        float32
+	zoomPosYLag        float32
+	enableZoomtime     int32
+	zoomCameraBound    bool
+	zoomStageBound     bool
+	zoomPos            [2]float32
+	cam                Camera
+	finish             FinishType
+	waitdown           int32
+	slowtime           int32
+	shuttertime        int32
+	fadeintime         int32
+	fadeouttime        int32
+	wintime            int32
+	changeStateNest    int32
+	dialogueFlg        bool
+	dialogueForce      int
+	dialogueBarsFlg    bool
+	aiInput            [MaxSimul*2 + MaxAttachedChar]AiInput
+	cgi                [MaxSimul*2 + MaxAttachedChar]cgiState
+	// Results of the rounds played so far
+	timerCount  []int32
+	timerRounds []int32
+	scoreRounds [][2]float32
+	// Characters and the objects they share
+	chars      [MaxSimul*2 + MaxAttachedChar][]*Char
+	charList   CharList
+	charData   map[*Char]charState
+	palfx      map[*PalFX]PalFX
+	anims      map[*Animation]Animation
+	hitScales  map[*HitScale]HitScale
+	cmdBuffers map[*CommandBuffer]CommandBuffer
+	inputs     map[*InputReader]InputReader
+	commands   map[*CommandList]savedCommands
+	persistent [][2][]int32 // Negative state persistent counters, live and saved
+	saves      uint32       // Number of times the state was saved
+	// Projectiles and explods
+	projs             [MaxSimul*2 + MaxAttachedChar][]Projectile
+	explods           [MaxSimul*2 + MaxAttachedChar][]Explod
+	explDrawlist      [MaxSimul*2 + MaxAttachedChar][]int
+	topexplDrawlist   [MaxSimul*2 + MaxAttachedChar][]int
+	underexplDrawlist [MaxSimul*2 + MaxAttachedChar][]int
+	// Stage
+	stage      *Stage
+	stageVars  Stage
+	stageTime  int32
+	stageBga   bgAction
+	bgs        []backGround
+	bgCtrls    []bgCtrl
+	bgctLine   []bgctNode
+	bgctActive []*bgCtrl
+	// Lifebar counters
+	roundCur                   int32
+	roundWt, roundSwt, roundDt [4]int32
+	roundTimerActive           bool
+	roundIntroState            [2]bool
+	combo                      [2]comboState
+	scorePoints                [2]float32
+	winCount                   [2]int32
+}
+
+// Commands of a command list, tagged with the save they were taken by so
+// that the buffers can be kept from one save to the next
+type savedCommands struct {
+	save uint32
+	cmds [][]Command
+}
+
+// Per player values from CharGlobalInfo that change during a match
+type cgiState struct {
+	pctype      ProjContact
+	pctime      int32
+	pcid        int32
+	projidcount int
+}
+
+type comboState struct {
+	cur, old, curd, oldd int32
+	curp, oldp           float32
+	resttime             int32
+	counterX             float32
+	shaketime            int32
+	combo                int32
+}
+
+type charState struct {
+	val Char
+	// The map the char used when saved. Animations may reference it, so it is
+	// refilled rather than replaced on load.
+	remapSpr RemapPreset
+}
+
+// Copies the current match state into the snapshot
+func (gs *GameState) save() {
+	s := &sys
+	gs.randseed = s.randseed
+	gs.gameTime = s.gameTime
+	gs.round = s.round
+	gs.intro = s.intro
+	gs.time = s.time
+	gs.lastHitter = s.lastHitter
+	gs.winTeam = s.winTeam
+	gs.winType = s.winType
+	gs.winTrigger = s.winTrigger
+	gs.wins = s.wins
+	gs.roundsExisted = s.roundsExisted
+	gs.draws = s.draws
+	gs.firstAttack = s.firstAttack
+	gs.teamLeader = s.teamLeader
+	gs.introSkipped = s.introSkipped
+	gs.specialFlag = s.specialFlag
+	gs.envShake = s.envShake
+	gs.pause = s.pause
+	gs.pausetime = s.pausetime
+	gs.pausebg = s.pausebg
+	gs.pauseendcmdbuftime = s.pauseendcmdbuftime
+	gs.pauseplayer = s.pauseplayer
+	gs.super = s.super
+	gs.supertime = s.supertime
+	gs.superpausebg = s.superpausebg
+	gs.superendcmdbuftime = s.superendcmdbuftime
+	gs.superplayer = s.superplayer
+	gs.superdarken = s.superdarken
+	gs.superanim = s.superanim
+	gs.superpmap = s.superpmap.clone()
+	gs.superpos = s.superpos
+	gs.superfacing = s.superfacing
+	gs.superp2defmul = s.superp2defmul
+	gs.envcol = s.envcol
+	gs.envcol_time = s.envcol_time
+	gs.envcol_under = s.envcol_under
+	gs.brightness = s.brightness
+	gs.allPalFX = s.allPalFX.clone()
+	gs.bgPalFX = s.bgPalFX.clone()
+	gs.nextCharId = s.nextCharId
+	gs.tickCount = s.tickCount
+	gs.oldTickCount = s.oldTickCount
+	gs.tickCountF = s.tickCountF
+	gs.lastTick = s.lastTick
+	gs.nextAddTime = s.nextAddTime
+	gs.oldNextAddTime = s.oldNextAddTime
+	gs.turbo = s.turbo
+	gs.accel = s.accel
+	gs.screenleft = s.screenleft
+	gs.screenright = s.screenright
+	gs.xmin, gs.xmax = s.xmin, s.xmax
+	gs.winskipped = s.winskipped
+	gs.drawScale = s.drawScale
+	gs.zoomlag = s.zoomlag
+	gs.zoomScale = s.zoomScale
+	gs.zoomPosXLag = s.zoomPosXLag
+	gs.zoomPosYLag = s.zoomPosYLag
+	gs.enableZoomtime = s.enableZoomtime
+	gs.zoomCameraBound = s.zoomCameraBound
+	gs.zoomStageBound = s.zoomStageBound
+	gs.zoomPos = s.zoomPos
+	gs.cam = s.cam
+	gs.finish = s.finish
+	gs.waitdown = s.waitdown
+	gs.slowtime = s.slowtime
+	gs.shuttertime = s.shuttertime
+	gs.fadeintime = s.fadeintime
+	gs.fadeouttime = s.fadeouttime
+	gs.wintime = s.wintime
+	gs.changeStateNest = s.changeStateNest
+	gs.dialogueFlg = s.dialogueFlg
+	gs.dialogueForce = s.dialogueForce
+	gs.dialogueBarsFlg = s.dialogueBarsFlg
+	gs.aiInput = s.aiInput
+	for i := range s.cgi {
+		gs.cgi[i] = cgiState{s.cgi[i].pctype, s.cgi[i].pctime, s.cgi[i].pcid,
+			s.cgi[i].projidcount}
+	}
+	gs.timerCount = append(gs.timerCount[:0], s.timerCount...)
+	gs.timerRounds = append(gs.timerRounds[:0], s.timerRounds...)
+	gs.scoreRounds = append(gs.scoreRounds[:0], s.scoreRounds...)
+
+	// Rollback saves every frame, so the maps and slices of the previous save
+	// are emptied and filled again instead of allocating new ones
+	gs.clearMaps()
+	gs.saves++
+	gs.persistent = gs.persistent[:0]
+	gs.saveAnim(s.superanim)
+	for i, p := range s.chars {
+		gs.chars[i] = append(gs.chars[i][:0], p...)
+		for _, c := range p {
+			gs.saveChar(c)
+		}
+		for no, sb := range s.cgi[i].states {
+			if no < 0 && len(sb.ctrlsps) > 0 {
+				if n := len(gs.persistent); n < cap(gs.persistent) {
+					gs.persistent = gs.persistent[:n+1]
+				} else {
+					gs.persistent = append(gs.persistent, [2][]int32{})
+				}
+				ps := &gs.persistent[len(gs.persistent)-1]
+				ps[0], ps[1] = sb.ctrlsps, append(ps[1][:0], sb.ctrlsps...)
+			}
+		}
+	}
+	// Commands of chars that are gone are not kept
+	for cl, sc := range gs.commands {
+		if sc.save != gs.saves {
+			delete(gs.commands, cl)
+		}
+	}
+	s.charList.copyTo(&gs.charList)
+	for i := range s.projs {
+		gs.projs[i] = append(gs.projs[i][:0], s.projs[i]...)
+		for j := range s.projs[i] {
+			p := &s.projs[i][j]
+			gs.projs[i][j].aimg = p.aimg.clone()
+			gs.saveAnim(p.ani)
+			gs.savePalFX(p.palfx)
+		}
+		gs.explods[i] = append(gs.explods[i][:0], s.explods[i]...)
+		for j := range s.explods[i] {
+			gs.saveAnim(s.explods[i][j].anim)
+			gs.savePalFX(s.explods[i][j].palfx)
+		}
+		gs.explDrawlist[i] = append(gs.explDrawlist[i][:0], s.explDrawlist[i]...)
+		gs.topexplDrawlist[i] = append(gs.topexplDrawlist[i][:0], s.topexplDrawlist[i]...)
+		gs.underexplDrawlist[i] = append(gs.underexplDrawlist[i][:0], s.underexplDrawlist[i]...)
+	}
+
+	gs.stage = s.stage
+	gs.stageVars.copyStageVars(s.stage)
+	gs.stageTime = s.stage.stageTime
+	gs.stageBga = s.stage.bga
+	gs.bgs = gs.bgs[:0]
+	for _, b := range s.stage.bg {
+		gs.bgs = append(gs.bgs, *b)
+		gs.savePalFX(b.palfx)
+	}
+	gs.bgCtrls = append(gs.bgCtrls[:0], s.stage.bgc...)
+	gs.bgctLine = cloneTimeLine(s.stage.bgct.line)
+	gs.bgctActive = append(gs.bgctActive[:0], s.stage.bgct.al...)
+
+	ro := s.lifebar.ro
+	gs.roundCur, gs.roundWt, gs.roundSwt, gs.roundDt = ro.cur, ro.wt, ro.swt, ro.dt
+	gs.roundTimerActive, gs.roundIntroState = ro.timerActive, ro.introState
+	for i, co := range s.lifebar.co {
+		gs.combo[i] = comboState{co.cur, co.old, co.curd, co.oldd, co.curp, co.oldp,
+			co.resttime, co.counterX, co.shaketime, co.combo}
+	}
+	for i := range gs.scorePoints {
+		gs.scorePoints[i] = s.lifebar.sc[i].scorePoints
+		gs.winCount[i] = s.lifebar.wc[i].wins
+	}
+}
+
+// Empties the maps of the objects shared between chars. The saved commands
+// are kept, as their buffers are reused by the next save.
+func (gs *GameState) clearMaps() {
+	if gs.charData == nil {
+		gs.charData = make(map[*Char]charState)
+		gs.palfx = make(map[*PalFX]PalFX)
+		gs.anims = make(map[*Animation]Animation)
+		gs.hitScales = make(map[*HitScale]HitScale)
+		gs.cmdBuffers = make(map[*CommandBuffer]CommandBuffer)
+		gs.inputs = make(map[*InputReader]InputReader)
+		gs.commands = make(map[*CommandList]savedCommands)
+		return
+	}
+	for k := range gs.charData {
+		delete(gs.charData, k)
+	}
+	for k := range gs.palfx {
+		delete(gs.palfx, k)
+	}
+	for k := range gs.anims {
+		delete(gs.anims, k)
+	}
+	for k := range gs.hitScales {
+		delete(gs.hitScales, k)
+	}
+	for k := range gs.cmdBuffers {
+		delete(gs.cmdBuffers, k)
+	}
+	for k := range gs.inputs {
+		delete(gs.inputs, k)
+	}
+}
+
+func (gs *GameState) saveChar(c *Char) {
+	if _, ok := gs.charData[c]; ok {
+		return
+	}
+	gs.charData[c] = charState{c.clone(), c.remapSpr}
+	gs.savePalFX(c.palfx)
+	gs.saveAnim(c.anim)
+	for _, hs := range c.defaultHitScale {
+		gs.saveHitScale(hs)
+	}
+	for _, m := range [...]map[int32][3]*HitScale{c.nextHitScale, c.activeHitScale} {
+		for _, a := range m {
+			for _, hs := range a {
+				gs.saveHitScale(hs)
+			}
+		}
+	}
+	for i := range c.cmd {
+		cl := &c.cmd[i]
+		sc := gs.commands[cl]
+		if sc.save == gs.saves {
+			continue
+		}
+		gs.commands[cl] = savedCommands{gs.saves, copyCommands(sc.cmds, cl.Commands)}
+		if cl.Buffer != nil {
+			gs.cmdBuffers[cl.Buffer] = *cl.Buffer
+			if ir := cl.Buffer.InputReader; ir != nil {
+				gs.inputs[ir] = *ir
+			}
+		}
+	}
+}
+
+func (gs *GameState) savePalFX(pfx *PalFX) {
+	if pfx != nil {
+		if _, ok := gs.palfx[pfx]; !ok {
+			gs.palfx[pfx] = pfx.clone()
+		}
+	}
+}
+
+func (gs *GameState) saveAnim(a *Animation) {
+	if a != nil {
+		if _, ok := gs.anims[a]; !ok {
+			gs.anims[a] = *a
+		}
+	}
+}
+
+func (gs *GameState) saveHitScale(hs *HitScale) {
+	if hs != nil {
+		gs.hitScales[hs] = *hs
+	}
+}
+
+// Writes the snapshot back into the running match
+func (gs *GameState) load() {
+	s := &sys
+	s.randseed = gs.randseed
+	s.gameTime = gs.gameTime
+	s.round = gs.round
+	s.intro = gs.intro
+	s.time = gs.time
+	s.lastHitter = gs.lastHitter
+	s.winTeam = gs.winTeam
+	s.winType = gs.winType
+	s.winTrigger = gs.winTrigger
+	s.wins = gs.wins
+	s.roundsExisted = gs.roundsExisted
+	s.draws = gs.draws
+	s.firstAttack = gs.firstAttack
+	s.teamLeader = gs.teamLeader
+	s.introSkipped = gs.introSkipped
+	s.specialFlag = gs.specialFlag
+	s.envShake = gs.envShake
+	s.pause = gs.pause
+	s.pausetime = gs.pausetime
+	s.pausebg = gs.pausebg
+	s.pauseendcmdbuftime = gs.pauseendcmdbuftime
+	s.pauseplayer = gs.pauseplayer
+	s.super = gs.super
+	s.supertime = gs.supertime
+	s.superpausebg = gs.superpausebg
+	s.superendcmdbuftime = gs.superendcmdbuftime
+	s.superplayer = gs.superplayer
+	s.superdarken = gs.superdarken
+	s.superanim = gs.superanim
+	s.superpmap = gs.superpmap.clone()
+	s.superpos = gs.superpos
+	s.superfacing = gs.superfacing
+	s.superp2defmul = gs.superp2defmul
+	s.envcol = gs.envcol
+	s.envcol_time = gs.envcol_time
+	s.envcol_under = gs.envcol_under
+	s.brightness = gs.brightness
+	s.allPalFX = gs.allPalFX.clone()
+	s.bgPalFX = gs.bgPalFX.clone()
+	s.nextCharId = gs.nextCharId
+	s.tickCount = gs.tickCount
+	s.oldTickCount = gs.oldTickCount
+	s.tickCountF = gs.tickCountF
+	s.lastTick = gs.lastTick
+	s.nextAddTime = gs.nextAddTime
+	s.oldNextAddTime = gs.oldNextAddTime
+	s.turbo = gs.turbo
+	s.accel = gs.accel
+	s.screenleft = gs.screenleft
+	s.screenright = gs.screenright
+	s.xmin, s.xmax = gs.xmin, gs.xmax
+	s.winskipped = gs.winskipped
+	s.drawScale = gs.drawScale
+	s.zoomlag = gs.zoomlag
+	s.zoomScale = gs.zoomScale
+	s.zoomPosXLag = gs.zoomPosXLag
+	s.zoomPosYLag = gs.zoomPosYLag
+	s.enableZoomtime = gs.enableZoomtime
+	s.zoomCameraBound = gs.zoomCameraBound
+	s.zoomStageBound = gs.zoomStageBound
+	s.zoomPos = gs.zoomPos
+	s.cam = gs.cam
+	s.finish = gs.finish
+	s.waitdown = gs.waitdown
+	s.slowtime = gs.slowtime
+	s.shuttertime = gs.shuttertime
+	s.fadeintime = gs.fadeintime
+	s.fadeouttime = gs.fadeouttime
+	s.wintime = gs.wintime
+	s.changeStateNest = gs.changeStateNest
+	s.dialogueFlg = gs.dialogueFlg
+	s.dialogueForce = gs.dialogueForce
+	s.dialogueBarsFlg = gs.dialogueBarsFlg
+	s.aiInput = gs.aiInput
+	for i, v := range gs.cgi {
+		s.cgi[i].pctype, s.cgi[i].pctime, s.cgi[i].pcid = v.pctype, v.pctime, v.pcid
+		s.cgi[i].projidcount = v.projidcount
+	}
+	// Rounds that end again after loading are added to the results again
+	s.timerCount = append(s.timerCount[:0], gs.timerCount...)
+	s.timerRounds = append(s.timerRounds[:0], gs.timerRounds...)
+	s.scoreRounds = append(s.scoreRounds[:0], gs.scoreRounds...)
+	if s.matchData != nil {
+		for i := s.matchData.MaxN(); i >= int(gs.round); i-- {
+			s.matchData.RawSetInt(i, lua.LNil)
+		}
+	}
+
+	for i := range gs.chars {
+		s.chars[i] = append(s.chars[i][:0], gs.chars[i]...)
+	}
+	for c, cs := range gs.charData {
+		// Sounds that are already playing are left alone
+		sc := c.soundChannels
+		*c = cs.val.clone()
+		c.soundChannels = sc
+		if cs.remapSpr != nil {
+			for k := range cs.remapSpr {
+				delete(cs.remapSpr, k)
+			}
+			for k, v := range cs.val.remapSpr {
+				cs.remapSpr[k] = v.clone()
+			}
+			c.remapSpr = cs.remapSpr
+		}
+	}
+	for pfx, v := range gs.palfx {
+		*pfx = v.clone()
+	}
+	for a, v := range gs.anims {
+		*a = v
+	}
+	for hs, v := range gs.hitScales {
+		*hs = v
+	}
+	for cb, v := range gs.cmdBuffers {
+		*cb = v
+	}
+	for ir, v := range gs.inputs {
+		*ir = v
+	}
+	for cl, sc := range gs.commands {
+		for i := range sc.cmds {
+			for j := range sc.cmds[i] {
+				held := cl.Commands[i][j].held
+				cl.Commands[i][j] = sc.cmds[i][j]
+				cl.Commands[i][j].held = held
+				copy(held, sc.cmds[i][j].held)
+			}
+		}
+	}
+	for _, p := range gs.persistent {
+		copy(p[0], p[1])
+	}
+	gs.charList.copyTo(&s.charList)
+	for i := range gs.projs {
+		s.projs[i] = append(s.projs[i][:0], gs.projs[i]...)
+		for j := range s.projs[i] {
+			s.projs[i][j].aimg = gs.projs[i][j].aimg.clone()
+		}
+		s.explods[i] = append(s.explods[i][:0], gs.explods[i]...)
+		s.explDrawlist[i] = append(s.explDrawlist[i][:0], gs.explDrawlist[i]...)
+		s.topexplDrawlist[i] = append(s.topexplDrawlist[i][:0], gs.topexplDrawlist[i]...)
+		s.underexplDrawlist[i] = append(s.underexplDrawlist[i][:0], gs.underexplDrawlist[i]...)
+	}
+
+	s.stage.copyStageVars(&gs.stageVars)
+	s.stage.stageTime = gs.stageTime
+	s.stage.bga = gs.stageBga
+	for i, b := range s.stage.bg {
+		*b = gs.bgs[i]
+	}
+	copy(s.stage.bgc, gs.bgCtrls)
+	s.stage.bgct.line = cloneTimeLine(gs.bgctLine)
+	s.stage.bgct.al = append(s.stage.bgct.al[:0], gs.bgctActive...)
+
+	ro := s.lifebar.ro
+	ro.cur, ro.wt, ro.swt, ro.dt = gs.roundCur, gs.roundWt, gs.roundSwt, gs.roundDt
+	ro.timerActive, ro.introState = gs.roundTimerActive, gs.roundIntroState
+	for i, co := range s.lifebar.co {
+		v := gs.combo[i]
+		co.cur, co.old, co.curd, co.oldd, co.curp, co.oldp = v.cur, v.old, v.curd, v.oldd, v.curp, v.oldp
+		co.resttime, co.counterX, co.shaketime, co.combo = v.resttime, v.counterX, v.shaketime, v.combo
+	}
+	for i := range gs.scorePoints {
+		s.lifebar.sc[i].scorePoints = gs.scorePoints[i]
+		s.lifebar.wc[i].wins = gs.winCount[i]
+	}
+}
+
+// Saves the current match state to a numbered slot
+func (s *System) saveState(slot int32) {
+	if s.stateSlots == nil {
+		s.stateSlots = make(map[int32]*GameState)
+	}
+	gs := &GameState{}
+	gs.save()
+	s.stateSlots[slot] = gs
+}
+
+// Restores a state saved earlier in the current match. Netplay can not load
+// states, since the other player would not follow.
+func (s *System) loadState(slot int32) bool {
+	gs, ok := s.stateSlots[slot]
+	if !ok || s.netInput != nil || gs.stage != s.stage {
+		return false
+	}
+	gs.load()
+	return true
+}
+
+// Returns a copy of the char that shares no mutable slices or maps with it.
+// Pointers to palfx, animations and hit scales are kept as they are.
+func (c *Char) clone() (cc Char) {
+	cc = *c
+	cc.children = append([]*Char(nil), c.children...)
+	cc.targets = append([]int32(nil), c.targets...)
+	cc.hitdefTargets = append([]int32(nil), c.hitdefTargets...)
+	cc.hitdefTargetsBuffer = append([]int32(nil), c.hitdefTargetsBuffer...)
+	for i := range c.enemynear {
+		cc.enemynear[i] = append([]*Char(nil), c.enemynear[i]...)
+	}
+	cc.p2enemy = append([]*Char(nil), c.p2enemy...)
+	cc.ss.ps = append([]int32(nil), c.ss.ps...)
+	for i := range c.ss.wakegawakaranai {
+		cc.ss.wakegawakaranai[i] = append([]bool(nil), c.ss.wakegawakaranai[i]...)
+	}
+	cc.ss.sb.ctrlsps = append([]int32(nil), c.ss.sb.ctrlsps...)
+	cc.ghv.hitBy = append([][2]int32(nil), c.ghv.hitBy...)
+	if c.mapArray != nil {
+		cc.mapArray = make(map[string]float32, len(c.mapArray))
+		for k, v := range c.mapArray {
+			cc.mapArray[k] = v
+		}
+	}
+	if c.remapSpr != nil {
+		cc.remapSpr = make(RemapPreset, len(c.remapSpr))
+		for k, v := range c.remapSpr {
+			cc.remapSpr[k] = v.clone()
+		}
+	}
+	cc.clipboardText = append([]string(nil), c.clipboardText...)
+	cc.dialogue = append([]string(nil), c.dialogue...)
+	cc.sizeBox = append([]float32(nil), c.sizeBox...)
+	for _, m := range [...]*map[int32][3]*HitScale{&cc.nextHitScale, &cc.activeHitScale} {
+		if *m != nil {
+			tmp := make(map[int32][3]*HitScale, len(*m))
+			for k, v := range *m {
+				tmp[k] = v
+			}
+			*m = tmp
+		}
+	}
+	cc.aimg = c.aimg.clone()
+	return
+}
+
+// Copies the char list into cc, reusing the slices and map it already has
+func (cl *CharList) copyTo(cc *CharList) {
+	cc.runOrder = append(cc.runOrder[:0], cl.runOrder...)
+	cc.drawOrder = append(cc.drawOrder[:0], cl.drawOrder...)
+	if cc.idMap == nil {
+		cc.idMap = make(map[int32]*Char, len(cl.idMap))
+	} else {
+		for k := range cc.idMap {
+			delete(cc.idMap, k)
+		}
+	}
+	for k, v := range cl.idMap {
+		cc.idMap[k] = v
+	}
+}
+
+func (ai *AfterImage) clone() (ac AfterImage) {
+	ac = *ai
+	ac.palfx = make([]PalFX, len(ai.palfx))
+	for i := range ai.palfx {
+		ac.palfx[i] = ai.palfx[i].clone()
+	}
+	return
+}
+
+func (pf *PalFX) clone() (pc PalFX) {
+	pc = *pf
+	pc.remap = append([]int(nil), pf.remap...)
+	return
+}
+
+func (rt RemapTable) clone() RemapTable {
+	tmp := make(RemapTable, len(rt))
+	for k, v := range rt {
+		tmp[k] = v
+	}
+	return tmp
+}
+
+func cloneTimeLine(line []bgctNode) []bgctNode {
+	tmp := make([]bgctNode, len(line))
+	for i := range line {
+		tmp[i] = bgctNode{append([]*bgCtrl(nil), line[i].bgc...), line[i].waitTime}
+	}
+	return tmp
+}
+
+// Copies cmds into dst, reusing its slices where they have the same length
+func copyCommands(dst, cmds [][]Command) [][]Command {
+	if len(dst) != len(cmds) {
+		dst = make([][]Command, len(cmds))
+	}
+	for i := range cmds {
+		if len(dst[i]) != len(cmds[i]) {
+			dst[i] = make([]Command, len(cmds[i]))
+		}
+		for j := range cmds[i] {
+			held := dst[i][j].held
+			dst[i][j] = cmds[i][j]
+			dst[i][j].held = append(held[:0], cmds[i][j].held...)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,78 @@
+//go:build headless
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Saves the match, plays some frames, loads the save and plays the same
+// frames again, which have to come out the same
+func TestGameStateDeterminism(t *testing.T) {
+	const start, frames = 120, 180
+	var gs GameState
+	var played []*SyncState
+	n := 0
+	runTestMatch(t, 99*60, func() bool {
+		n++
+		switch {
+		case n == start-30 || n == start:
+			// The first save is overwritten, so the second one reuses its
+			// buffers
+			gs.save()
+		case n <= start:
+		case n <= start+frames:
+			played = append(played, newSyncState())
+			if n == start+frames {
+				gs.load()
+			}
+		default:
+			i := n - start - frames - 1
+			if d := played[i].diff(newSyncState()); len(d) > 0 {
+				t.Fatalf("frame %v played back differently after loading (first / second):\n%v",
+					start+i+1, strings.Join(d, "\n"))
+			}
+			return i < frames-1
+		}
+		return true
+	})
+	if n != start+frames*2 {
+		t.Fatalf("match ended after %v frames, expected %v", n, start+frames*2)
+	}
+	if played[0].hash() == played[frames-1].hash() {
+		t.Fatal("the match did not change while it was played")
+	}
+}
+
+// Loads a state saved in the first round once the second has started, which
+// takes back the results of the first round
+func TestGameStateRoundResults(t *testing.T) {
+	var gs GameState
+	n, loaded := 0, false
+	runTestMatch(t, 60, func() bool {
+		n++
+		if n == 10 {
+			gs.save()
+		}
+		if sys.round < 2 {
+			return n < 3000
+		}
+		if len(sys.scoreRounds) != 1 || sys.matchData.MaxN() != 1 {
+			t.Fatalf("round 2 started with %v score results and %v match data rounds",
+				len(sys.scoreRounds), sys.matchData.MaxN())
+		}
+		gs.load()
+		loaded = true
+		if sys.round != 1 || len(sys.scoreRounds) != 0 || len(sys.timerRounds) != 0 ||
+			len(sys.timerCount) != 0 || sys.matchData.MaxN() != 0 {
+			t.Errorf("round %v with %v score results, %v timer results, %v timer counts and %v match data rounds after loading",
+				sys.round, len(sys.scoreRounds), len(sys.timerRounds), len(sys.timerCount),
+				sys.matchData.MaxN())
+		}
+		return false
+	})
+	if !loaded {
+		t.Fatal("the first round did not end")
+	}
+}
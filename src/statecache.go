@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+// The states a character compiles to are kept in save/cache, one file per
+// .def file, so that selecting the character again, even in another session,
+// does not have to compile its .cns and .zss files and the common ones. A
+// cache file is only used if it was written by the same build of the engine
+// with the same settings, and if none of the files it was compiled from has
+// changed since. Set StateCache to false in the config or run with
+// -nostatecache to always compile.
+//
+// All values are little-endian:
+//
+//	[4]byte  magic "IKSC"
+//	uint16   format version
+//	string   engine ID, see stateCacheEngineID
+//	[32]byte SHA-256 of the constants and settings the states depend on
+//	uint16   number of source files, each a string path and [32]byte SHA-256
+//	int32    wakewakaLength of the char
+//	uint32   number of strings of the string pool, each a string
+//	uint32   number of states, each an int32 state number and the state
+//
+// where strings are a uint16 length and the bytes. Bytecode and state
+// controller parameters are a uint32 length and the bytes.
+const (
+	stateCacheMagic   = "IKSC"
+	stateCacheVersion = 1
+	stateCacheDir     = "save/cache"
+)
+
+// Tags of the state controllers in a cache file
+const (
+	scTag_bytes byte = iota // StateControllerBase types, followed by the name
+	scTag_block
+	scTag_expr
+	scTag_varAssign
+	scTag_callFunction
+	scTag_loopBreak
+	scTag_loopContinue
+	scTag_null
+)
+
+// State controllers made of their parameters only, by type name. Those not
+// listed here make the character's states uncacheable.
+var stateCacheTypes = func() map[string]reflect.Type {
+	m := make(map[string]reflect.Type)
+	for _, sc := range [...]StateController{afterImage{}, afterImageTime{},
+		allPalFX{}, angleAdd{}, angleDraw{}, angleMul{}, angleSet{},
+		appendToClipboard{}, assertCommand{}, assertInput{}, assertSpecial{},
+		attackDist{}, attackMulSet{}, bgPalFX{}, bindToParent{}, bindToRoot{},
+		bindToTarget{}, cameraCtrl{}, changeAnim{}, changeAnim2{}, changeState{},
+		clearClipboard{}, createPlatform{}, ctrlSet{}, defenceMulSet{},
+		destroySelf{}, dialogue{}, displayToClipboard{}, dizzyPointsAdd{},
+		dizzyPointsSet{}, dizzySet{}, envColor{}, envShake{}, explod{},
+		explodBindTime{}, fallEnvShake{}, forceFeedback{}, gameMakeAnim{},
+		getHitVarSet{}, gravity{}, groundLevelOffset{}, guardBreakSet{},
+		guardPointsAdd{}, guardPointsSet{}, height{}, helper{}, hitAdd{},
+		hitBy{}, hitDef{}, hitFallDamage{}, hitFallSet{}, hitFallVel{},
+		hitOverride{}, hitScaleSet{}, hitVelSet{}, lifeAdd{}, lifebarAction{},
+		lifeSet{}, loadFile{}, makeDust{}, mapSet{}, matchRestart{},
+		modifyBGCtrl{}, modifyBgm{}, modifyChar{}, modifyExplod{}, modifySnd{},
+		modifyStageVar{}, moveHitReset{}, notHitBy{}, offset{}, palFX{}, pause{},
+		playBgm{}, playerPush{}, playSnd{}, posAdd{}, posFreeze{}, posSet{},
+		powerAdd{}, powerSet{}, printToConsole{}, projectile{}, redLifeAdd{},
+		redLifeSet{}, remapPal{}, remapSprite{}, removeExplod{}, reversalDef{},
+		roundTimeAdd{}, roundTimeSet{}, saveFile{}, scoreAdd{}, screenBound{},
+		selfState{}, sndPan{}, sprPriority{}, stateTypeSet{}, stopSnd{},
+		superPause{}, tagIn{}, tagOut{}, targetAdd{}, targetBind{},
+		targetDizzyPointsAdd{}, targetDrop{}, targetFacing{},
+		targetGuardPointsAdd{}, targetLifeAdd{}, targetPowerAdd{},
+		targetRedLifeAdd{}, targetScoreAdd{}, targetState{}, targetVelAdd{},
+		targetVelSet{}, text{}, trans{}, turn{}, varRandom{}, varRangeSet{},
+		varSet{}, velAdd{}, velMul{}, velSet{}, victoryQuote{}, width{}, zoom{}} {
+		t := reflect.TypeOf(sc)
+		m[t.Name()] = t
+	}
+	return m
+}()
+
+// Identifies the build of the engine. Release builds have a version and a
+// build time, development builds only differ by their executable.
+var stateCacheEngineID = func() string {
+	id := Version + " " + BuildTime
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			id += fmt.Sprintf(" %v %v", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return id
+}()
+
+func stateCachePath(def string) string {
+	h := sha256.Sum256([]byte(filepath.ToSlash(filepath.Clean(def))))
+	return stateCacheDir + "/" + hex.EncodeToString(h[:8]) + ".stc"
+}
+
+// Hash of what the compiled states depend on besides the source files
+func stateCacheOptions(constants map[string]float32) (h [32]byte) {
+	var b bytes.Buffer
+	keys := make([]string, 0, len(constants))
+	for k := range constants {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		putReplayStr(&b, k)
+		binary.Write(&b, binary.LittleEndian, math.Float32bits(constants[k]))
+	}
+	binary.Write(&b, binary.LittleEndian, [...]bool{sys.ignoreMostErrors, sys.optimizeBytecode})
+	for _, list := range [...][]string{sys.commonStates, sys.commonCmd} {
+		binary.Write(&b, binary.LittleEndian, uint16(len(list)))
+		for _, s := range list {
+			putReplayStr(&b, s)
+		}
+	}
+	putReplayStr(&b, sys.motifDir)
+	putReplayStr(&b, sys.lifebar.def)
+	return sha256.Sum256(b.Bytes())
+}
+
+func hashFile(filename string) (h [32]byte, err error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	return sha256.Sum256(b), nil
+}
+
+type stateCacheEncoder struct {
+	b   bytes.Buffer
+	err error
+}
+
+func (e *stateCacheEncoder) write(v interface{}) {
+	binary.Write(&e.b, binary.LittleEndian, v)
+}
+
+func (e *stateCacheEncoder) bytes(b []byte) {
+	e.write(uint32(len(b)))
+	e.b.Write(b)
+}
+
+func (e *stateCacheEncoder) exp(be BytecodeExp) {
+	e.bytes(*(*[]byte)(unsafe.Pointer(&be)))
+}
+
+func (e *stateCacheEncoder) ctrls(ctrls []StateController) {
+	e.write(uint32(len(ctrls)))
+	for _, sc := range ctrls {
+		e.ctrl(sc)
+	}
+}
+
+func (e *stateCacheEncoder) ctrl(sc StateController) {
+	switch sc := sc.(type) {
+	case StateBlock:
+		e.write(scTag_block)
+		e.block(&sc)
+	case StateExpr:
+		e.write(scTag_expr)
+		e.exp(BytecodeExp(sc))
+	case varAssign:
+		e.write(scTag_varAssign)
+		e.write(sc.vari)
+		e.exp(sc.be)
+	case callFunction:
+		e.write(scTag_callFunction)
+		e.write([...]int32{sc.numVars, sc.numRets, sc.numArgs})
+		e.ctrls(sc.ctrls)
+		e.exp(sc.arg)
+		e.bytes(sc.ret)
+	case LoopBreak:
+		e.write(scTag_loopBreak)
+	case LoopContinue:
+		e.write(scTag_loopContinue)
+	case NullStateController:
+		e.write(scTag_null)
+	default:
+		v := reflect.ValueOf(sc)
+		if stateCacheTypes[v.Type().Name()] != v.Type() {
+			if e.err == nil {
+				e.err = Error(fmt.Sprintf("State controller %T can not be cached", sc))
+			}
+			return
+		}
+		e.write(scTag_bytes)
+		putReplayStr(&e.b, v.Type().Name())
+		e.bytes(v.Bytes())
+	}
+}
+
+func (e *stateCacheEncoder) block(b *StateBlock) {
+	e.write([...]int32{b.persistent, b.persistentIndex, b.ignorehitpause})
+	e.write(b.ctrlsIgnorehitpause)
+	e.exp(b.trigger)
+	e.write(b.elseBlock != nil)
+	if b.elseBlock != nil {
+		e.block(b.elseBlock)
+	}
+	e.ctrls(b.ctrls)
+	e.write([...]bool{b.loopBlock, b.nestedInLoop, b.forLoop, b.forAssign})
+	e.write(b.forCtrlVar.vari)
+	e.exp(b.forCtrlVar.be)
+	for _, be := range b.forExpression {
+		e.exp(be)
+	}
+	e.write([...]int32{b.forBegin, b.forEnd, b.forIncrement})
+}
+
+type stateCacheDecoder struct {
+	replayDecoder
+}
+
+func (d *stateCacheDecoder) bytes() []byte {
+	var n uint32
+	d.read(&n)
+	if d.err != nil {
+		return nil
+	}
+	if int64(n) > int64(d.r.Len()) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	io.ReadFull(d.r, b)
+	return b
+}
+
+func (d *stateCacheDecoder) exp() BytecodeExp {
+	b := d.bytes()
+	return *(*BytecodeExp)(unsafe.Pointer(&b))
+}
+
+func (d *stateCacheDecoder) ctrls() []StateController {
+	var n uint32
+	d.read(&n)
+	if d.err != nil || int64(n) > int64(d.r.Len()) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	var ctrls []StateController
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		ctrls = append(ctrls, d.ctrl())
+	}
+	return ctrls
+}
+
+func (d *stateCacheDecoder) ctrl() StateController {
+	var tag byte
+	d.read(&tag)
+	switch tag {
+	case scTag_bytes:
+		t, ok := stateCacheTypes[d.str()]
+		b := d.bytes()
+		if !ok {
+			if d.err == nil {
+				d.err = Error("Unknown state controller")
+			}
+			return NullStateController{}
+		}
+		v := reflect.New(t).Elem()
+		v.SetBytes(b)
+		return v.Interface().(StateController)
+	case scTag_block:
+		return *d.block()
+	case scTag_expr:
+		return StateExpr(d.exp())
+	case scTag_varAssign:
+		var va varAssign
+		d.read(&va.vari)
+		va.be = d.exp()
+		return va
+	case scTag_callFunction:
+		var cf callFunction
+		var n [3]int32
+		d.read(&n)
+		cf.numVars, cf.numRets, cf.numArgs = n[0], n[1], n[2]
+		cf.ctrls = d.ctrls()
+		cf.arg = d.exp()
+		cf.ret = d.bytes()
+		return cf
+	case scTag_loopBreak:
+		return LoopBreak{}
+	case scTag_loopContinue:
+		return LoopContinue{}
+	case scTag_null:
+		return NullStateController{}
+	}
+	if d.err == nil {
+		d.err = Error(fmt.Sprintf("Unknown state controller tag %v", tag))
+	}
+	return NullStateController{}
+}
+
+func (d *stateCacheDecoder) block() *StateBlock {
+	b := &StateBlock{}
+	var i [3]int32
+	d.read(&i)
+	b.persistent, b.persistentIndex, b.ignorehitpause = i[0], i[1], i[2]
+	d.read(&b.ctrlsIgnorehitpause)
+	b.trigger = d.exp()
+	var hasElse bool
+	d.read(&hasElse)
+	if hasElse && d.err == nil {
+		b.elseBlock = d.block()
+	}
+	b.ctrls = d.ctrls()
+	var f [4]bool
+	d.read(&f)
+	b.loopBlock, b.nestedInLoop, b.forLoop, b.forAssign = f[0], f[1], f[2], f[3]
+	d.read(&b.forCtrlVar.vari)
+	b.forCtrlVar.be = d.exp()
+	for j := range b.forExpression {
+		b.forExpression[j] = d.exp()
+	}
+	d.read(&i)
+	b.forBegin, b.forEnd, b.forIncrement = i[0], i[1], i[2]
+	return b
+}
+
+// Writes the compiled states of player pn to the cache
+func saveStateCache(pn int, def string, constants map[string]float32,
+	sources []string, states map[int32]StateBytecode) error {
+	e := &stateCacheEncoder{}
+	e.b.WriteString(stateCacheMagic)
+	e.write(uint16(stateCacheVersion))
+	putReplayStr(&e.b, stateCacheEngineID)
+	e.write(stateCacheOptions(constants))
+	e.write(uint16(len(sources)))
+	for _, s := range sources {
+		h, err := hashFile(s)
+		if err != nil {
+			return err
+		}
+		putReplayStr(&e.b, s)
+		e.write(h)
+	}
+	e.write(sys.cgi[pn].wakewakaLength)
+	e.write(uint32(len(sys.stringPool[pn].List)))
+	for _, s := range sys.stringPool[pn].List {
+		if len(s) > math.MaxUint16 {
+			return Error("String too long to be cached")
+		}
+		putReplayStr(&e.b, s)
+	}
+	nos := make([]int32, 0, len(states))
+	for no := range states {
+		nos = append(nos, no)
+	}
+	sort.Slice(nos, func(i, j int) bool { return nos[i] < nos[j] })
+	e.write(uint32(len(nos)))
+	for _, no := range nos {
+		sb := states[no]
+		e.write(no)
+		e.write([...]int32{int32(sb.stateType), int32(sb.moveType),
+			int32(sb.physics), sb.numVars})
+		e.bytes(sb.stateDef)
+		e.write(uint32(len(sb.ctrlsps)))
+		e.write(sb.ctrlsps)
+		e.block(&sb.block)
+	}
+	if e.err != nil {
+		return e.err
+	}
+	if err := os.MkdirAll(stateCacheDir, 0755); err != nil {
+		return err
+	}
+	// Written whole under another name first, as two players with the same
+	// character may be saving it at once
+	path := stateCachePath(def)
+	tmp := fmt.Sprintf("%v.%v.tmp", path, pn)
+	if err := os.WriteFile(tmp, e.b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Reads the states of player pn from the cache, or returns nil if they are
+// not cached or have to be compiled again
+func loadStateCache(pn int, def string, constants map[string]float32) map[int32]StateBytecode {
+	data, err := os.ReadFile(stateCachePath(def))
+	if err != nil || !bytes.HasPrefix(data, []byte(stateCacheMagic)) {
+		return nil
+	}
+	d := &stateCacheDecoder{replayDecoder{r: bytes.NewReader(data[len(stateCacheMagic):])}}
+	var ver uint16
+	var opts [32]byte
+	d.read(&ver)
+	if ver != stateCacheVersion || d.str() != stateCacheEngineID {
+		return nil
+	}
+	if d.read(&opts); opts != stateCacheOptions(constants) {
+		return nil
+	}
+	var n uint16
+	d.read(&n)
+	for i := uint16(0); i < n && d.err == nil; i++ {
+		s := d.str()
+		var h [32]byte
+		d.read(&h)
+		if cur, err := hashFile(s); err != nil || cur != h {
+			return nil
+		}
+	}
+	var wakewakaLength int32
+	var strs []string
+	d.read(&wakewakaLength)
+	var ns uint32
+	d.read(&ns)
+	for i := uint32(0); i < ns && d.err == nil; i++ {
+		strs = append(strs, d.str())
+	}
+	states := make(map[int32]StateBytecode)
+	d.read(&ns)
+	for i := uint32(0); i < ns && d.err == nil; i++ {
+		var no int32
+		var t [4]int32
+		d.read(&no)
+		d.read(&t)
+		sb := StateBytecode{stateType: StateType(t[0]), moveType: MoveType(t[1]),
+			physics: StateType(t[2]), playerNo: pn, no: no, numVars: t[3]}
+		sb.stateDef = d.bytes()
+		var nps uint32
+		d.read(&nps)
+		if d.err == nil && int64(nps)*4 <= int64(d.r.Len()) {
+			sb.ctrlsps = make([]int32, nps)
+			d.read(sb.ctrlsps)
+		} else {
+			d.err = io.ErrUnexpectedEOF
+		}
+		sb.block = *d.block()
+		states[no] = sb
+	}
+	if d.err != nil {
+		sys.errLog.Printf("Ignoring the state cache of %v: %v\n", def, d.err)
+		return nil
+	}
+	sys.stringPool[pn].Clear()
+	for _, s := range strs {
+		sys.stringPool[pn].Add(s)
+	}
+	sys.cgi[pn].wakewakaLength = wakewakaLength
+	return states
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Number of frames between the states compared by netplay peers and stored
+// in replays
+const stateHashInterval = 60
+
+// Values below -1 start a message in the netplay stream, which otherwise
+// carries InputBits and -1 when a peer stops sending
+const (
+	nmStateHash int32 = -2 // frame, hash
+	nmSyncState int32 = -3 // frame, number of words, words of the SyncState
+)
+
+// Largest SyncState accepted from the other player, in words
+const maxSyncWords = 1 << 16
+
+// Gameplay values of a char or helper
+type syncChar struct {
+	playerNo int32
+	id       int32
+	pos, vel [3]float32
+	life     int32
+	power    int32
+	stateno  int32
+	animNo   int32
+	animElem int32
+}
+
+// SyncState is the part of the match state that has to be the same on every
+// machine simulating the match. It is cheap to take and hash, so it can be
+// compared every few frames, and it is sent whole when the hashes differ so
+// the values that diverged can be logged.
+type SyncState struct {
+	randseed int32
+	gameTime int32
+	chars    []syncChar
+}
+
+func newSyncState() *SyncState {
+	ss := &SyncState{randseed: sys.randseed, gameTime: sys.gameTime}
+	for _, p := range sys.chars {
+		for _, c := range p {
+			sc := syncChar{playerNo: int32(c.playerNo), id: c.id, pos: c.pos,
+				vel: c.vel, life: c.life, power: c.power, stateno: c.ss.no,
+				animNo: c.animNo}
+			if c.anim != nil {
+				sc.animElem = c.anim.current + 1
+			}
+			ss.chars = append(ss.chars, sc)
+		}
+	}
+	return ss
+}
+
+// Number of words of a syncChar
+const syncCharWords = 13
+
+// Flattens the state into words, the form it is hashed, sent and stored in
+func (ss *SyncState) words() []int32 {
+	w := make([]int32, 0, 3+len(ss.chars)*syncCharWords)
+	w = append(w, ss.randseed, ss.gameTime, int32(len(ss.chars)))
+	for _, c := range ss.chars {
+		w = append(w, c.playerNo, c.id)
+		for _, f := range [...]float32{c.pos[0], c.pos[1], c.pos[2],
+			c.vel[0], c.vel[1], c.vel[2]} {
+			w = append(w, int32(math.Float32bits(f)))
+		}
+		w = append(w, c.life, c.power, c.stateno, c.animNo, c.animElem)
+	}
+	return w
+}
+
+func syncStateFromWords(w []int32) (*SyncState, error) {
+	if len(w) < 3 || w[2] < 0 || len(w) != 3+int(w[2])*syncCharWords {
+		return nil, Error("Invalid sync state")
+	}
+	ss := &SyncState{randseed: w[0], gameTime: w[1]}
+	f := func(i int) float32 { return math.Float32frombits(uint32(w[i])) }
+	for i := 3; i < len(w); i += syncCharWords {
+		ss.chars = append(ss.chars, syncChar{playerNo: w[i], id: w[i+1],
+			pos:  [3]float32{f(i + 2), f(i + 3), f(i + 4)},
+			vel:  [3]float32{f(i + 5), f(i + 6), f(i + 7)},
+			life: w[i+8], power: w[i+9], stateno: w[i+10], animNo: w[i+11],
+			animElem: w[i+12]})
+	}
+	return ss, nil
+}
+
+func (ss *SyncState) encode() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, ss.words())
+	return b.Bytes()
+}
+
+func decodeSyncState(data []byte) (*SyncState, error) {
+	if len(data)%4 != 0 {
+		return nil, Error("Invalid sync state")
+	}
+	w := make([]int32, len(data)/4)
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, w); err != nil {
+		return nil, err
+	}
+	return syncStateFromWords(w)
+}
+
+func (ss *SyncState) hash() uint32 {
+	return crc32.ChecksumIEEE(ss.encode())
+}
+
+// Lists the values that differ from another state, one per line, with this
+// state's value first
+func (ss *SyncState) diff(o *SyncState) (d []string) {
+	add := func(name string, a, b interface{}) {
+		if a != b {
+			d = append(d, fmt.Sprintf("  %v: %v / %v", name, a, b))
+		}
+	}
+	add("randseed", ss.randseed, o.randseed)
+	add("gametime", ss.gameTime, o.gameTime)
+	add("chars", len(ss.chars), len(o.chars))
+	for i := 0; i < len(ss.chars) && i < len(o.chars); i++ {
+		a, b := &ss.chars[i], &o.chars[i]
+		n := fmt.Sprintf("P%v id %v", a.playerNo+1, a.id)
+		add(n+" playerno", a.playerNo, b.playerNo)
+		add(n+" id", a.id, b.id)
+		add(n+" pos", a.pos, b.pos)
+		add(n+" vel", a.vel, b.vel)
+		add(n+" life", a.life, b.life)
+		add(n+" power", a.power, b.power)
+		add(n+" stateno", a.stateno, b.stateno)
+		add(n+" anim", a.animNo, b.animNo)
+		add(n+" animelem", a.animElem, b.animElem)
+	}
+	return
+}
+
+type syncMessage struct {
+	peer  *netPeer
+	frame int32
+	hash  uint32
+	state *SyncState // Set instead of hash when the states differed
+}
+
+// Reads a message from p started by tag, on the receiving goroutine
+func (ni *NetInput) readSyncMessage(p *netPeer, tag int32) error {
+	frame, err := p.conn.ReadI32()
+	if err != nil {
+		return err
+	}
+	msg := syncMessage{peer: p, frame: frame}
+	switch tag {
+	case nmStateHash:
+		var h int32
+		if h, err = p.conn.ReadI32(); err != nil {
+			return err
+		}
+		msg.hash = uint32(h)
+	case nmSyncState:
+		var n int32
+		if n, err = p.conn.ReadI32(); err != nil {
+			return err
+		}
+		if n < 0 || n > maxSyncWords {
+			return Error("Invalid sync state received")
+		}
+		w := make([]int32, n)
+		for i := range w {
+			if w[i], err = p.conn.ReadI32(); err != nil {
+				return err
+			}
+		}
+		if msg.state, err = syncStateFromWords(w); err != nil {
+			return err
+		}
+	default:
+		return Error(fmt.Sprintf("Unknown netplay message %v", tag))
+	}
+	// Desync detection is best effort, so messages are dropped rather than
+	// stalling the inputs
+	select {
+	case ni.syncIn <- msg:
+	default:
+	}
+	return nil
+}
+
+func (p *netPeer) sendSyncMessage(msg []int32) {
+	select {
+	case p.syncOut <- msg:
+	default:
+	}
+}
+
+// Number of hashed frames kept to compare with the ones of other machines
+const syncStatesKept = 8
+
+// Called once for every frame in order, when its inputs are final. Every
+// stateHashInterval frames the hash of the state before the frame is sent to
+// the other machines and written to the replay. ss is the state saved before
+// the frame, or nil if it is the current one.
+func (ni *NetInput) confirmFrame(t int32, ss *SyncState) {
+	if t%stateHashInterval == 0 {
+		if ss == nil {
+			ss = newSyncState()
+		}
+		ni.syncLocal[t] = ss
+		delete(ni.syncLocal, t-stateHashInterval*syncStatesKept)
+		for _, p := range ni.peers {
+			p.sendSyncMessage([]int32{nmStateHash, t, int32(ss.hash())})
+		}
+		for _, rw := range ni.writers() {
+			rw.writeSyncState(ss)
+		}
+	}
+	ni.receiveSync()
+	ni.writeReplayFrame(t)
+}
+
+// Compares the hashes received from the other machines with the local ones,
+// logging the first frame where they differ. Guests only compare with the
+// host, which compares with every guest.
+func (ni *NetInput) receiveSync() {
+	for {
+		select {
+		case msg := <-ni.syncIn:
+			if msg.state == nil {
+				msg.peer.syncRemote[msg.frame] = msg.hash
+			} else if ss := ni.syncLocal[msg.frame]; ss != nil {
+				sys.errLog.Printf("Desync at frame %v (local / remote):\n%v",
+					msg.frame, strings.Join(ss.diff(msg.state), "\n"))
+			}
+			continue
+		default:
+		}
+		break
+	}
+	for _, p := range ni.peers {
+		var frames []int32
+		for t := range p.syncRemote {
+			if ni.syncLocal[t] != nil {
+				frames = append(frames, t)
+			}
+		}
+		sort.Slice(frames, func(i, j int) bool { return frames[i] < frames[j] })
+		for _, t := range frames {
+			ss, h := ni.syncLocal[t], p.syncRemote[t]
+			delete(p.syncRemote, t)
+			if ss.hash() != h && ni.desync < 0 {
+				ni.desync = t
+				sys.errLog.Printf("Desync detected at frame %v: state hash %08x, remote %08x",
+					t, ss.hash(), h)
+				// Both machines detect it and send their state, so each can
+				// log what differs
+				w := ss.words()
+				p.sendSyncMessage(append([]int32{nmSyncState, t, int32(len(w))}, w...))
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"image"
 	"io"
@@ -16,7 +17,6 @@ import (
 	"time"
 
 	"github.com/ikemen-engine/beep"
-	"github.com/ikemen-engine/beep/speaker"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -64,6 +64,8 @@ var sys = System{
 	stageList:        make(map[int32]*Stage),
 	wincnt:           wincntMap(make(map[string][]int32)),
 	wincntFileName:   "save/autolevel.save",
+	trainingInput:    TrainingInput{recPlayer: -1, playPlayer: -1},
+	frameData:        FrameDataMeter{enabled: true},
 	powerShare:       [...]bool{true, true},
 	oldNextAddTime:   1,
 	commandLine:      make(chan string),
@@ -111,6 +113,7 @@ type System struct {
 	keepAspect              bool
 	window                  *Window
 	gameEnd, frameSkip      bool
+	headless                bool
 	redrawWait              struct{ nextTime, lastDraw time.Time }
 	brightness              int32
 	roundTime               int32
@@ -131,9 +134,19 @@ type System struct {
 	keyState                map[Key]bool
 	netInput                *NetInput
 	fileInput               *FileInput
+	botInput                *BotInput
+	trainingInput           TrainingInput
+	inputHistory            InputHistory
+	frameData               FrameDataMeter
+	recorder                *ReplayWriter // Records offline matches
+	recordFile              string
+	resimulating            bool
+	stateSlots              map[int32]*GameState
 	aiInput                 [MaxSimul*2 + MaxAttachedChar]AiInput
+	aiController            AIControllerType
 	keyConfig               []KeyConfig
 	joystickConfig          []KeyConfig
+	joystickSlots           JoystickSlots
 	com                     [MaxSimul*2 + MaxAttachedChar]float32
 	autolevel               bool
 	home                    int
@@ -160,6 +173,11 @@ type System struct {
 	esc                     bool
 	loadMutex               sync.Mutex
 	ignoreMostErrors        bool
+	stateCache              bool
+	optimizeBytecode        bool
+	bytecodeDump            string
+	debugger                *Debugger
+	profiler                *Profiler
 	stringPool              [MaxSimul*2 + MaxAttachedChar]StringPool
 	bcStack, bcVarStack     BytecodeStack
 	bcVar                   []BytecodeValue
@@ -299,10 +317,22 @@ type System struct {
 	fullscreenHeight      int32
 
 	// Input variables
-	controllerStickSensitivity float32
-	inputButtonAssist          bool
-	inputSOCDresolution        int32
-	xinputTriggerSensitivity   float32
+	inputDefaults            InputSettings   // For players without settings of their own
+	inputSettings            []InputSettings // Of each player's controls
+	matchInputSettings       [MaxSimul*2 + MaxAttachedChar]InputSettings
+	inputMacros              []InputMacros
+	allowMacros              bool  // Match rule, see currentAllowMacros
+	turboInterval            int32 // Frames turbo buttons stay pressed and released
+	xinputTriggerSensitivity float32
+
+	// Netplay variables
+	netplayInputDelay     int32
+	netplayLocalPlayers   int32 // Players on this machine
+	netplayPeers          int32 // Machines in a session hosted on this one
+	netplayRollbackFrames int32
+	netplayTransport      string // "tcp" or "udp"
+	netplaySpectatorPort  string
+	netplaySpectatorDelay int32
 
 	// Localcoord sceenpack
 	luaLocalcoord    [2]int32
@@ -433,9 +463,12 @@ func (s *System) init(w, h int32) *lua.LState {
 	// Now we proceed to init the render.
 	gfx.Init()
 	gfx.BeginFrame(false)
-	// And the audio.
-	speaker.Init(audioFrequency, audioOutLen)
-	speaker.Play(NewNormalizer(s.soundMixer))
+	// And the audio, which headless mode has no use for.
+	if s.headless {
+		s.frameSkip = true
+	} else {
+		speakerInit(NewNormalizer(s.soundMixer))
+	}
 	l := lua.NewState()
 	l.Options.IncludeGoStackTrace = true
 	l.OpenLibs()
@@ -487,9 +520,20 @@ func (s *System) shutdown() {
 	if !sys.gameEnd {
 		sys.gameEnd = true
 	}
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	if s.botInput != nil {
+		s.botInput.Close()
+	}
+	if s.debugger != nil {
+		s.debugger.Close()
+	}
 	gfx.Close()
 	s.window.Close()
-	speaker.Close()
+	if !s.headless {
+		speakerClose()
+	}
 }
 func (s *System) setWindowSize(w, h int32) {
 	s.scrrect[2], s.scrrect[3] = w, h
@@ -507,6 +551,7 @@ func (s *System) eventUpdate() bool {
 		v.Activate = false
 	}
 	s.window.pollEvents()
+	s.joystickSlots.update()
 	s.gameEnd = s.window.shouldClose()
 	return !s.gameEnd
 }
@@ -522,6 +567,13 @@ func (s *System) runMainThreadTask() {
 }
 
 func (s *System) await(fps int) bool {
+	if s.headless {
+		// Nothing is shown, so frames are simulated as fast as possible
+		s.frameSkip = true
+		s.runMainThreadTask()
+		s.eventUpdate()
+		return !s.gameEnd
+	}
 	if !s.frameSkip {
 		// Render the finished frame
 		gfx.EndFrame()
@@ -560,11 +612,21 @@ func (s *System) update() bool {
 	if s.gameTime == 0 {
 		s.preFightTime = s.frameCounter
 	}
+	if s.recorder != nil && s.netInput == nil && s.oldNextAddTime > 0 {
+		s.recorder.writeCaptured()
+	}
 	if s.fileInput != nil {
-		if s.anyHardButton() {
-			s.await(FPS * 4)
+		if s.fileInput.seeking() {
+			// Frames before the seek target are played without being shown
+			s.frameSkip = true
+			s.runMainThreadTask()
+			s.eventUpdate()
 		} else {
-			s.await(FPS)
+			fps := float32(FPS) * s.accel
+			if s.anyHardButton() {
+				fps *= 4
+			}
+			s.await(int(MaxF(1, fps)))
 		}
 		return s.fileInput.Update()
 	}
@@ -622,13 +684,57 @@ func (s *System) loadStart() {
 	s.loader.runTread()
 }
 func (s *System) synchronize() error {
-	if s.fileInput != nil {
-		s.fileInput.Synchronize()
-	} else if s.netInput != nil {
+	if s.netInput != nil {
 		return s.netInput.Synchronize()
 	}
+	if s.fileInput != nil && !s.fileInput.offline {
+		return s.fileInput.Synchronize()
+	}
+	return nil
+}
+
+// Synchronizes at the start of a fight. Offline recordings hold the fights
+// only, so they are written and played back from here, once per fight.
+func (s *System) synchronizeFight() error {
+	if s.fileInput != nil && s.fileInput.offline {
+		return s.fileInput.Synchronize()
+	}
+	if err := s.synchronize(); err != nil {
+		return err
+	}
+	// Offline matches are recorded with the current RNG state as the seed
+	if s.recordFile != "" && s.netInput == nil && s.fileInput == nil {
+		if s.recorder == nil {
+			var err error
+			if s.recorder, err = NewReplayWriter(s.recordFile); err != nil {
+				s.errLog.Println(err.Error())
+				s.recordFile = ""
+				return nil
+			}
+		}
+		m := newReplayMatch(s.randseed, s.preFightTime)
+		m.local = true
+		s.recorder.writeMatch(m)
+	}
 	return nil
 }
+
+// Records the end of round checksum to the replay, or checks it on playback
+func (s *System) replayChecksum() {
+	if s.fileInput != nil {
+		if err := s.fileInput.checkRound(); err != nil {
+			s.errLog.Println(err.Error())
+			s.esc = true
+		}
+	} else if s.netInput != nil {
+		for _, rw := range s.netInput.writers() {
+			rw.writeChecksum(s.round, roundChecksum())
+		}
+	}
+	if s.recorder != nil && s.netInput == nil {
+		s.recorder.writeChecksum(s.round, roundChecksum())
+	}
+}
 func (s *System) anyHardButton() bool {
 	for _, kc := range s.keyConfig {
 		if kc.a() || kc.b() || kc.c() || kc.x() || kc.y() || kc.z() {
@@ -939,6 +1045,44 @@ func (s *System) restoreAllVolume() {
 		}
 	}
 }
+
+type headlessResult struct {
+	Winner      int32        `json:"winner"`
+	WinTeam     int          `json:"winTeam"`
+	Wins        [2]int32     `json:"wins"`
+	Draws       int32        `json:"draws"`
+	Rounds      int32        `json:"rounds"`
+	ScoreRounds [][2]float32 `json:"scoreRounds"`
+	TimerRounds []int32      `json:"timerRounds"`
+	Frames      int32        `json:"frames"`
+	Chars       [2][]string  `json:"chars"`
+	// Hash of the final SyncState, to compare runs of the same match
+	StateHash string `json:"stateHash"`
+	// First frame where replay playback or netplay desynchronized
+	Desync *int32 `json:"desync,omitempty"`
+}
+
+// Writes the result of a match to stdout as a line of JSON, for tools that
+// run matches in headless mode. winp is the winner returned by game().
+func (s *System) printHeadlessResult(winp int32) {
+	r := headlessResult{Winner: winp, WinTeam: s.winTeam, Wins: s.wins, Draws: s.draws,
+		Rounds: s.round - 1, ScoreRounds: s.scoreRounds, TimerRounds: s.timerRounds,
+		Frames: s.gameTime, StateHash: fmt.Sprintf("%08x", newSyncState().hash())}
+	for i, p := range s.chars {
+		if len(p) > 0 && i < MaxSimul*2 {
+			r.Chars[i&1] = append(r.Chars[i&1], p[0].name)
+		}
+	}
+	if s.fileInput != nil && s.fileInput.desync >= 0 {
+		r.Desync = &s.fileInput.desync
+	} else if s.netInput != nil && s.netInput.desync >= 0 {
+		r.Desync = &s.netInput.desync
+	}
+	if b, err := json.Marshal(r); err == nil {
+		fmt.Println(string(b))
+	}
+}
+
 func (s *System) clearAllSound() {
 	s.soundChannels.StopAll()
 	s.stopAllSound()
@@ -1117,6 +1261,18 @@ func (s *System) addFrameTime(t float32) bool {
 	s.nextAddTime = t
 	return true
 }
+
+// Runs the game logic of one input frame without rendering it
+func (s *System) resimulate() {
+	for {
+		s.bgPalFX.step()
+		s.stage.action()
+		s.action()
+		if s.addFrameTime(s.turbo) {
+			break
+		}
+	}
+}
 func (s *System) resetFrameTime() {
 	s.tickCount, s.oldTickCount, s.tickCountF, s.lastTick, s.absTickCountF = 0, -1, 0, 0, 0
 	s.nextAddTime, s.oldNextAddTime = 1, 1
@@ -1159,9 +1315,15 @@ func (s *System) commandUpdate() {
 					}
 					for j := range c.cmd {
 						c.cmd[j].Step(int32(c.facing), c.key < 0, hp, buftime+Btoi(hp))
+						if s.matchInputSettings[i].SimpleSpecials && s.com[i] == 0 {
+							c.cmd[j].StepSimpleSpecials()
+						}
 					}
 				}
 			}
+			if s.recorder != nil && s.netInput == nil && r.cmd[0].Buffer != nil {
+				s.recorder.capture(i, r.cmd[0].Buffer.bits(int32(r.facing)))
+			}
 			if r.key < 0 {
 				cc := int32(-1)
 				// AI Scaling
@@ -1179,6 +1341,8 @@ func (s *System) commandUpdate() {
 			}
 		}
 	}
+	s.trainingInput.update()
+	s.inputHistory.update()
 }
 func (s *System) charUpdate() {
 	s.charList.update()
@@ -1668,6 +1832,11 @@ func (s *System) action() {
 
 	if s.tickNextFrame() {
 		spd := s.gameSpeed * s.accel
+		// Replays are sped up by playing frames faster instead, since each
+		// recorded input has to last as many ticks as it did when recorded
+		if s.fileInput != nil {
+			spd = s.gameSpeed
+		}
 		if s.postMatchFlg {
 			spd = 1
 		} else if !s.gsf(GSF_nokoslow) && s.time != 0 && s.intro < 0 && s.slowtime > 0 {
@@ -1936,8 +2105,12 @@ func (s *System) fight() (reload bool) {
 	// Reset variables
 	s.gameTime, s.paused, s.accel = 0, false, 1
 	s.aiInput = [len(s.aiInput)]AiInput{}
+	s.stateSlots = nil
 	// Defer resetting variables on return
 	defer func() {
+		if s.recorder != nil {
+			s.recorder.fighting = false
+		}
 		s.oldNextAddTime = 1
 		s.nomusic = false
 		s.allPalFX.clear()
@@ -2005,13 +2178,17 @@ func (s *System) fight() (reload bool) {
 			}
 		default:
 		}
+		if s.debugger != nil {
+			s.debugger.poll()
+		}
 	}
 
 	// Synchronize with external inputs (netplay, replays, etc)
-	if err := s.synchronize(); err != nil {
+	if err := s.synchronizeFight(); err != nil {
 		s.errLog.Println(err.Error())
 		s.esc = true
 	}
+	resolveInputSettings()
 	if s.netInput != nil {
 		defer s.netInput.Stop()
 	}
@@ -2207,6 +2384,9 @@ func (s *System) fight() (reload bool) {
 		s.reloadFlg, s.reloadStageFlg, s.reloadLifebarFlg = false, false, false
 	}
 	reset()
+	if s.netInput != nil {
+		s.netInput.startRollback()
+	}
 
 	// Loop until end of match
 	fin := false
@@ -2222,6 +2402,7 @@ func (s *System) fight() (reload bool) {
 
 		// If next round
 		if s.roundOver() && !fin {
+			s.replayChecksum()
 			s.round++
 			for i := range s.roundsExisted {
 				s.roundsExisted[i]++
@@ -2311,6 +2492,19 @@ func (s *System) fight() (reload bool) {
 		// Update game state
 		s.action()
 
+		// Send the new state to the bots and get their next inputs
+		if s.botInput != nil && s.fileInput == nil && s.netInput == nil {
+			s.botInput.Update()
+		}
+
+		// Measure the attacks of the tick for the frame data
+		if s.tickFrame() {
+			s.frameData.update()
+			if s.profiler != nil {
+				s.profiler.frames++
+			}
+		}
+
 		// F4 pressed to restart round
 		if s.roundResetFlg && !s.postMatchFlg {
 			sys.paused = false
@@ -2937,6 +3131,23 @@ func (s *Select) AddSelectedChar(tn, cn, pl int) bool {
 	sys.loadMutex.Unlock()
 	return true
 }
+
+// Adds the character at def to team side tn, whether it is on the select
+// screen or not
+func (s *Select) addSelectedDef(tn int, def string, pl int) {
+	n := 0
+	for i := range s.charlist {
+		if s.charlist[i].def == def {
+			n = i
+			break
+		}
+	}
+	sys.loadMutex.Lock()
+	s.cdefOverwrite[len(s.selected[tn])*2+tn] = def
+	s.selected[tn] = append(s.selected[tn], [...]int{n, pl})
+	s.ocd[tn] = append(s.ocd[tn], *newOverrideCharData())
+	sys.loadMutex.Unlock()
+}
 func (s *Select) ClearSelected() {
 	sys.loadMutex.Lock()
 	s.selected = [2][][2]int{}
@@ -1,4 +1,4 @@
-//go:build !kinc
+//go:build !kinc && !headless
 
 package main
 
@@ -9,6 +9,9 @@ import (
 	glfw "github.com/go-gl/glfw/v3.3/glfw"
 )
 
+// Matches are only run headless by the builds with the headless tag
+const headlessBackend = false
+
 type Window struct {
 	*glfw.Window
 	title      string
@@ -69,6 +72,7 @@ func (s *System) newWindow(w, h int) (*Window, error) {
 	window.MakeContextCurrent()
 	window.SetKeyCallback(keyCallback)
 	window.SetCharModsCallback(charCallback)
+	glfw.SetJoystickCallback(joystickCallback)
 
 	// V-Sync
 	if s.vRetrace >= 0 {
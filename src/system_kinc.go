@@ -1,4 +1,4 @@
-//go:build kinc
+//go:build kinc && !headless
 
 package main
 
@@ -22,6 +22,8 @@ extern uint8_t close_callback(void *);
 */
 import "C"
 
+const headlessBackend = false
+
 type Window struct {
 	width      int
 	height     int
@@ -72,6 +74,7 @@ func (w *Window) toggleFullscreen() {
 
 func (w *Window) pollEvents() {
 	C.kinc_internal_frame()
+	input.pollConnections()
 }
 
 func (w *Window) shouldClose() bool {
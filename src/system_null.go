@@ -0,0 +1,49 @@
+//go:build headless
+
+package main
+
+import (
+	"image"
+)
+
+// Headless builds have no window, so matches always run in headless mode
+const headlessBackend = true
+
+type Window struct {
+	fullscreen bool
+	w, h       int
+}
+
+func (s *System) newWindow(w, h int) (*Window, error) {
+	return &Window{false, w, h}, nil
+}
+
+func (w *Window) SwapBuffers() {
+}
+
+func (w *Window) SetIcon(icon []image.Image) {
+}
+
+func (w *Window) SetSwapInterval(interval int) {
+}
+
+func (w *Window) GetSize() (int, int) {
+	return w.w, w.h
+}
+
+func (w *Window) GetClipboardString() string {
+	return ""
+}
+
+func (w *Window) toggleFullscreen() {
+}
+
+func (w *Window) pollEvents() {
+}
+
+func (w *Window) shouldClose() bool {
+	return false
+}
+
+func (w *Window) Close() {
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NetTransport is the connection to the other player. NetInput exchanges an
+// ordered stream of int32 values over it: the synchronization values, one
+// InputBits per frame and the desync detection messages.
+type NetTransport interface {
+	ReadI32() (int32, error)
+	WriteI32(int32) error
+	Close() error
+}
+
+type tcpTransport struct {
+	conn *net.TCPConn
+}
+
+func (t *tcpTransport) ReadI32() (int32, error) {
+	b := [4]byte{}
+	if _, err := io.ReadFull(t.conn, b[:]); err != nil {
+		return 0, err
+	}
+	return int32(binary.LittleEndian.Uint32(b[:])), nil
+}
+
+func (t *tcpTransport) WriteI32(i32 int32) error {
+	b := [4]byte{}
+	binary.LittleEndian.PutUint32(b[:], uint32(i32))
+	_, err := t.conn.Write(b[:])
+	return err
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// The UDP transport keeps the stream ordered without the head-of-line
+// blocking of TCP. Every packet carries all the values the other player has
+// not acknowledged yet, so a lost packet is made up for by the next one,
+// which is normally sent a frame later, instead of by a retransmission.
+//
+// Packets start with a type byte. Data packets follow it with the number of
+// values received from the other player (the ack), the sequence number of the
+// first value in the packet and the values.
+const (
+	udpHello byte = iota // Sent until the other player answers with one
+	udpData
+	udpBye
+)
+
+const (
+	// Most values sent in one packet. A peer that falls further behind than
+	// this catches up over several packets.
+	udpMaxValues = 256
+	// Unacknowledged values are sent again after this long without a packet
+	udpResendTime = 20 * time.Millisecond
+	// Time between packets when there is nothing to send
+	udpKeepAlive = 250 * time.Millisecond
+	// The connection is dropped after this long without hearing from the
+	// other player
+	udpTimeout = 5 * time.Second
+	// Values received but not read yet, beyond which new ones are not
+	// acknowledged
+	udpRecvBuffer = 1024
+)
+
+// udpSocket reads the packets arriving on a UDP socket and hands them to the
+// transport of the address they came from. The host serves every guest from
+// its listening socket.
+type udpSocket struct {
+	conn      *net.UDPConn
+	connected bool // Dialed, so it only exchanges packets with one address
+	mu        sync.Mutex
+	peers     map[string]*udpTransport
+	hello     chan *net.UDPAddr // Addresses of new players saying hello
+	err       error
+}
+
+type udpTransport struct {
+	sock     *udpSocket
+	addr     *net.UDPAddr
+	loss     float32 // Fraction of outgoing packets to drop, for testing
+	answer   bool    // Whether to answer hellos, done by the listening side
+	greeted  chan struct{}
+	mu       sync.Mutex
+	out      []int32   // Values not acknowledged by the other player yet
+	outSeq   uint32    // Sequence number of out[0]
+	inSeq    uint32    // Sequence number of the next value expected
+	acked    bool      // Whether inSeq has been acknowledged
+	sent     time.Time // When the last packet was sent
+	received time.Time // When the last packet arrived
+	in       chan int32
+	done     chan struct{}
+	err      error
+}
+
+func newUDPSocket(conn *net.UDPConn, connected bool) *udpSocket {
+	s := &udpSocket{conn: conn, connected: connected,
+		peers: map[string]*udpTransport{}, hello: make(chan *net.UDPAddr, 16)}
+	go s.read()
+	return s
+}
+
+func (s *udpSocket) read() {
+	b := make([]byte, 9+udpMaxValues*4)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			peers := s.peers
+			s.peers = map[string]*udpTransport{}
+			s.mu.Unlock()
+			for _, t := range peers {
+				t.fail(err)
+			}
+			close(s.hello)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		s.mu.Lock()
+		t := s.peers[addr.String()]
+		s.mu.Unlock()
+		if t != nil {
+			t.handle(b[:n])
+		} else if b[0] == udpHello {
+			select {
+			case s.hello <- addr:
+			default:
+			}
+		}
+	}
+}
+
+// Creates the transport to the player at addr. answer is set before the
+// socket can hand the transport any packet.
+func (s *udpSocket) add(addr *net.UDPAddr, answer bool) *udpTransport {
+	t := &udpTransport{sock: s, addr: addr, answer: answer, acked: true,
+		received: time.Now(), greeted: make(chan struct{}),
+		in: make(chan int32, udpRecvBuffer), done: make(chan struct{})}
+	if p, err := strconv.ParseFloat(sys.cmdFlags["-netloss"], 32); err == nil {
+		t.loss = ClampF(float32(p), 0, 100) / 100
+	}
+	s.mu.Lock()
+	s.peers[addr.String()] = t
+	s.mu.Unlock()
+	go t.keepAlive()
+	return t
+}
+
+// Waits for a hello from a new player and answers it
+func (s *udpSocket) accept() (*udpTransport, error) {
+	for addr := range s.hello {
+		s.mu.Lock()
+		_, known := s.peers[addr.String()]
+		s.mu.Unlock()
+		if !known {
+			t := s.add(addr, true)
+			t.write([]byte{udpHello})
+			return t, nil
+		}
+	}
+	return nil, s.err
+}
+
+func (s *udpSocket) Close() error {
+	return s.conn.Close()
+}
+
+// Sends hellos to a listening player until one comes back
+func dialUDP(conn *net.UDPConn) (*udpTransport, error) {
+	t := newUDPSocket(conn, true).add(conn.RemoteAddr().(*net.UDPAddr), false)
+	for start := time.Now(); time.Since(start) < udpTimeout; {
+		if err := t.write([]byte{udpHello}); err != nil {
+			return nil, err
+		}
+		select {
+		case <-t.greeted:
+			return t, nil
+		case <-t.done:
+			return nil, t.err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil, Error("Can not connect to the other player")
+}
+
+func (t *udpTransport) ReadI32() (int32, error) {
+	select {
+	case v := <-t.in:
+		return v, nil
+	case <-t.done:
+		// Values that arrived before the connection ended are still read
+		select {
+		case v := <-t.in:
+			return v, nil
+		default:
+		}
+		return 0, t.err
+	}
+}
+
+func (t *udpTransport) WriteI32(i32 int32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.out = append(t.out, i32)
+	return t.sendLocked()
+}
+
+func (t *udpTransport) Close() error {
+	t.mu.Lock()
+	if t.err == nil {
+		// The bye is not acknowledged, so it is sent a few times
+		for i := 0; i < 3; i++ {
+			t.write([]byte{udpBye})
+		}
+	}
+	t.mu.Unlock()
+	t.fail(io.EOF)
+	t.sock.mu.Lock()
+	delete(t.sock.peers, t.addr.String())
+	t.sock.mu.Unlock()
+	if t.sock.connected {
+		return t.sock.Close()
+	}
+	return nil
+}
+
+func (t *udpTransport) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+		close(t.done)
+	}
+}
+
+func (t *udpTransport) write(b []byte) error {
+	if t.loss > 0 && rand.Float32() < t.loss {
+		return nil
+	}
+	var err error
+	if t.sock.connected {
+		_, err = t.sock.conn.Write(b)
+	} else {
+		_, err = t.sock.conn.WriteToUDP(b, t.addr)
+	}
+	return err
+}
+
+// Sends the unacknowledged values along with the ack. t.mu must be held.
+func (t *udpTransport) sendLocked() error {
+	n := Min(int32(len(t.out)), udpMaxValues)
+	b := make([]byte, 9+n*4)
+	b[0] = udpData
+	binary.LittleEndian.PutUint32(b[1:], t.inSeq)
+	binary.LittleEndian.PutUint32(b[5:], t.outSeq)
+	for i, v := range t.out[:n] {
+		binary.LittleEndian.PutUint32(b[9+i*4:], uint32(v))
+	}
+	t.acked, t.sent = true, time.Now()
+	return t.write(b)
+}
+
+// Processes a packet from the other player, on the goroutine of the socket
+func (t *udpTransport) handle(b []byte) {
+	t.mu.Lock()
+	t.received = time.Now()
+	t.mu.Unlock()
+	switch b[0] {
+	case udpHello:
+		if t.answer {
+			// The other player missed our answer to their hello
+			t.mu.Lock()
+			t.write([]byte{udpHello})
+			t.mu.Unlock()
+		} else {
+			select {
+			case <-t.greeted:
+			default:
+				close(t.greeted)
+			}
+		}
+	case udpBye:
+		t.fail(io.EOF)
+	case udpData:
+		if len(b) >= 9 && (len(b)-9)%4 == 0 {
+			t.receiveData(b)
+		}
+	}
+}
+
+func (t *udpTransport) receiveData(b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Drop the values the other player has received
+	if ack := binary.LittleEndian.Uint32(b[1:]); int32(ack-t.outSeq) > 0 &&
+		int(ack-t.outSeq) <= len(t.out) {
+		t.out = t.out[ack-t.outSeq:]
+		t.outSeq = ack
+	}
+	seq := binary.LittleEndian.Uint32(b[5:])
+	for i := 9; i < len(b); i, seq = i+4, seq+1 {
+		// Values already received are skipped, and ones after a gap wait for
+		// the packet that fills it to be sent again
+		if seq != t.inSeq {
+			if int32(seq-t.inSeq) > 0 {
+				break
+			}
+			continue
+		}
+		select {
+		case t.in <- int32(binary.LittleEndian.Uint32(b[i:])):
+			t.inSeq++
+			t.acked = false
+		default:
+			return
+		}
+	}
+}
+
+// Resends unacknowledged values and acknowledges received ones when no data
+// has been sent for a while, keeps the connection alive when idle and drops
+// it when the other player has not been heard from for too long
+func (t *udpTransport) keepAlive() {
+	tick := time.NewTicker(5 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-tick.C:
+		}
+		t.mu.Lock()
+		if time.Since(t.received) >= udpTimeout {
+			t.mu.Unlock()
+			t.fail(Error("Connection to the other player timed out"))
+			return
+		}
+		since := time.Since(t.sent)
+		if since >= udpKeepAlive || since >= udpResendTime && (len(t.out) > 0 || !t.acked) {
+			// Failed sends are retried on the next tick
+			t.sendLocked()
+		}
+		t.mu.Unlock()
+	}
+}
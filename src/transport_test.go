@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects two UDP transports over the loopback interface, dropping the given
+// percentage of the packets each sends as -netloss does
+func testUDPPair(t *testing.T, loss string) (host, guest *udpTransport) {
+	sys.cmdFlags["-netloss"] = loss
+	defer delete(sys.cmdFlags, "-netloss")
+	hostConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := newUDPSocket(hostConn, false)
+	t.Cleanup(func() { sock.Close() })
+	accepted := make(chan *udpTransport, 1)
+	go func() {
+		h, _ := sock.accept()
+		accepted <- h
+	}()
+	guestConn, err := net.DialUDP("udp", nil, hostConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guest, err = dialUDP(guestConn); err != nil {
+		guestConn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { guest.Close() })
+	if host = <-accepted; host == nil {
+		t.Fatal("the host did not accept the guest")
+	}
+	t.Cleanup(func() { host.Close() })
+	return
+}
+
+// Reads n values from t, which have to be 0 to n-1 in order
+func testReadValues(t *testing.T, tr *udpTransport, n int32) {
+	for i := int32(0); i < n; i++ {
+		v, err := tr.ReadI32()
+		if err != nil {
+			t.Fatalf("value %v: %v", i, err)
+		}
+		if v != i {
+			t.Fatalf("value %v is %v", i, v)
+		}
+	}
+}
+
+// Values sent both ways arrive in order and are all acknowledged, with a
+// third of the packets lost
+func TestUDPTransportLoss(t *testing.T) {
+	host, guest := testUDPPair(t, "30")
+	const n = 1000
+	go func() {
+		for i := int32(0); i < n; i++ {
+			guest.WriteI32(i)
+		}
+	}()
+	for i := int32(0); i < n; i++ {
+		host.WriteI32(i)
+	}
+	testReadValues(t, host, n)
+	testReadValues(t, guest, n)
+	for _, tr := range []*udpTransport{host, guest} {
+		for deadline := time.Now().Add(2 * time.Second); ; {
+			tr.mu.Lock()
+			left := len(tr.out)
+			tr.mu.Unlock()
+			if left == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%v values are never acknowledged", left)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// A value whose packet never left is sent again
+func TestUDPTransportResend(t *testing.T) {
+	host, guest := testUDPPair(t, "")
+	guest.mu.Lock()
+	guest.out = append(guest.out, 0)
+	guest.mu.Unlock()
+	testReadValues(t, host, 1)
+}
+
+// The connection is dropped when the other player stops sending
+func TestUDPTransportTimeout(t *testing.T) {
+	host, guest := testUDPPair(t, "")
+	host.fail(Error("stopped by the test"))
+	time.Sleep(50 * time.Millisecond)
+	// Instead of waiting for the timeout
+	guest.mu.Lock()
+	guest.received = time.Now().Add(-udpTimeout)
+	guest.mu.Unlock()
+	if _, err := guest.ReadI32(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("read after the timeout: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build headless && !js && !raw
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Log writer implementation
+func NewLogWriter() io.Writer {
+	return os.Stderr
+}
+
+// Message box implementation using stderr
+func ShowInfoDialog(message, title string) {
+	fmt.Fprintln(os.Stderr, title+"\n\n"+message)
+}
+
+func ShowErrorDialog(message string) {
+	fmt.Fprintln(os.Stderr, "I.K.E.M.E.N Error\n\n"+message)
+}
+
+// TrueType font that is measured but never drawn
+type nullTtf struct {
+	height int32
+}
+
+func (t *nullTtf) SetColor(red float32, green float32, blue float32, alpha float32) {
+}
+
+func (t *nullTtf) Width(scale float32, fs string, argv ...interface{}) float32 {
+	return float32(len([]rune(fmt.Sprintf(fs, argv...)))) * float32(t.height) / 2 * scale
+}
+
+func (t *nullTtf) Printf(x, y float32, scale float32, align int32, blend bool, window [4]int32, fs string, argv ...interface{}) error {
+	return nil
+}
+
+// TTF font loading
+func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) {
+	if height == -1 {
+		height = int32(f.Size[1])
+	} else {
+		f.Size[1] = uint16(height)
+	}
+	f.ttf = &nullTtf{height}
+
+	// Create Ttf dummy palettes
+	f.palettes = make([][256]uint32, 1)
+}